@@ -0,0 +1,172 @@
+// cache.go - Katzenpost non-voting authority client document cache.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/katzenpost/authority/nonvoting/internal/s11n"
+	"github.com/katzenpost/core/pki"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	cacheFilePrefix = "consensus-"
+	cacheFileSuffix = ".jws"
+
+	// cacheRetainEpochs is the number of epochs prior to the current epoch
+	// that are retained.  The authority serves Documents for the previous,
+	// current and next epochs.
+	cacheRetainEpochs = 2
+)
+
+// docCache is an on-disk cache of serialized Documents.  As the cache
+// directory is not trusted, Documents are re-verified each time they are
+// loaded.
+type docCache struct {
+	sync.Mutex
+
+	dir      string
+	clock    epochClock
+	verifyFn func([]byte) (*pki.Document, error)
+	log      *logging.Logger
+}
+
+// isRetained returns true iff Documents for the epoch are of interest.  This
+// is bounded by the current epoch, rather than by what is in the cache
+// directory, as the file names are not trusted.
+func (dc *docCache) isRetained(epoch uint64) bool {
+	now, _, _ := dc.clock()
+	return epoch+cacheRetainEpochs >= now && epoch <= now+1
+}
+
+func (dc *docCache) path(epoch uint64) string {
+	return filepath.Join(dc.dir, fmt.Sprintf("%s%d%s", cacheFilePrefix, epoch, cacheFileSuffix))
+}
+
+// get returns the cached Document for the epoch, if any.
+func (dc *docCache) get(epoch uint64) (*pki.Document, []byte) {
+	dc.Lock()
+	defer dc.Unlock()
+
+	p := dc.path(epoch)
+	raw, err := ioutil.ReadFile(p)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			dc.log.Warningf("Failed to read cached document for epoch %v: %v", epoch, err)
+		}
+		return nil, nil
+	}
+
+	doc, err := dc.verifyFn(raw)
+	if err == nil && doc.Epoch != epoch {
+		err = s11n.ErrInvalidEpoch
+	}
+	if err != nil {
+		dc.log.Warningf("Discarding invalid cached document for epoch %v: %v", epoch, err)
+		os.Remove(p)
+		return nil, nil
+	}
+	dc.log.Debugf("Loaded cached document for epoch %v.", epoch)
+
+	return doc, raw
+}
+
+// put caches the verified serialized Document for the epoch, and evicts
+// Documents for epochs that are no longer of interest.
+func (dc *docCache) put(epoch uint64, raw []byte) {
+	dc.Lock()
+	defer dc.Unlock()
+
+	if !dc.isRetained(epoch) {
+		return
+	}
+
+	// Write the Document atomically, so that a partially written file is
+	// never loaded.
+	p := dc.path(epoch)
+	f, err := ioutil.TempFile(dc.dir, cacheFilePrefix)
+	if err != nil {
+		dc.log.Warningf("Failed to cache document for epoch %v: %v", epoch, err)
+		return
+	}
+	if _, err = f.Write(raw); err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		dc.log.Warningf("Failed to cache document for epoch %v: %v", epoch, err)
+		os.Remove(f.Name())
+		return
+	}
+
+	dc.prune()
+}
+
+func (dc *docCache) prune() {
+	fis, err := ioutil.ReadDir(dc.dir)
+	if err != nil {
+		dc.log.Warningf("Failed to read cache directory: %v", err)
+		return
+	}
+
+	for _, fi := range fis {
+		n := fi.Name()
+		if !strings.HasPrefix(n, cacheFilePrefix) || !strings.HasSuffix(n, cacheFileSuffix) {
+			continue
+		}
+		epoch, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(n, cacheFilePrefix), cacheFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		if !dc.isRetained(epoch) {
+			dc.log.Debugf("Evicting cached document for epoch %v.", epoch)
+			os.Remove(filepath.Join(dc.dir, n))
+		}
+	}
+}
+
+func newDocCache(dir string, clock epochClock, verifyFn func([]byte) (*pki.Document, error), log *logging.Logger) (*docCache, error) {
+	const dirMode = 0700
+
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return nil, fmt.Errorf("nonvoting/client: failed to create CacheDir: %v", err)
+	}
+	if fi, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("nonvoting/client: failed to stat() CacheDir: %v", err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("nonvoting/client: CacheDir '%v' is not a directory", dir)
+	}
+
+	return &docCache{
+		dir:      dir,
+		clock:    clock,
+		verifyFn: verifyFn,
+		log:      log,
+	}, nil
+}
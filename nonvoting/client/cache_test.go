@@ -0,0 +1,143 @@
+// cache_test.go - Non-voting authority client document cache tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCacheDoc returns a serialized test Document for the epoch, that
+// testCacheVerify will accept.
+func testCacheDoc(epoch uint64) []byte {
+	return []byte("doc-" + strconv.FormatUint(epoch, 10))
+}
+
+func testCacheVerify(raw []byte) (*pki.Document, error) {
+	s := string(raw)
+	if !strings.HasPrefix(s, "doc-") {
+		return nil, errors.New("invalid document")
+	}
+	epoch, err := strconv.ParseUint(strings.TrimPrefix(s, "doc-"), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &pki.Document{Epoch: epoch}, nil
+}
+
+func newTestCache(t *testing.T, now *uint64) (*docCache, func()) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "authority-cache-test-")
+	require.NoError(err, "TempDir()")
+	logBackend, err := log.New("", "DEBUG", true)
+	require.NoError(err, "log.New()")
+
+	clock := func() (uint64, time.Duration, time.Duration) {
+		return *now, 0, time.Hour
+	}
+	dc, err := newDocCache(filepath.Join(dir, "cache"), clock, testCacheVerify, logBackend.GetLogger("cache"))
+	require.NoError(err, "newDocCache()")
+	return dc, func() { os.RemoveAll(dir) }
+}
+
+func TestDocCache(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	now := uint64(10)
+	dc, cleanupFn := newTestCache(t, &now)
+	defer cleanupFn()
+
+	// Documents are written through, and loaded.
+	doc, raw := dc.get(10)
+	assert.Nil(doc, "get(): empty")
+	dc.put(10, testCacheDoc(10))
+	doc, raw = dc.get(10)
+	require.NotNil(doc, "get(): written")
+	assert.Equal(uint64(10), doc.Epoch, "get(): Epoch")
+	assert.Equal(testCacheDoc(10), raw, "get(): raw")
+
+	// Documents are re-verified each time they are loaded, and discarded
+	// if invalid, or for the wrong epoch.
+	for _, v := range [][]byte{[]byte("garbage"), testCacheDoc(11)} {
+		require.NoError(ioutil.WriteFile(dc.path(10), v, 0600), "WriteFile()")
+		doc, _ = dc.get(10)
+		assert.Nil(doc, "get(): tampered: %s", v)
+		_, err := os.Stat(dc.path(10))
+		assert.True(os.IsNotExist(err), "get(): tampered file removed: %s", v)
+	}
+}
+
+func TestDocCacheEviction(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	now := uint64(10)
+	dc, cleanupFn := newTestCache(t, &now)
+	defer cleanupFn()
+
+	isCached := func(epoch uint64) bool {
+		_, err := os.Stat(dc.path(epoch))
+		return err == nil
+	}
+
+	// Epochs outside of the window around the current epoch are never
+	// cached.
+	for _, epoch := range []uint64{7, 8, 9, 10, 11, 12} {
+		dc.put(epoch, testCacheDoc(epoch))
+	}
+	assert.False(isCached(7), "Too old")
+	assert.False(isCached(12), "Too new")
+	for _, epoch := range []uint64{8, 9, 10, 11} {
+		assert.True(isCached(epoch), "Retained: %v", epoch)
+	}
+
+	// Files for far future epochs do not cause valid documents to be
+	// evicted, and are evicted themselves, but unrelated files are left
+	// alone.
+	const unrelated = "unrelated"
+	require.NoError(ioutil.WriteFile(dc.path(1000), testCacheDoc(1000), 0600), "WriteFile(): future")
+	require.NoError(ioutil.WriteFile(filepath.Join(dc.dir, unrelated), nil, 0600), "WriteFile(): unrelated")
+	dc.put(10, testCacheDoc(10))
+	assert.False(isCached(1000), "Future evicted")
+	for _, epoch := range []uint64{8, 9, 10, 11} {
+		assert.True(isCached(epoch), "Retained after future: %v", epoch)
+	}
+	_, err := os.Stat(filepath.Join(dc.dir, unrelated))
+	assert.NoError(err, "Unrelated retained")
+
+	// Advancing the clock evicts the old epochs on the next put.
+	now = 12
+	dc.put(12, testCacheDoc(12))
+	assert.False(isCached(8), "Evicted: 8")
+	assert.False(isCached(9), "Evicted: 9")
+	for _, epoch := range []uint64{10, 11, 12} {
+		assert.True(isCached(epoch), "Retained after advance: %v", epoch)
+	}
+}
@@ -18,16 +18,17 @@
 package client
 
 import (
-	"bytes"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/katzenpost/authority/nonvoting/internal/s11n"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/eddsa"
-	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/epochtime"
 	"github.com/katzenpost/core/log"
 	"github.com/katzenpost/core/pki"
 	"github.com/katzenpost/core/utils"
@@ -36,7 +37,52 @@ import (
 	"gopkg.in/op/go-logging.v1"
 )
 
-var defaultDialer = &net.Dialer{}
+var (
+	// ErrLateDescriptor is the error returned by Post when the authority
+	// has already generated the Document for the epoch.  Like
+	// pki.ErrInvalidPostEpoch (returned when the authority holds a
+	// conflicting descriptor), retrying the post will never succeed.
+	ErrLateDescriptor = errors.New("nonvoting/client: Post() descriptor is late for epoch")
+
+	// ErrAuthorityInternal is the error returned by Post when the authority
+	// failed to accept a descriptor due to an internal error.  The post may
+	// be retried.
+	ErrAuthorityInternal = errors.New("nonvoting/client: Post() authority internal error")
+
+	// ErrInvalidDescriptor is the error returned by Post when the authority
+	// rejects the descriptor as malformed, in an unsupported format, or for
+	// an epoch that is not being accepted.
+	ErrInvalidDescriptor = errors.New("nonvoting/client: Post() descriptor rejected as invalid")
+
+	// ErrForbidden is the error returned by Post when the authority does
+	// not authorize the node to post descriptors.
+	ErrForbidden = errors.New("nonvoting/client: Post() node not authorized by authority")
+
+	// ErrRejected is the error wrapped by the errors returned when the
+	// authority responds with an unknown error code.
+	ErrRejected = errors.New("nonvoting/client: rejected by authority")
+
+	// ErrNotSupported is the error returned when the authority does not
+	// support the requested functionality.
+	ErrNotSupported = errors.New("nonvoting/client: operation not supported by authority")
+
+	// ErrNotYet is the error returned by Get when the authority has yet to
+	// generate the Document for the epoch.  Unlike pki.ErrNoDocument,
+	// retrying may succeed.
+	ErrNotYet = errors.New("nonvoting/client: Get() document not yet generated")
+
+	// ErrIncompatibleAuthority is the error returned when the authority
+	// does not support any of the descriptor or document formats that the
+	// client does.
+	ErrIncompatibleAuthority = errors.New("nonvoting/client: incompatible authority")
+
+	defaultDialer = &net.Dialer{}
+
+	defaultAttemptTimeout = 30 * time.Second
+
+	errLegacyAuthority = errors.New("nonvoting/client: authority does not support capabilities")
+	errRangeOmitted    = errors.New("nonvoting/client: GetRange() authority omitted epoch from response")
+)
 
 // Config is a nonvoting authority pki.Client instance.
 type Config struct {
@@ -47,224 +93,678 @@ type Config struct {
 	// fetching documents.
 	Address string
 
+	// Addresses is the optional list of additional addresses of replicas of
+	// the authority that share the same PublicKey.  Each request is made to
+	// the addresses in turn till one succeeds.
+	Addresses []string
+
+	// RandomizeAddresses is set to try the addresses in random order rather
+	// than the configured order, to spread load across the replicas.
+	RandomizeAddresses bool
+
+	// AttemptTimeout is the optional timeout for each attempt to make a
+	// request to one of the addresses, bounded by the caller's context.  If
+	// unset, a reasonable default is used.
+	AttemptTimeout time.Duration
+
+	// EndpointBackoff is the optional base time to skip an address for
+	// after it fails, doubled on each consecutive failure.
+	EndpointBackoff time.Duration
+
 	// PublicKey is the authority's public key to use when validating documents.
 	PublicKey *eddsa.PublicKey
 
+	// PublicKeys is the optional list of additional authority public keys.
+	// Connections to authorities with any of PublicKey or PublicKeys are
+	// accepted, and Documents must be signed by at least Threshold of them.
+	PublicKeys []*eddsa.PublicKey
+
+	// Threshold is the minimum number of valid authority signatures that a
+	// Document must carry.  If unset, a single signature is sufficient.
+	Threshold int
+
+	// RetryPolicy is the optional policy for retrying Get when the
+	// Document is not yet available, or the authority is unreachable.  If
+	// unset, Get is not retried.  Watch always retries till the end of the
+	// epoch, and only uses the policy's backoff.
+	RetryPolicy *RetryPolicy
+
+	// DocumentPolicy is the optional policy that Documents must satisfy
+	// in addition to being correctly signed.  Documents that violate the
+	// policy are rejected.
+	DocumentPolicy *DocumentPolicy
+
+	// CacheDir is the optional directory used to cache Documents on disk,
+	// so that they are available across restarts without contacting the
+	// authority.  Cached Documents are verified each time they are loaded.
+	CacheDir string
+
+	// Observer is the optional Observer that receives instrumentation
+	// events, such as NewMetricsObserver.
+	Observer Observer
+
 	// DialContextFn is the optional alternative Dialer.DialContext function
 	// to be used when creating outgoing network connections.
 	DialContextFn func(ctx context.Context, network, address string) (net.Conn, error)
 }
 
+// epochClock returns the current epoch, the time elapsed since the start of
+// the epoch, and the time till the next epoch, like epochtime.Now.
+type epochClock func() (uint64, time.Duration, time.Duration)
+
 func (cfg *Config) validate() error {
 	if cfg.LogBackend == nil {
 		return fmt.Errorf("nonvoting/client: LogBackend is mandatory")
 	}
-	if err := utils.EnsureAddrIPPort(cfg.Address); err != nil {
-		return fmt.Errorf("nonvoting/client: Invalid Address: %v", err)
+	addrs := cfg.addresses()
+	if len(addrs) == 0 {
+		return fmt.Errorf("nonvoting/client: Address is mandatory")
 	}
-	if cfg.PublicKey == nil {
+	addrMap := make(map[string]bool)
+	for _, v := range addrs {
+		if err := utils.EnsureAddrIPPort(v); err != nil {
+			return fmt.Errorf("nonvoting/client: Invalid Address: %v", err)
+		}
+		if addrMap[v] {
+			return fmt.Errorf("nonvoting/client: Duplicate Address: %v", v)
+		}
+		addrMap[v] = true
+	}
+	if cfg.AttemptTimeout < 0 {
+		return fmt.Errorf("nonvoting/client: Invalid AttemptTimeout: %v", cfg.AttemptTimeout)
+	}
+	if cfg.EndpointBackoff < 0 {
+		return fmt.Errorf("nonvoting/client: Invalid EndpointBackoff: %v", cfg.EndpointBackoff)
+	}
+	if cfg.RetryPolicy != nil {
+		if err := cfg.RetryPolicy.validate(); err != nil {
+			return err
+		}
+	}
+	if cfg.DocumentPolicy != nil {
+		if err := cfg.DocumentPolicy.validate(); err != nil {
+			return err
+		}
+	}
+	keys := cfg.publicKeys()
+	if len(keys) == 0 {
 		return fmt.Errorf("nonvoting/client: PublicKey is mandatory")
 	}
+	keyMap := make(map[[eddsa.PublicKeySize]byte]bool)
+	for _, v := range keys {
+		if v == nil {
+			return fmt.Errorf("nonvoting/client: PublicKeys contains a nil key")
+		}
+		if keyMap[v.ByteArray()] {
+			return fmt.Errorf("nonvoting/client: Duplicate PublicKey: %v", v)
+		}
+		keyMap[v.ByteArray()] = true
+	}
+	if cfg.Threshold < 0 || cfg.Threshold > len(keys) {
+		return fmt.Errorf("nonvoting/client: Invalid Threshold: %v of %v", cfg.Threshold, len(keys))
+	}
 	return nil
 }
 
+func (cfg *Config) addresses() []string {
+	var addrs []string
+	if cfg.Address != "" {
+		addrs = append(addrs, cfg.Address)
+	}
+	return append(addrs, cfg.Addresses...)
+}
+
+func (cfg *Config) publicKeys() []*eddsa.PublicKey {
+	var keys []*eddsa.PublicKey
+	if cfg.PublicKey != nil {
+		keys = append(keys, cfg.PublicKey)
+	}
+	return append(keys, cfg.PublicKeys...)
+}
+
+func (cfg *Config) threshold() int {
+	if cfg.Threshold == 0 {
+		return 1
+	}
+	return cfg.Threshold
+}
+
+// Client is a nonvoting authority pki.Client, with additional functionality
+// specific to the non-voting authority.
+type Client interface {
+	pki.Client
+
+	// GetDescriptorStatus returns the authority's view of the descriptors
+	// posted by the node with the provided signing key, for each epoch that
+	// the authority holds a descriptor for.
+	GetDescriptorStatus(ctx context.Context, signingKey *eddsa.PrivateKey) ([]*DescriptorStatus, error)
+
+	// GetRange returns the Documents for the inclusive range of epochs,
+	// from the authority, in a single request if the authority supports
+	// FeatureConsensusRange, or one epoch at a time otherwise.  Each
+	// requested epoch will have an entry in the returned map, with the
+	// per-epoch result.
+	GetRange(ctx context.Context, startEpoch, endEpoch uint64) (map[uint64]*RangeResult, error)
+
+	// GetWait returns the Document for the epoch like Get, except that
+	// if the authority has yet to generate the Document, it will block till
+	// the Document is generated or the context is done.  Authorities that
+	// do not support FeatureConsensusWait are polled as per the
+	// RetryPolicy's backoff.
+	GetWait(ctx context.Context, epoch uint64) (*pki.Document, []byte, error)
+
+	// PostRevision posts the node's descriptor to the authority like Post,
+	// with the provided revision.  Prior to the Document for the epoch
+	// being generated, the authority will replace a previously posted
+	// descriptor with one that has a higher revision.
+	PostRevision(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *pki.MixDescriptor, revision uint64) error
+
+	// PostSigned posts the node's descriptor, as signed by SignDescriptor,
+	// to the authority like PostRevision.  The descriptor is posted exactly
+	// as provided, so that its DescriptorHash can be compared with the
+	// DescriptorStatus.Hash reported by the authority.
+	PostSigned(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, signed []byte) error
+
+	// Watch returns a channel that delivers the Document for each epoch,
+	// starting with the current one, as it becomes available.  The
+	// Document for the next epoch is fetched as soon as the authority
+	// publishes it.  Epochs without a Document are reported explicitly.
+	// The channel is closed when the context is done.
+	Watch(ctx context.Context) <-chan *WatchEvent
+
+	// Close closes the sessions held open for reuse.  Sessions that are in
+	// use are closed once the request completes, and further requests
+	// will not reuse sessions.
+	Close()
+
+	// VerifyDocument validates and deserializes the Document like
+	// Deserialize, and returns the authority public keys that produced
+	// valid signatures.
+	VerifyDocument(raw []byte) (*pki.Document, []*eddsa.PublicKey, error)
+
+	// GetCapabilities returns the formats and optional features supported
+	// by the authority.  Authorities that predate capability advertisement
+	// are reported as supporting the original formats and no features.
+	GetCapabilities(ctx context.Context) (*Capabilities, error)
+
+	// GetAuthorityStatus returns the authority's readiness to generate the
+	// Document for the next epoch.  It requires FeatureAuthorityStatus,
+	// which authorities only advertise on their admin listeners.
+	GetAuthorityStatus(ctx context.Context) (*AuthorityStatus, error)
+}
+
+const (
+	// FeatureConsensusRange is the feature that allows GetRange to fetch
+	// the range in a single request.
+	FeatureConsensusRange = s11n.FeatureConsensusRange
+
+	// FeatureConsensusWait is the feature that allows GetWait to have the
+	// authority hold the request till the Document is generated.
+	FeatureConsensusWait = s11n.FeatureConsensusWait
+
+	// FeatureDescriptorStatus is the feature required by
+	// GetDescriptorStatus.
+	FeatureDescriptorStatus = s11n.FeatureDescriptorStatus
+
+	// FeatureDescriptorRevision is the feature required by PostRevision
+	// with a non-zero revision.
+	FeatureDescriptorRevision = s11n.FeatureDescriptorRevision
+
+	// FeatureDescriptorErrorCodes is the feature that indicates that Post
+	// can return ErrLateDescriptor and ErrAuthorityInternal.
+	FeatureDescriptorErrorCodes = s11n.FeatureDescriptorErrorCodes
+
+	// FeatureSessionReuse is the feature that allows a session to be
+	// reused across requests.  Concurrent requests made with the same key
+	// are serialized over the one session.
+	FeatureSessionReuse = s11n.FeatureSessionReuse
+
+	// FeatureAuthorityStatus is the feature required by
+	// GetAuthorityStatus.
+	FeatureAuthorityStatus = s11n.FeatureAuthorityStatus
+)
+
+// Capabilities is the set of formats and optional features supported by the
+// authority.
+type Capabilities = s11n.Capabilities
+
+// AuthorityStatus is the authority's readiness to generate the Document for
+// the next epoch.
+type AuthorityStatus = s11n.AuthorityStatus
+
+// RangeResult is the result of fetching the Document for a single epoch as
+// part of a GetRange call.
+type RangeResult struct {
+	// Doc is the validated Document iff Err is nil.
+	Doc *pki.Document
+
+	// Raw is the serialized Document iff Err is nil.
+	Raw []byte
+
+	// Err is the error, if any, encountered when fetching the Document, as
+	// would be returned by Get for the same epoch.
+	Err error
+}
+
+// DescriptorStatus is the authority's view of a node's descriptor for a given
+// epoch.
+type DescriptorStatus struct {
+	// Epoch is the epoch that the descriptor is for.
+	Epoch uint64
+
+	// Hash is the DescriptorHash of the signed descriptor held by the
+	// authority.
+	Hash []byte
+
+	// Revision is the revision of the descriptor held by the authority.
+	Revision uint64
+
+	// HasDocument is true iff the Document for the epoch has been generated.
+	HasDocument bool
+
+	// Included is true iff the descriptor is included in the Document.
+	Included bool
+
+	// Layer is the layer that the node was assigned to iff Included is set.
+	Layer uint8
+
+	// Standby is true iff the descriptor was withheld from the Document as
+	// the topology was at capacity.  Standby nodes are preferred over new
+	// nodes when capacity becomes available.
+	Standby bool
+}
+
+// SignDescriptor signs and serializes the descriptor with the provided
+// revision, for posting with PostSigned.
+func SignDescriptor(signingKey *eddsa.PrivateKey, d *pki.MixDescriptor, revision uint64) ([]byte, error) {
+	signed, err := s11n.SignDescriptorRevision(signingKey, d, revision)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(signed), nil
+}
+
+// DescriptorHash returns the digest of the signed descriptor, for
+// comparison with DescriptorStatus.Hash.  The signature is not
+// deterministic across serializations of the same descriptor, so only the
+// signed descriptor that was actually posted will match.
+func DescriptorHash(signed []byte) []byte {
+	return s11n.DescriptorHash(signed)
+}
+
 type client struct {
 	cfg *Config
 	log *logging.Logger
 
-	serverLinkKey *ecdh.PublicKey
+	publicKeys     []*eddsa.PublicKey
+	serverLinkKeys map[[eddsa.PublicKeySize]byte]*ecdh.PublicKey
+
+	endpoints      []*endpoint
+	attemptTimeout time.Duration
+	cache          *docCache
+	clock          epochClock
+	rng            *lockedRand
+
+	// newWireFn is the optional alternative to wire.NewSession, used by the
+	// tests.
+	newWireFn func(*wire.SessionConfig) (wireSession, error)
 }
 
 func (c *client) Post(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *pki.MixDescriptor) error {
 	c.log.Debugf("Post(ctx, %d, %v, %+v)", epoch, signingKey.PublicKey(), d)
 
+	return c.signAndPost(ctx, epoch, signingKey, d, 0)
+}
+
+func (c *client) PostRevision(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *pki.MixDescriptor, revision uint64) error {
+	c.log.Debugf("PostRevision(ctx, %d, %v, %+v, %d)", epoch, signingKey.PublicKey(), d, revision)
+
+	return c.signAndPost(ctx, epoch, signingKey, d, revision)
+}
+
+func (c *client) PostSigned(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, signed []byte) error {
+	c.log.Debugf("PostSigned(ctx, %d, %v, '%v')", epoch, signingKey.PublicKey(), string(signed))
+
+	// Ensure that the descriptor we are about to post is well formed, and
+	// is for the node.
+	d, revision, err := s11n.VerifyAndParseDescriptorRevision(signed, epoch)
+	if err != nil {
+		return err
+	}
+	if !d.IdentityKey.Equal(signingKey.PublicKey()) {
+		return fmt.Errorf("nonvoting/client: PostSigned() descriptor is not signed by the signing key")
+	}
+
+	return c.post(ctx, epoch, signingKey, signed, revision)
+}
+
+func (c *client) signAndPost(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *pki.MixDescriptor, revision uint64) error {
 	// Ensure that the descriptor we are about to post is well formed.
 	if err := s11n.IsDescriptorWellFormed(d, epoch); err != nil {
 		return err
 	}
 
 	// Make a serialized + signed + serialized descriptor.
-	signed, err := s11n.SignDescriptor(signingKey, d)
+	signed, err := s11n.SignDescriptorRevision(signingKey, d, revision)
 	if err != nil {
 		return err
 	}
 	c.log.Debugf("Signed descriptor: '%v'", signed)
 
-	// Convert the link key to an ECDH keypair.
-	linkKey := signingKey.ToECDH()
-	defer linkKey.Reset()
+	return c.post(ctx, epoch, signingKey, []byte(signed), revision)
+}
 
-	// Initialize the TCP/IP connection, and wire session.
-	doneCh := make(chan interface{})
-	defer close(doneCh)
-	conn, s, err := c.initSession(ctx, doneCh, signingKey.PublicKey(), linkKey)
-	if err != nil {
-		return err
+func (c *client) post(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, signed []byte, revision uint64) error {
+
+	// The post succeeds as long as any of the authority's endpoints
+	// accepts the descriptor.
+	return c.withSession(ctx, &sessionRequest{
+		signingKey: signingKey,
+		fn: func(_ context.Context, s *session) error {
+			if revision != 0 && !s.caps.HasFeature(s11n.FeatureDescriptorRevision) {
+				return ErrNotSupported
+			}
+
+			// Dispatch the post_descriptor command.
+			cmd := &commands.PostDescriptor{
+				Epoch:   epoch,
+				Payload: signed,
+			}
+			resp, err := s.roundTrip(cmd)
+			if err != nil {
+				return err
+			}
+
+			// Parse the post_descriptor_status command.
+			r, ok := resp.(*commands.PostDescriptorStatus)
+			if !ok {
+				return fmt.Errorf("nonvoting/client: Post() unexpected reply: %T", resp)
+			}
+			switch r.ErrorCode {
+			case commands.DescriptorOk:
+				return nil
+			case commands.DescriptorInvalid:
+				return ErrInvalidDescriptor
+			case commands.DescriptorConflict:
+				// Note: Older authorities also return this for late uploads,
+				// internal errors, and descriptor revisions.
+				return pki.ErrInvalidPostEpoch
+			case commands.DescriptorForbidden:
+				return ErrForbidden
+			case s11n.DescriptorLate:
+				return ErrLateDescriptor
+			case s11n.DescriptorInternalError:
+				return ErrAuthorityInternal
+			default:
+				return fmt.Errorf("%w: Post() %v", ErrRejected, postErrorToString(r.ErrorCode))
+			}
+		},
+	})
+}
+
+func (c *client) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
+	c.log.Debugf("Get(ctx, %d)", epoch)
+
+	return c.get(ctx, epoch, true)
+}
+
+// get returns the Document for the epoch, from the cache if possible,
+// retrying as per the RetryPolicy iff retry is set.
+func (c *client) get(ctx context.Context, epoch uint64, retry bool) (*pki.Document, []byte, error) {
+	if doc, raw := c.getCached(epoch); doc != nil {
+		return doc, raw, nil
 	}
-	defer func() {
-		s.Close()
-		conn.Close()
-	}()
+	return c.getConsensus(ctx, epoch, 0, retry)
+}
 
-	// Dispatch the post_descriptor command.
-	cmd := &commands.PostDescriptor{
-		Epoch:   epoch,
-		Payload: []byte(signed),
+// getConsensus issues the get_consensus command, or iff holdTime is set,
+// the get_consensus_wait extension, which the authority may hold for up to
+// holdTime.
+func (c *client) getConsensus(ctx context.Context, epoch uint64, holdTime time.Duration, retry bool) (*pki.Document, []byte, error) {
+	req := &sessionRequest{
+		isFinal: func(err error) bool {
+			// Documents that are gone will not be on another endpoint.
+			return err == pki.ErrNoDocument
+		},
+		isRetriable: func(err error) bool {
+			return err == ErrNotYet
+		},
 	}
-	resp, err := c.doRoundTrip(ctx, s, cmd)
-	if err != nil {
-		return err
+	if !retry {
+		req.isRetriable = nil
 	}
-
-	// Parse the post_descriptor_status command.
-	r, ok := resp.(*commands.PostDescriptorStatus)
-	if !ok {
-		return fmt.Errorf("nonvoting/client: Post() unexpected reply: %T", resp)
+	if holdTime > 0 {
+		req.holdTime = holdTime
+		req.isRetriable = nil
+		req.isFinal = func(err error) bool {
+			// The authority held the request, so there is no point in
+			// waiting on another endpoint.
+			return err == pki.ErrNoDocument || err == ErrNotYet
+		}
 	}
-	switch r.ErrorCode {
-	case commands.DescriptorOk:
+
+	var doc *pki.Document
+	var raw []byte
+	req.fn = func(_ context.Context, s *session) error {
+		var errorCode uint8
+		var payload []byte
+		if holdTime > 0 {
+			if !s.caps.HasFeature(s11n.FeatureConsensusWait) {
+				return ErrNotSupported
+			}
+
+			// Dispatch the get_consensus_wait extension.
+			resp, err := s.extRoundTrip(&s11n.ExtensionRequest{
+				Command: s11n.ExtGetConsensusWait,
+				Epoch:   epoch,
+				Timeout: uint32(holdTime / time.Second),
+			})
+			if err != nil {
+				return err
+			}
+			errorCode, payload = resp.ErrorCode, resp.Payload
+		} else {
+			// Dispatch the get_consensus command.
+			resp, err := s.roundTrip(&commands.GetConsensus{Epoch: epoch})
+			if err != nil {
+				return err
+			}
+
+			// Parse the consensus command.
+			r, ok := resp.(*commands.Consensus)
+			if !ok {
+				return fmt.Errorf("nonvoting/client: Get() unexpected reply: %T", resp)
+			}
+			errorCode, payload = r.ErrorCode, r.Payload
+		}
+
+		var err error
+		if doc, err = c.parseConsensus(epoch, errorCode, payload); err != nil {
+			return err
+		}
+		raw = payload
 		return nil
-	case commands.DescriptorConflict:
-		return pki.ErrInvalidPostEpoch
-	default:
-		return fmt.Errorf("nonvoting/client: Post() rejected by authority: %v", postErrorToString(r.ErrorCode))
 	}
+	if err := c.withSession(ctx, req); err != nil {
+		return nil, nil, err
+	}
+	c.putCached(epoch, raw)
 
-	// NOTREACHED
+	return doc, raw, nil
 }
 
-func (c *client) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
-	c.log.Debugf("Get(ctx, %d)", epoch)
+func (c *client) GetRange(ctx context.Context, startEpoch, endEpoch uint64) (map[uint64]*RangeResult, error) {
+	c.log.Debugf("GetRange(ctx, %d, %d)", startEpoch, endEpoch)
 
-	// Generate a random ecdh keypair to use for the link authentication.
-	linkKey, err := ecdh.NewKeypair(rand.Reader)
-	if err != nil {
-		return nil, nil, err
+	// The authority only holds Documents for a handful of epochs, and will
+	// not service larger ranges than this.
+	const maxRangeEpochs = 8
+
+	if endEpoch < startEpoch || endEpoch-startEpoch >= maxRangeEpochs {
+		return nil, fmt.Errorf("nonvoting/client: GetRange() invalid range: %v-%v", startEpoch, endEpoch)
 	}
-	defer linkKey.Reset()
 
-	// Initialize the TCP/IP connection, and wire session.
-	doneCh := make(chan interface{})
-	defer close(doneCh)
-	conn, s, err := c.initSession(ctx, doneCh, nil, linkKey)
-	if err != nil {
-		return nil, nil, err
+	entries, err := c.getConsensusRange(ctx, startEpoch, endEpoch)
+	if err == ErrNotSupported {
+		// Fetch each epoch in turn from authorities that do not support
+		// ranges.
+		return c.getRangeEach(ctx, startEpoch, endEpoch)
+	} else if err != nil {
+		return nil, err
 	}
-	defer func() {
-		s.Close()
-		conn.Close()
-	}()
 
-	// Dispatch the get_consensus command.
-	cmd := &commands.GetConsensus{Epoch: epoch}
-	resp, err := c.doRoundTrip(ctx, s, cmd)
-	if err != nil {
-		return nil, nil, err
+	ret := make(map[uint64]*RangeResult)
+	for _, v := range entries {
+		if v.Epoch < startEpoch || v.Epoch > endEpoch {
+			c.log.Warningf("nonvoting/Client: GetRange() authority returned entry for unrequested epoch: %v", v.Epoch)
+			continue
+		}
+		res := new(RangeResult)
+		if res.Doc, res.Err = c.parseConsensus(v.Epoch, v.ErrorCode, v.Payload); res.Err == nil {
+			res.Raw = v.Payload
+			c.putCached(v.Epoch, v.Payload)
+		}
+		ret[v.Epoch] = res
 	}
 
-	// Parse the consensus command.
-	r, ok := resp.(*commands.Consensus)
-	if !ok {
-		return nil, nil, fmt.Errorf("nonvoting/client: Get() unexpected reply: %T", resp)
+	// Explicitly mark any epochs that the authority omitted.
+	for epoch := startEpoch; epoch <= endEpoch; epoch++ {
+		if _, ok := ret[epoch]; !ok {
+			ret[epoch] = &RangeResult{Err: errRangeOmitted}
+		}
+		if epoch == endEpoch {
+			break // Avoid overflow.
+		}
 	}
-	switch r.ErrorCode {
+
+	return ret, nil
+}
+
+func (c *client) getRangeEach(ctx context.Context, startEpoch, endEpoch uint64) (map[uint64]*RangeResult, error) {
+	ret := make(map[uint64]*RangeResult)
+	for epoch := startEpoch; ; epoch++ {
+		res := new(RangeResult)
+		res.Doc, res.Raw, res.Err = c.get(ctx, epoch, false)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ret[epoch] = res
+		if epoch == endEpoch {
+			break // Avoid overflow.
+		}
+	}
+	return ret, nil
+}
+
+func (c *client) getCached(epoch uint64) (*pki.Document, []byte) {
+	if c.cache == nil {
+		return nil, nil
+	}
+	return c.cache.get(epoch)
+}
+
+func (c *client) putCached(epoch uint64, raw []byte) {
+	if c.cache != nil {
+		c.cache.put(epoch, raw)
+	}
+}
+
+func (c *client) parseConsensus(epoch uint64, errorCode uint8, payload []byte) (*pki.Document, error) {
+	switch errorCode {
 	case commands.ConsensusOk:
 	case commands.ConsensusGone:
-		return nil, nil, pki.ErrNoDocument
+		return nil, pki.ErrNoDocument
+	case commands.ConsensusNotFound:
+		return nil, ErrNotYet
 	default:
-		return nil, nil, fmt.Errorf("nonvoting/Client: Get() rejected by authority: %v", getErrorToString(r.ErrorCode))
+		return nil, fmt.Errorf("%w: Get() %v", ErrRejected, getErrorToString(errorCode))
 	}
 
 	// Validate the document.
-	doc, err := s11n.VerifyAndParseDocument(r.Payload, c.cfg.PublicKey)
+	doc, err := c.Deserialize(payload)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	} else if doc.Epoch != epoch {
 		c.log.Warningf("nonvoting/Client: Get() authority returned document for wrong epoch: %v", doc.Epoch)
-		return nil, nil, s11n.ErrInvalidEpoch
+		return nil, s11n.ErrInvalidEpoch
 	}
 	c.log.Debugf("Document: %v", doc)
 
-	return doc, r.Payload, nil
+	return doc, nil
 }
 
 func (c *client) Deserialize(raw []byte) (*pki.Document, error) {
-	return s11n.VerifyAndParseDocument(raw, c.cfg.PublicKey)
+	doc, _, err := c.VerifyDocument(raw)
+	return doc, err
 }
 
-func (c *client) initSession(ctx context.Context, doneCh <-chan interface{}, signingKey *eddsa.PublicKey, linkKey *ecdh.PrivateKey) (net.Conn, *wire.Session, error) {
-	// Connect to the peer.
-	dialFn := c.cfg.DialContextFn
-	if dialFn == nil {
-		dialFn = defaultDialer.DialContext
-	}
-	conn, err := dialFn(ctx, "tcp", c.cfg.Address)
+func (c *client) VerifyDocument(raw []byte) (*pki.Document, []*eddsa.PublicKey, error) {
+	doc, signers, err := s11n.VerifyAndParseDocumentThreshold(raw, c.publicKeys, c.cfg.threshold())
 	if err != nil {
-		return nil, nil, err
+		return nil, signers, err
 	}
-
-	var isOk bool
-	defer func() {
-		if !isOk {
-			conn.Close()
+	c.log.Debugf("Document signed by: %v", signers)
+	if c.cfg.DocumentPolicy != nil {
+		now, _, _ := c.clock()
+		if err = c.cfg.DocumentPolicy.check(doc, now); err != nil {
+			c.log.Warningf("nonvoting/Client: Rejecting Document for epoch %v: %v", doc.Epoch, err)
+			return nil, signers, err
 		}
-	}()
-
-	var ad []byte
-	if signingKey != nil {
-		ad = signingKey.Bytes()
 	}
+	return doc, signers, nil
+}
 
-	// Initialize the wire protocol session.
-	cfg := &wire.SessionConfig{
-		Authenticator:     c,
-		AdditionalData:    ad,
-		AuthenticationKey: linkKey,
-		RandomReader:      rand.Reader,
-	}
-	s, err := wire.NewSession(cfg, true)
-	if err != nil {
-		return nil, nil, err
-	}
+func (c *client) Close() {
+	c.log.Debugf("Close()")
 
-	go func() {
-		select {
-		case <-ctx.Done():
-			conn.Close()
-		case <-doneCh:
-		}
-	}()
+	for _, ep := range c.endpoints {
+		ep.closeIdle()
+	}
+}
 
-	// Handshake.
-	if err = s.Initialize(conn); err != nil {
-		return nil, nil, err
+func (c *client) GetCapabilities(ctx context.Context) (*Capabilities, error) {
+	c.log.Debugf("GetCapabilities(ctx)")
+
+	// Initializing the wire session will negotiate capabilities.
+	var caps *s11n.Capabilities
+	err := c.withSession(ctx, &sessionRequest{
+		fn: func(_ context.Context, s *session) error {
+			caps = s.caps
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	isOk = true
-	return conn, s, nil
+	return &Capabilities{
+		DescriptorVersions: caps.DescriptorVersions,
+		DocumentVersions:   caps.DocumentVersions,
+		Features:           caps.Features,
+	}, nil
 }
 
 func (c *client) IsPeerValid(creds *wire.PeerCredentials) bool {
-	if !bytes.Equal(c.cfg.PublicKey.Bytes(), creds.AdditionalData) {
+	var pk [eddsa.PublicKeySize]byte
+	if len(creds.AdditionalData) != len(pk) {
 		c.log.Warningf("nonvoting/Client: IsPeerValid(): AD mismatch: %v", hex.EncodeToString(creds.AdditionalData))
 		return false
 	}
-	if !c.serverLinkKey.Equal(creds.PublicKey) {
+	copy(pk[:], creds.AdditionalData)
+	linkKey, ok := c.serverLinkKeys[pk]
+	if !ok {
+		c.log.Warningf("nonvoting/Client: IsPeerValid(): AD mismatch: %v", hex.EncodeToString(creds.AdditionalData))
+		return false
+	}
+	if !linkKey.Equal(creds.PublicKey) {
 		c.log.Warningf("nonvoting/Client: IsPeerValid(): Public Key mismatch: %v", creds.PublicKey)
 		return false
 	}
 	return true
 }
 
-func (c *client) doRoundTrip(ctx context.Context, s *wire.Session, cmd commands.Command) (commands.Command, error) {
-	if err := s.SendCommand(cmd); err != nil {
-		return nil, err
-	}
-	return s.RecvCommand()
-}
-
-// New constructs a new pki.Client instance.
-func New(cfg *Config) (pki.Client, error) {
+// New constructs a new Client instance.
+func New(cfg *Config) (Client, error) {
 	if cfg == nil {
 		return nil, fmt.Errorf("nonvoting/client: cfg is mandatory")
 	}
@@ -275,7 +775,25 @@ func New(cfg *Config) (pki.Client, error) {
 	c := new(client)
 	c.cfg = cfg
 	c.log = cfg.LogBackend.GetLogger("pki/nonvoting/client")
-	c.serverLinkKey = cfg.PublicKey.ToECDH()
+	c.publicKeys = cfg.publicKeys()
+	c.serverLinkKeys = make(map[[eddsa.PublicKeySize]byte]*ecdh.PublicKey)
+	for _, v := range c.publicKeys {
+		c.serverLinkKeys[v.ByteArray()] = v.ToECDH()
+	}
+	for _, v := range cfg.addresses() {
+		c.endpoints = append(c.endpoints, &endpoint{addr: v})
+	}
+	if c.attemptTimeout = cfg.AttemptTimeout; c.attemptTimeout == 0 {
+		c.attemptTimeout = defaultAttemptTimeout
+	}
+	c.rng = newLockedRand()
+	c.clock = epochtime.Now
+	if cfg.CacheDir != "" {
+		var err error
+		if c.cache, err = newDocCache(cfg.CacheDir, c.clock, c.Deserialize, c.log); err != nil {
+			return nil, err
+		}
+	}
 
 	return c, nil
 }
@@ -303,6 +821,10 @@ func postErrorToString(v uint8) string {
 		return "Conflict"
 	case commands.DescriptorForbidden:
 		return "Forbidden"
+	case s11n.DescriptorLate:
+		return "Late"
+	case s11n.DescriptorInternalError:
+		return "InternalError"
 	default:
 		return fmt.Sprintf("[unknown ErrorCode: %v]", v)
 	}
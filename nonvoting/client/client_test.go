@@ -0,0 +1,195 @@
+// client_test.go - Non-voting authority client tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/authority/nonvoting/internal/s11n"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/wire/commands"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRejections(t *testing.T) {
+	assert := assert.New(t)
+
+	const epoch = 23
+
+	var errorCode uint8
+	a := &fakeAuthority{}
+	a.fn = func(w *fakeWire, cmd commands.Command) commands.Command {
+		switch c := cmd.(type) {
+		case *commands.GetConsensus:
+			return &commands.Consensus{ErrorCode: errorCode}
+		case *commands.PostDescriptor:
+			if c.Epoch == s11n.ExtensionEpoch {
+				return capabilitiesResponse(t, s11n.LocalCapabilities())
+			}
+			return &commands.PostDescriptorStatus{ErrorCode: errorCode}
+		default:
+			return nil
+		}
+	}
+	c := a.newClient(t)
+	signingKey, d := newTestDescriptor(t, epoch)
+
+	// Each rejection is reported as a distinct error.
+	for _, v := range []struct {
+		errorCode uint8
+		err       error
+	}{
+		{commands.DescriptorOk, nil},
+		{commands.DescriptorInvalid, ErrInvalidDescriptor},
+		{commands.DescriptorConflict, pki.ErrInvalidPostEpoch},
+		{commands.DescriptorForbidden, ErrForbidden},
+		{s11n.DescriptorLate, ErrLateDescriptor},
+		{s11n.DescriptorInternalError, ErrAuthorityInternal},
+	} {
+		errorCode = v.errorCode
+		assert.Equal(v.err, c.Post(context.Background(), epoch, signingKey, d), "Post(): %v", postErrorToString(v.errorCode))
+	}
+
+	// Unknown error codes are reported as rejections.
+	errorCode = 23
+	err := c.Post(context.Background(), epoch, signingKey, d)
+	assert.True(errors.Is(err, ErrRejected), "Post(): unknown: %v", err)
+	_, _, err = c.Get(context.Background(), epoch)
+	assert.True(errors.Is(err, ErrRejected), "Get(): unknown: %v", err)
+}
+
+func TestPublisherCapabilities(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	const epoch = 10
+
+	for _, v := range []struct {
+		name     string
+		legacy   bool
+		attempts int
+	}{
+		// Authorities with the late and internal error status codes only
+		// report conflicts as such, so they are not retried.
+		{"Negotiated", false, 1},
+
+		// Legacy authorities also report late uploads and internal errors
+		// as conflicts, so they are retried.
+		{"Legacy", true, 3},
+	} {
+		legacy := v.legacy
+		a := &fakeAuthority{}
+		a.fn = func(w *fakeWire, cmd commands.Command) commands.Command {
+			c := cmd.(*commands.PostDescriptor)
+			if c.Epoch == s11n.ExtensionEpoch && !legacy {
+				return capabilitiesResponse(t, s11n.LocalCapabilities())
+			}
+			return &commands.PostDescriptorStatus{ErrorCode: commands.DescriptorConflict}
+		}
+		c := a.newClient(t)
+
+		signingKey, d := newTestDescriptor(t, epoch)
+		p, err := newPublisher(&PublisherConfig{
+			LogBackend: c.cfg.LogBackend,
+			Client:     c,
+			SigningKey: signingKey,
+			Descriptor: d,
+			MixKeyFn: func(uint64) (*ecdh.PublicKey, error) {
+				k, err := ecdh.NewKeypair(rand.Reader)
+				if err != nil {
+					return nil, err
+				}
+				return k.PublicKey(), nil
+			},
+			RetryPolicy: &RetryPolicy{
+				InitialBackoff: time.Millisecond,
+				MaxBackoff:     2 * time.Millisecond,
+				MaxAttempts:    3,
+			},
+		}, func() (uint64, time.Duration, time.Duration) { return epoch, 0, time.Hour })
+		require.NoError(err, "newPublisher()")
+
+		var st *PublisherStatus
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if l := p.Status(); len(l) > 0 && l[0].Final {
+				st = l[0]
+				break
+			}
+		}
+		p.Halt()
+		require.NotNil(st, "%v: Final", v.name)
+		assert.Equal(pki.ErrInvalidPostEpoch, st.Err, "%v: Err", v.name)
+		assert.Equal(v.attempts, st.Attempts, "%v: Attempts", v.name)
+	}
+}
+
+func TestSessionReuse(t *testing.T) {
+	assert := assert.New(t)
+
+	const epoch = 23
+
+	for _, v := range []struct {
+		name     string
+		features []string
+		nrDials  int
+	}{
+		// Authorities that allow reuse serve every request over a single
+		// session, even when the requests are concurrent.
+		{"Reusable", s11n.LocalCapabilities().Features, 1},
+
+		// ... otherwise each request is made over its own session.
+		{"Not reusable", nil, 10},
+	} {
+		serverCaps := s11n.LocalCapabilities()
+		serverCaps.Features = v.features
+		a := &fakeAuthority{}
+		a.fn = func(w *fakeWire, cmd commands.Command) commands.Command {
+			switch cmd.(type) {
+			case *commands.GetConsensus:
+				return &commands.Consensus{ErrorCode: commands.ConsensusNotFound}
+			default:
+				return capabilitiesResponse(t, serverCaps)
+			}
+		}
+		c := a.newClient(t)
+
+		_, _, err := c.Get(context.Background(), epoch)
+		assert.Equal(ErrNotYet, err, "%v: Get()", v.name)
+		_, _, err = c.Get(context.Background(), epoch)
+		assert.Equal(ErrNotYet, err, "%v: Get(): again", v.name)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _, err := c.Get(context.Background(), epoch)
+				assert.Equal(ErrNotYet, err, "%v: Get(): concurrent", v.name)
+			}()
+		}
+		wg.Wait()
+		assert.Equal(v.nrDials, a.nrDials(), "%v: Dials", v.name)
+		c.Close()
+	}
+}
@@ -0,0 +1,607 @@
+// authority.go - Katzenpost non-voting authority in-memory fake.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package clienttest implements an in-memory fake non-voting authority, for
+// testing code that uses the non-voting authority client without sockets
+// or timers.
+package clienttest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/katzenpost/authority/nonvoting/client"
+	"github.com/katzenpost/authority/nonvoting/internal/s11n"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/pki"
+)
+
+// Parameters is the set of parameters included in generated Documents.
+type Parameters struct {
+	// Layers is the number of mix layers in the topology.
+	Layers int
+
+	MixLambda   float64
+	MixMaxDelay uint64
+
+	SendLambda      float64
+	SendShift       uint64
+	SendMaxInterval uint64
+}
+
+// DefaultParameters returns the Parameters used by a new Authority.
+func DefaultParameters() *Parameters {
+	return &Parameters{
+		Layers:          3,
+		MixLambda:       0.00025,
+		MixMaxDelay:     90000,
+		SendLambda:      15.0,
+		SendShift:       3,
+		SendMaxInterval: 3000,
+	}
+}
+
+type descriptor struct {
+	desc     *pki.MixDescriptor
+	raw      []byte
+	revision uint64
+}
+
+type document struct {
+	doc *pki.Document
+	raw []byte
+}
+
+type watcher struct {
+	sync.Mutex
+
+	queue  []*client.WatchEvent
+	wakeCh chan interface{}
+}
+
+// Authority is an in-memory fake non-voting authority, that implements
+// client.Client.  Descriptors are validated and stored exactly as the real
+// authority would, but Documents are only generated when explicitly
+// requested with GenerateDocument.
+type Authority struct {
+	sync.Mutex
+
+	signingKey *eddsa.PrivateKey
+	params     Parameters
+	epoch      *uint64
+	isLegacy   bool
+
+	descriptors map[uint64]map[[eddsa.PublicKeySize]byte]*descriptor
+	documents   map[uint64]*document
+	docWaiters  map[uint64]chan interface{}
+	watchers    map[*watcher]bool
+
+	getResponses  map[uint64]error
+	postResponses map[[eddsa.PublicKeySize]byte]error
+}
+
+// PublicKey returns the Authority's public key, that Documents are signed
+// with.
+func (a *Authority) PublicKey() *eddsa.PublicKey {
+	return a.signingKey.PublicKey()
+}
+
+// SetParameters sets the parameters to be included in Documents generated
+// from now on.
+func (a *Authority) SetParameters(p *Parameters) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.params = *p
+}
+
+// SetEpoch sets the current epoch, that descriptors are accepted relative
+// to, instead of using the system clock.
+func (a *Authority) SetEpoch(epoch uint64) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.epoch = &epoch
+}
+
+// SetLegacy sets if the Authority behaves like an authority that predates
+// the wire protocol extensions, as seen through the real client.  Legacy
+// authorities report the client's legacy Capabilities, do not support the
+// features that require the extensions (client.ErrNotSupported), and report
+// late and internal error descriptor uploads as conflicts
+// (pki.ErrInvalidPostEpoch).
+func (a *Authority) SetLegacy(isLegacy bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.isLegacy = isLegacy
+}
+
+// SetGetResponse scripts the error returned when fetching the Document for
+// the epoch, eg: client.ErrNotYet or pki.ErrNoDocument, regardless of if the
+// Document has been generated.  A nil error removes the scripted response.
+func (a *Authority) SetGetResponse(epoch uint64, err error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if err == nil {
+		delete(a.getResponses, epoch)
+	} else {
+		a.getResponses[epoch] = err
+	}
+}
+
+// SetPostResponse scripts the error returned when the node with the identity
+// key posts a descriptor, eg: pki.ErrInvalidPostEpoch or
+// client.ErrForbidden.  The descriptor is not stored.  A nil error removes
+// the scripted response.
+func (a *Authority) SetPostResponse(identityKey *eddsa.PublicKey, err error) {
+	a.Lock()
+	defer a.Unlock()
+
+	pk := identityKey.ByteArray()
+	if err == nil {
+		delete(a.postResponses, pk)
+	} else {
+		a.postResponses[pk] = err
+	}
+}
+
+// Descriptors returns the descriptors posted for the epoch.
+func (a *Authority) Descriptors(epoch uint64) []*pki.MixDescriptor {
+	a.Lock()
+	defer a.Unlock()
+
+	var ret []*pki.MixDescriptor
+	for _, v := range a.descriptors[epoch] {
+		ret = append(ret, v.desc)
+	}
+	return ret
+}
+
+// GenerateDocument generates and signs the Document for the epoch from the
+// descriptors posted so far, with the mixes assigned to layers in order of
+// identity key.  It is an error to generate a Document for an epoch more
+// than once.
+func (a *Authority) GenerateDocument(epoch uint64) (*pki.Document, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if _, ok := a.documents[epoch]; ok {
+		return nil, fmt.Errorf("clienttest: Document for epoch %v already generated", epoch)
+	}
+	if a.params.Layers <= 0 {
+		return nil, fmt.Errorf("clienttest: invalid number of layers: %v", a.params.Layers)
+	}
+
+	// Carve out the descriptors between providers and nodes.
+	var providers [][]byte
+	var nodes []*descriptor
+	for _, v := range a.descriptors[epoch] {
+		if v.desc.Layer == pki.LayerProvider {
+			providers = append(providers, v.raw)
+		} else {
+			nodes = append(nodes, v)
+		}
+	}
+	sort.Slice(providers, func(i, j int) bool { return bytes.Compare(providers[i], providers[j]) < 0 })
+	sort.Slice(nodes, func(i, j int) bool {
+		return bytes.Compare(nodes[i].desc.IdentityKey.Bytes(), nodes[j].desc.IdentityKey.Bytes()) < 0
+	})
+
+	// Assign nodes to layers.
+	topology := make([][][]byte, a.params.Layers)
+	for idx, v := range nodes {
+		layer := idx % a.params.Layers
+		topology[layer] = append(topology[layer], v.raw)
+	}
+
+	// Build, sign and validate the Document.
+	doc := &s11n.Document{
+		Epoch:           epoch,
+		MixLambda:       a.params.MixLambda,
+		MixMaxDelay:     a.params.MixMaxDelay,
+		SendLambda:      a.params.SendLambda,
+		SendShift:       a.params.SendShift,
+		SendMaxInterval: a.params.SendMaxInterval,
+		Topology:        topology,
+		Providers:       providers,
+	}
+	signed, err := s11n.SignDocument(a.signingKey, doc)
+	if err != nil {
+		return nil, err
+	}
+	raw := []byte(signed)
+	pDoc, err := s11n.VerifyAndParseDocument(raw, a.signingKey.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	a.documents[epoch] = &document{doc: pDoc, raw: raw}
+
+	// Wake up everyone that is waiting on this document.
+	if ch, ok := a.docWaiters[epoch]; ok {
+		close(ch)
+		delete(a.docWaiters, epoch)
+	}
+	for w := range a.watchers {
+		w.push(&client.WatchEvent{Epoch: epoch, Doc: pDoc, Raw: raw})
+	}
+
+	return pDoc, nil
+}
+
+func (a *Authority) Post(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *pki.MixDescriptor) error {
+	return a.PostRevision(ctx, epoch, signingKey, d, 0)
+}
+
+func (a *Authority) PostRevision(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *pki.MixDescriptor, revision uint64) error {
+	// Descriptors signed with the wrong key would be rejected as invalid,
+	// so reject them as the authority rejects peers posting descriptors
+	// for other nodes.
+	if !d.IdentityKey.Equal(signingKey.PublicKey()) {
+		return client.ErrForbidden
+	}
+	signed, err := client.SignDescriptor(signingKey, d, revision)
+	if err != nil {
+		return err
+	}
+	return a.PostSigned(ctx, epoch, signingKey, signed)
+}
+
+func (a *Authority) PostSigned(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, signed []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Like the authority, only accept descriptors for the epochs around
+	// the current one.
+	now := a.now()
+	switch epoch {
+	case now - 1, now, now + 1:
+	default:
+		return client.ErrInvalidDescriptor
+	}
+
+	// Ensure that the descriptor is well formed, and signed by the node.
+	d, revision, err := s11n.VerifyAndParseDescriptorRevision(signed, epoch)
+	if err != nil {
+		return err
+	}
+	if !d.IdentityKey.Equal(signingKey.PublicKey()) {
+		return fmt.Errorf("nonvoting/client: PostSigned() descriptor is not signed by the signing key")
+	}
+	raw := append([]byte{}, signed...)
+
+	a.Lock()
+	defer a.Unlock()
+
+	if revision != 0 && a.isLegacy {
+		return client.ErrNotSupported
+	}
+	pk := d.IdentityKey.ByteArray()
+	if err, ok := a.postResponses[pk]; ok {
+		return a.postError(err)
+	}
+
+	// Apply the same rules as the authority for replacing descriptors.
+	_, hasDoc := a.documents[epoch]
+	if prev, ok := a.descriptors[epoch][pk]; ok {
+		switch {
+		case bytes.Equal(prev.raw, raw):
+			return nil
+		case hasDoc, revision <= prev.revision:
+			return pki.ErrInvalidPostEpoch
+		}
+	} else if hasDoc {
+		return a.postError(client.ErrLateDescriptor)
+	}
+
+	m, ok := a.descriptors[epoch]
+	if !ok {
+		m = make(map[[eddsa.PublicKeySize]byte]*descriptor)
+		a.descriptors[epoch] = m
+	}
+	m[pk] = &descriptor{desc: d, raw: raw, revision: revision}
+
+	return nil
+}
+
+// postError returns err as seen through the real client.  Locks are held.
+func (a *Authority) postError(err error) error {
+	if a.isLegacy && (err == client.ErrLateDescriptor || err == client.ErrAuthorityInternal) {
+		return pki.ErrInvalidPostEpoch
+	}
+	return err
+}
+
+func (a *Authority) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if err, ok := a.getResponses[epoch]; ok {
+		return nil, nil, err
+	}
+	if d, ok := a.documents[epoch]; ok {
+		return d.doc, d.raw, nil
+	}
+	return nil, nil, client.ErrNotYet
+}
+
+func (a *Authority) GetWait(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
+	for {
+		doc, raw, err := a.Get(ctx, epoch)
+		if err != client.ErrNotYet {
+			return doc, raw, err
+		}
+
+		a.Lock()
+		ch, ok := a.docWaiters[epoch]
+		if !ok {
+			ch = make(chan interface{})
+			a.docWaiters[epoch] = ch
+		}
+		a.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
+func (a *Authority) GetRange(ctx context.Context, startEpoch, endEpoch uint64) (map[uint64]*client.RangeResult, error) {
+	if endEpoch < startEpoch {
+		return nil, fmt.Errorf("nonvoting/client: GetRange() invalid range: %v-%v", startEpoch, endEpoch)
+	}
+
+	ret := make(map[uint64]*client.RangeResult)
+	for epoch := startEpoch; ; epoch++ {
+		res := new(client.RangeResult)
+		res.Doc, res.Raw, res.Err = a.Get(ctx, epoch)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ret[epoch] = res
+		if epoch == endEpoch {
+			break
+		}
+	}
+	return ret, nil
+}
+
+func (a *Authority) GetDescriptorStatus(ctx context.Context, signingKey *eddsa.PrivateKey) ([]*client.DescriptorStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.isLegacy {
+		return nil, client.ErrNotSupported
+	}
+	pk := signingKey.PublicKey().ByteArray()
+	var ret []*client.DescriptorStatus
+	for epoch, m := range a.descriptors {
+		desc, ok := m[pk]
+		if !ok {
+			continue
+		}
+		st := &client.DescriptorStatus{
+			Epoch:    epoch,
+			Hash:     s11n.DescriptorHash(desc.raw),
+			Revision: desc.revision,
+		}
+		if d, ok := a.documents[epoch]; ok {
+			st.HasDocument = true
+			st.Included, st.Layer = isInDocument(d.doc, desc.desc.IdentityKey)
+		}
+		ret = append(ret, st)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Epoch < ret[j].Epoch })
+	return ret, nil
+}
+
+// GetCapabilities returns the Capabilities that the real client reports for
+// a current authority, or for a legacy one (see SetLegacy).
+func (a *Authority) GetCapabilities(ctx context.Context) (*client.Capabilities, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	caps := s11n.LocalCapabilities()
+	if a.isLegacy {
+		caps = s11n.LegacyCapabilities()
+	}
+	return &client.Capabilities{
+		DescriptorVersions: caps.DescriptorVersions,
+		DocumentVersions:   caps.DocumentVersions,
+		Features:           caps.Features,
+	}, nil
+}
+
+// GetAuthorityStatus returns the status for the epoch after the current one.
+// Documents can be generated from any set of descriptors, so the Authority is
+// always ready unless the Parameters are invalid.
+func (a *Authority) GetAuthorityStatus(ctx context.Context) (*client.AuthorityStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	epoch := a.now() + 1
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.isLegacy {
+		return nil, client.ErrNotSupported
+	}
+	var nrProviders, nrNodes int
+	for _, v := range a.descriptors[epoch] {
+		if v.desc.Layer == pki.LayerProvider {
+			nrProviders++
+		} else {
+			nrNodes++
+		}
+	}
+	return &client.AuthorityStatus{
+		Epoch:  epoch,
+		Ready:  a.params.Layers > 0,
+		Report: fmt.Sprintf("epoch %v: providers %v, nodes %v", epoch, nrProviders, nrNodes),
+	}, nil
+}
+
+// Watch returns a channel that delivers each Document as it is generated.
+// Unlike the real client, no events are delivered for epochs that lack a
+// Document.
+func (a *Authority) Watch(ctx context.Context) <-chan *client.WatchEvent {
+	w := &watcher{wakeCh: make(chan interface{}, 1)}
+
+	a.Lock()
+	a.watchers[w] = true
+	a.Unlock()
+
+	ch := make(chan *client.WatchEvent)
+	go func() {
+		defer func() {
+			a.Lock()
+			delete(a.watchers, w)
+			a.Unlock()
+			close(ch)
+		}()
+
+		for {
+			ev := w.pop()
+			if ev == nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-w.wakeCh:
+				}
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- ev:
+			}
+		}
+	}()
+	return ch
+}
+
+// Close is a no-op, as the Authority holds no sessions.
+func (a *Authority) Close() {}
+
+func (a *Authority) Deserialize(raw []byte) (*pki.Document, error) {
+	return s11n.VerifyAndParseDocument(raw, a.signingKey.PublicKey())
+}
+
+func (a *Authority) VerifyDocument(raw []byte) (*pki.Document, []*eddsa.PublicKey, error) {
+	doc, err := a.Deserialize(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return doc, []*eddsa.PublicKey{a.signingKey.PublicKey()}, nil
+}
+
+func (a *Authority) now() uint64 {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.epoch != nil {
+		return *a.epoch
+	}
+	now, _, _ := epochtime.Now()
+	return now
+}
+
+func isInDocument(doc *pki.Document, pk *eddsa.PublicKey) (bool, uint8) {
+	for layer, nodes := range doc.Topology {
+		for _, desc := range nodes {
+			if desc.IdentityKey.Equal(pk) {
+				return true, uint8(layer)
+			}
+		}
+	}
+	for _, desc := range doc.Providers {
+		if desc.IdentityKey.Equal(pk) {
+			return true, pki.LayerProvider
+		}
+	}
+	return false, 0
+}
+
+func (w *watcher) push(ev *client.WatchEvent) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.queue = append(w.queue, ev)
+	select {
+	case w.wakeCh <- true:
+	default:
+	}
+}
+
+func (w *watcher) pop() *client.WatchEvent {
+	w.Lock()
+	defer w.Unlock()
+
+	if len(w.queue) == 0 {
+		return nil
+	}
+	ev := w.queue[0]
+	w.queue = w.queue[1:]
+	return ev
+}
+
+// New constructs a new Authority instance, that signs Documents with the
+// provided signing key, or a random one if it is nil.
+func New(signingKey *eddsa.PrivateKey) (*Authority, error) {
+	if signingKey == nil {
+		var err error
+		if signingKey, err = eddsa.NewKeypair(rand.Reader); err != nil {
+			return nil, err
+		}
+	}
+
+	a := new(Authority)
+	a.signingKey = signingKey
+	a.params = *DefaultParameters()
+	a.descriptors = make(map[uint64]map[[eddsa.PublicKeySize]byte]*descriptor)
+	a.documents = make(map[uint64]*document)
+	a.docWaiters = make(map[uint64]chan interface{})
+	a.watchers = make(map[*watcher]bool)
+	a.getResponses = make(map[uint64]error)
+	a.postResponses = make(map[[eddsa.PublicKeySize]byte]error)
+
+	return a, nil
+}
+
+var _ client.Client = (*Authority)(nil)
@@ -0,0 +1,246 @@
+// authority_test.go - Katzenpost non-voting authority in-memory fake tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package clienttest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/authority/nonvoting/client"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testNode struct {
+	signingKey *eddsa.PrivateKey
+	layer      uint8
+}
+
+// descriptor returns a new descriptor for the node, valid for the epoch.
+func (n *testNode) descriptor(t *testing.T, epoch uint64) *pki.MixDescriptor {
+	require := require.New(t)
+
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "ecdh.NewKeypair()")
+	d := &pki.MixDescriptor{
+		Name:        n.signingKey.PublicKey().String()[:8],
+		IdentityKey: n.signingKey.PublicKey(),
+		LinkKey:     linkKey.PublicKey(),
+		MixKeys:     make(map[uint64]*ecdh.PublicKey),
+		Addresses: map[pki.Transport][]string{
+			pki.TransportTCPv4: []string{"192.0.2.1:4242"},
+		},
+		Layer: n.layer,
+	}
+	for e := epoch; e < epoch+3; e++ {
+		mixKey, err := ecdh.NewKeypair(rand.Reader)
+		require.NoError(err, "ecdh.NewKeypair()")
+		d.MixKeys[e] = mixKey.PublicKey()
+	}
+	return d
+}
+
+func newTestNode(t *testing.T, layer uint8) *testNode {
+	signingKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(t, err, "eddsa.NewKeypair()")
+	return &testNode{signingKey: signingKey, layer: layer}
+}
+
+// newTestAuthority returns an Authority for a single layer topology, at
+// the epoch, along with a provider and a mix that have posted descriptors
+// for the epoch.
+func newTestAuthority(t *testing.T, epoch uint64) (*Authority, *testNode, *testNode) {
+	require := require.New(t)
+
+	a, err := New(nil)
+	require.NoError(err, "New()")
+	a.SetParameters(&Parameters{Layers: 1})
+	a.SetEpoch(epoch)
+
+	provider, mix := newTestNode(t, pki.LayerProvider), newTestNode(t, 0)
+	for _, n := range []*testNode{provider, mix} {
+		require.NoError(a.Post(context.Background(), epoch, n.signingKey, n.descriptor(t, epoch)), "Post()")
+	}
+	return a, provider, mix
+}
+
+func TestAuthorityPost(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ctx := context.Background()
+	a, _, mix := newTestAuthority(t, 10)
+
+	// Only the previous, current and next epochs are accepted.
+	for _, v := range []struct {
+		epoch uint64
+		err   error
+	}{
+		{8, client.ErrInvalidDescriptor},
+		{9, nil},
+		{11, nil},
+		{12, client.ErrInvalidDescriptor},
+	} {
+		n := newTestNode(t, 0)
+		assert.Equal(v.err, a.Post(ctx, v.epoch, n.signingKey, n.descriptor(t, v.epoch)), "Post(): epoch %v", v.epoch)
+	}
+
+	// Descriptors must be signed by the node.
+	n := newTestNode(t, 0)
+	assert.Equal(client.ErrForbidden, a.Post(ctx, 10, n.signingKey, mix.descriptor(t, 10)), "Post(): wrong key")
+
+	// Descriptors may only be replaced by ones with a higher revision.
+	d := n.descriptor(t, 10)
+	require.NoError(a.PostRevision(ctx, 10, n.signingKey, d, 1), "PostRevision(): 1")
+	assert.NoError(a.PostRevision(ctx, 10, n.signingKey, d, 1), "PostRevision(): identical")
+	assert.Equal(pki.ErrInvalidPostEpoch, a.PostRevision(ctx, 10, n.signingKey, n.descriptor(t, 10), 1), "PostRevision(): same revision")
+	assert.NoError(a.PostRevision(ctx, 10, n.signingKey, n.descriptor(t, 10), 2), "PostRevision(): higher revision")
+	assert.Len(a.Descriptors(10), 3, "Descriptors()")
+
+	// Signed descriptors are posted, and reported, exactly as provided.
+	signed, err := client.SignDescriptor(n.signingKey, n.descriptor(t, 10), 3)
+	require.NoError(err, "SignDescriptor()")
+	require.NoError(a.PostSigned(ctx, 10, n.signingKey, signed), "PostSigned()")
+	st, err := a.GetDescriptorStatus(ctx, n.signingKey)
+	require.NoError(err, "GetDescriptorStatus()")
+	require.Len(st, 1, "GetDescriptorStatus(): epochs")
+	assert.Equal(client.DescriptorHash(signed), st[0].Hash, "GetDescriptorStatus(): Hash")
+	assert.Equal(uint64(3), st[0].Revision, "GetDescriptorStatus(): Revision")
+
+	// Once the Document is generated, descriptors are late.
+	_, err = a.GenerateDocument(10)
+	require.NoError(err, "GenerateDocument()")
+	late := newTestNode(t, 0)
+	assert.Equal(client.ErrLateDescriptor, a.Post(ctx, 10, late.signingKey, late.descriptor(t, 10)), "Post(): late")
+	assert.Equal(pki.ErrInvalidPostEpoch, a.PostRevision(ctx, 10, n.signingKey, n.descriptor(t, 10), 4), "PostRevision(): after Document")
+
+	// Scripted responses take precedence, till removed.
+	errScripted := errors.New("scripted")
+	a.SetPostResponse(late.signingKey.PublicKey(), errScripted)
+	assert.Equal(errScripted, a.Post(ctx, 11, late.signingKey, late.descriptor(t, 11)), "Post(): scripted")
+	a.SetPostResponse(late.signingKey.PublicKey(), nil)
+	assert.NoError(a.Post(ctx, 11, late.signingKey, late.descriptor(t, 11)), "Post(): unscripted")
+}
+
+func TestAuthorityGet(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ctx := context.Background()
+	a, provider, mix := newTestAuthority(t, 10)
+
+	_, _, err := a.Get(ctx, 10)
+	assert.Equal(client.ErrNotYet, err, "Get(): not yet")
+
+	// Waiters and watchers are woken once the Document is generated.
+	watchCtx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+	watchCh := a.Watch(watchCtx)
+	waitCh := make(chan error)
+	go func() {
+		_, _, err := a.GetWait(ctx, 10)
+		waitCh <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	doc, err := a.GenerateDocument(10)
+	require.NoError(err, "GenerateDocument()")
+	_, err = a.GenerateDocument(10)
+	assert.Error(err, "GenerateDocument(): twice")
+	assert.NoError(<-waitCh, "GetWait()")
+	ev := <-watchCh
+	assert.Equal(uint64(10), ev.Epoch, "Watch(): Epoch")
+	assert.Equal(doc, ev.Doc, "Watch(): Doc")
+
+	got, raw, err := a.Get(ctx, 10)
+	require.NoError(err, "Get()")
+	assert.Equal(doc, got, "Get(): Doc")
+	verified, err := a.Deserialize(raw)
+	require.NoError(err, "Deserialize()")
+	assert.Equal(uint64(10), verified.Epoch, "Deserialize(): Epoch")
+	require.Len(doc.Topology, 1, "Topology")
+	require.Len(doc.Providers, 1, "Providers")
+
+	// Scripted responses take precedence, till removed.
+	a.SetGetResponse(10, pki.ErrNoDocument)
+	_, _, err = a.Get(ctx, 10)
+	assert.Equal(pki.ErrNoDocument, err, "Get(): scripted")
+	a.SetGetResponse(10, nil)
+
+	m, err := a.GetRange(ctx, 9, 11)
+	require.NoError(err, "GetRange()")
+	require.Len(m, 3, "GetRange(): epochs")
+	assert.Equal(client.ErrNotYet, m[9].Err, "GetRange(): 9")
+	assert.NoError(m[10].Err, "GetRange(): 10")
+	assert.Equal(client.ErrNotYet, m[11].Err, "GetRange(): 11")
+
+	// The descriptor status reflects the Document.
+	for _, v := range []struct {
+		n     *testNode
+		layer uint8
+	}{
+		{provider, pki.LayerProvider},
+		{mix, 0},
+	} {
+		st, err := a.GetDescriptorStatus(ctx, v.n.signingKey)
+		require.NoError(err, "GetDescriptorStatus()")
+		require.Len(st, 1, "GetDescriptorStatus(): epochs")
+		assert.Equal(uint64(10), st[0].Epoch, "GetDescriptorStatus(): Epoch")
+		assert.True(st[0].HasDocument, "GetDescriptorStatus(): HasDocument")
+		assert.True(st[0].Included, "GetDescriptorStatus(): Included")
+		assert.Equal(v.layer, st[0].Layer, "GetDescriptorStatus(): Layer")
+	}
+}
+
+func TestAuthorityLegacy(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ctx := context.Background()
+	a, _, mix := newTestAuthority(t, 10)
+
+	caps, err := a.GetCapabilities(ctx)
+	require.NoError(err, "GetCapabilities()")
+	assert.True(caps.HasFeature(client.FeatureDescriptorErrorCodes), "GetCapabilities(): current")
+
+	// Legacy authorities lack the extensions, and report late uploads as
+	// conflicts.
+	a.SetLegacy(true)
+	caps, err = a.GetCapabilities(ctx)
+	require.NoError(err, "GetCapabilities(): legacy")
+	assert.Empty(caps.Features, "GetCapabilities(): legacy")
+	_, err = a.GetDescriptorStatus(ctx, mix.signingKey)
+	assert.Equal(client.ErrNotSupported, err, "GetDescriptorStatus(): legacy")
+	_, err = a.GetAuthorityStatus(ctx)
+	assert.Equal(client.ErrNotSupported, err, "GetAuthorityStatus(): legacy")
+	n := newTestNode(t, 0)
+	assert.Equal(client.ErrNotSupported, a.PostRevision(ctx, 10, n.signingKey, n.descriptor(t, 10), 1), "PostRevision(): legacy")
+
+	_, err = a.GenerateDocument(10)
+	require.NoError(err, "GenerateDocument()")
+	assert.Equal(pki.ErrInvalidPostEpoch, a.Post(ctx, 10, n.signingKey, n.descriptor(t, 10)), "Post(): legacy, late")
+	a.SetPostResponse(n.signingKey.PublicKey(), client.ErrAuthorityInternal)
+	assert.Equal(pki.ErrInvalidPostEpoch, a.Post(ctx, 11, n.signingKey, n.descriptor(t, 11)), "Post(): legacy, internal error")
+
+	a.SetLegacy(false)
+	assert.Equal(client.ErrAuthorityInternal, a.Post(ctx, 11, n.signingKey, n.descriptor(t, 11)), "Post(): internal error")
+}
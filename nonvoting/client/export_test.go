@@ -0,0 +1,48 @@
+// export_test.go - Katzenpost non-voting authority client test hooks.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/pki"
+)
+
+// The fake authority in clienttest imports this package, so tests that
+// use it live in client_test, and reach the internals through these hooks.
+
+// NewPublisherWithClock constructs and starts a new Publisher like
+// NewPublisher, that uses clock as the source of the current epoch.
+func NewPublisherWithClock(cfg *PublisherConfig, clock func() (uint64, time.Duration, time.Duration)) (*Publisher, error) {
+	return newPublisher(cfg, clock)
+}
+
+// WatchWithClock runs the Watch worker with clock as the source of the
+// current epoch, fetching Documents with fetchFn.
+func WatchWithClock(ctx context.Context, logBackend *log.Backend, policy *RetryPolicy, clock func() (uint64, time.Duration, time.Duration), fetchFn func(context.Context, uint64) (*pki.Document, []byte, error)) <-chan *WatchEvent {
+	c := &client{
+		cfg:   &Config{RetryPolicy: policy},
+		log:   logBackend.GetLogger("pki/nonvoting/client"),
+		clock: clock,
+		rng:   newLockedRand(),
+	}
+	ch := make(chan *WatchEvent, watchChannelSize)
+	go c.watchWorker(ctx, ch, fetchFn)
+	return ch
+}
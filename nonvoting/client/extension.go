@@ -0,0 +1,246 @@
+// extension.go - Katzenpost non-voting authority client wire extensions.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/katzenpost/authority/nonvoting/internal/s11n"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/pki"
+)
+
+func (c *client) negotiate(ctx context.Context, s *session) (*s11n.Capabilities, error) {
+	ep := s.ep
+	ep.Lock()
+	isLegacy, negotiated := time.Now().Before(ep.legacyUntil), ep.negotiated
+	ep.Unlock()
+	if isLegacy {
+		return s11n.LegacyCapabilities(), nil
+	}
+
+	b, err := s11n.SerializeCapabilities(s11n.LocalCapabilities())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.extRoundTrip(&s11n.ExtensionRequest{
+		Command: s11n.ExtGetCapabilities,
+		Payload: b,
+	})
+	switch {
+	case err == errLegacyAuthority:
+		// Authorities that predate capability advertisement reject the
+		// request as a descriptor upload for an invalid epoch.
+	case err != nil && !negotiated && ctx.Err() == nil && isClosedByPeer(err):
+		// ... or close the session if the peer is not allowed to post,
+		// which is told apart from a timeout or a reset that may happen
+		// to any authority.
+		err = errLegacyAuthority
+	case err != nil:
+		return nil, err
+	}
+	if err == errLegacyAuthority {
+		c.log.Debugf("nonvoting/Client: Authority %v does not support capabilities.", ep.addr)
+		ep.Lock()
+		ep.legacyUntil = time.Now().Add(legacyReprobeInterval)
+		ep.Unlock()
+		return nil, err
+	}
+
+	// Parse the capabilities.
+	caps, err := s11n.ParseCapabilities(resp.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if caps.Reason != "" {
+		c.log.Errorf("nonvoting/Client: Authority %v rejected capabilities: %v", ep.addr, caps.Reason)
+		return nil, ErrIncompatibleAuthority
+	}
+	if err = s11n.LocalCapabilities().Negotiate(caps); err != nil {
+		c.log.Errorf("nonvoting/Client: Incompatible authority %v: %v", ep.addr, err)
+		return nil, ErrIncompatibleAuthority
+	}
+
+	ep.Lock()
+	ep.negotiated = true
+	ep.Unlock()
+
+	return caps, nil
+}
+
+func (c *client) GetDescriptorStatus(ctx context.Context, signingKey *eddsa.PrivateKey) ([]*DescriptorStatus, error) {
+	c.log.Debugf("GetDescriptorStatus(ctx, %v)", signingKey.PublicKey())
+
+	var statuses []*s11n.DescriptorStatus
+	err := c.withSession(ctx, &sessionRequest{
+		signingKey: signingKey,
+		fn: func(_ context.Context, s *session) error {
+			if !s.caps.HasFeature(s11n.FeatureDescriptorStatus) {
+				return ErrNotSupported
+			}
+
+			// Dispatch the get_descriptor_status extension.
+			resp, err := s.extRoundTrip(&s11n.ExtensionRequest{Command: s11n.ExtGetDescriptorStatus})
+			if err != nil {
+				return err
+			}
+			statuses, err = s11n.ParseDescriptorStatus(resp.Payload)
+			return err
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*DescriptorStatus, 0, len(statuses))
+	for _, v := range statuses {
+		ret = append(ret, &DescriptorStatus{
+			Epoch:       v.Epoch,
+			Hash:        v.Hash,
+			Revision:    v.Revision,
+			HasDocument: v.HasDocument,
+			Included:    v.Included,
+			Layer:       v.Layer,
+			Standby:     v.Standby,
+		})
+	}
+	return ret, nil
+}
+
+func (c *client) GetAuthorityStatus(ctx context.Context) (*AuthorityStatus, error) {
+	c.log.Debugf("GetAuthorityStatus(ctx)")
+
+	var status *s11n.AuthorityStatus
+	err := c.withSession(ctx, &sessionRequest{
+		fn: func(_ context.Context, s *session) error {
+			if !s.caps.HasFeature(s11n.FeatureAuthorityStatus) {
+				return ErrNotSupported
+			}
+
+			// Dispatch the get_authority_status extension.
+			resp, err := s.extRoundTrip(&s11n.ExtensionRequest{Command: s11n.ExtGetAuthorityStatus})
+			if err != nil {
+				return err
+			}
+			status, err = s11n.ParseAuthorityStatus(resp.Payload)
+			return err
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (c *client) GetWait(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
+	c.log.Debugf("GetWait(ctx, %d)", epoch)
+
+	if doc, raw := c.getCached(epoch); doc != nil {
+		return doc, raw, nil
+	}
+
+	// The authority bounds how long each request is held, so keep
+	// re-issuing the request until the context is done.
+	const maxWait = 5 * time.Minute
+	for {
+		wait := maxWait
+		if deadline, ok := ctx.Deadline(); ok {
+			if wait = time.Until(deadline); wait > maxWait {
+				wait = maxWait
+			} else if wait < time.Second {
+				// Give up, as the round trip is unlikely to complete in time.
+				return nil, nil, context.DeadlineExceeded
+			}
+		}
+
+		start := time.Now()
+		doc, raw, err := c.getConsensus(ctx, epoch, wait, false)
+		switch err {
+		case ErrNotYet:
+		case ErrNotSupported:
+			return c.pollGet(ctx, epoch)
+		default:
+			return doc, raw, err
+		}
+		if time.Since(start) < wait/2 {
+			// The authority did not hold the request, so it is not
+			// expecting to generate the Document.
+			return nil, nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		default:
+		}
+	}
+}
+
+// pollGet repeatedly fetches the Document for the epoch, with the
+// RetryPolicy's backoff, till it is generated or the context is done, for
+// authorities that can not hold the request.
+func (c *client) pollGet(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
+	policy := c.cfg.RetryPolicy
+	if policy == nil {
+		policy = new(RetryPolicy)
+	}
+	for attempt := 1; ; attempt++ {
+		doc, raw, err := c.get(ctx, epoch, false)
+		if err != ErrNotYet {
+			return doc, raw, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(policy.backoff(attempt, c.rng)):
+		}
+	}
+}
+
+func (c *client) getConsensusRange(ctx context.Context, startEpoch, endEpoch uint64) ([]*s11n.ConsensusRangeEntry, error) {
+	var entries []*s11n.ConsensusRangeEntry
+	err := c.withSession(ctx, &sessionRequest{
+		fn: func(_ context.Context, s *session) error {
+			if !s.caps.HasFeature(s11n.FeatureConsensusRange) {
+				return ErrNotSupported
+			}
+
+			// Dispatch the get_consensus_range extension.
+			resp, err := s.extRoundTrip(&s11n.ExtensionRequest{
+				Command:  s11n.ExtGetConsensusRange,
+				Epoch:    startEpoch,
+				EndEpoch: endEpoch,
+			})
+			if err != nil {
+				return err
+			}
+			entries, err = s11n.ParseConsensusRange(resp.Payload)
+			return err
+		},
+	})
+	return entries, err
+}
+
+func isClosedByPeer(err error) bool {
+	if te, ok := err.(*transportError); ok {
+		err = te.err
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
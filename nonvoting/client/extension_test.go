@@ -0,0 +1,481 @@
+// extension_test.go - Non-voting authority client wire extension tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/authority/nonvoting/internal/s11n"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/wire"
+	"github.com/katzenpost/core/wire/commands"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAuthority is a wire protocol peer, that handles each command with
+// fn, which returns nil to close the session instead of responding.
+type fakeAuthority struct {
+	sync.Mutex
+
+	fn func(w *fakeWire, cmd commands.Command) commands.Command
+
+	dials      int
+	extensions []string
+}
+
+func (a *fakeAuthority) newClient(t *testing.T) *client {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", true)
+	require.NoError(err, "log.New()")
+	authorityKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+
+	cfg := &Config{
+		LogBackend: logBackend,
+		Address:    "192.0.2.1:2323",
+		PublicKey:  authorityKey.PublicKey(),
+		DialContextFn: func(ctx context.Context, network, address string) (net.Conn, error) {
+			a.Lock()
+			a.dials++
+			a.Unlock()
+			conn, peerConn := net.Pipe()
+			peerConn.Close()
+			return conn, nil
+		},
+	}
+	c, err := New(cfg)
+	require.NoError(err, "New()")
+	cc := c.(*client)
+	cc.newWireFn = func(*wire.SessionConfig) (wireSession, error) {
+		return &fakeWire{a: a}, nil
+	}
+	return cc
+}
+
+func (a *fakeAuthority) nrDials() int {
+	a.Lock()
+	defer a.Unlock()
+	return a.dials
+}
+
+func (a *fakeAuthority) handle(w *fakeWire, cmd commands.Command) commands.Command {
+	if c, ok := cmd.(*commands.PostDescriptor); ok && c.Epoch == s11n.ExtensionEpoch {
+		req, err := s11n.ParseExtensionRequest(c.Payload)
+		if err != nil {
+			return nil
+		}
+		a.Lock()
+		a.extensions = append(a.extensions, req.Command)
+		a.Unlock()
+	}
+	return a.fn(w, cmd)
+}
+
+type fakeWire struct {
+	a *fakeAuthority
+
+	nrCommands int
+	resp       commands.Command
+	isClosed   bool
+}
+
+func (w *fakeWire) Initialize(conn net.Conn) error {
+	return nil
+}
+
+func (w *fakeWire) SendCommand(cmd commands.Command) error {
+	if w.isClosed {
+		return io.ErrClosedPipe
+	}
+	w.nrCommands++
+	w.resp = w.a.handle(w, cmd)
+	return nil
+}
+
+func (w *fakeWire) RecvCommand() (commands.Command, error) {
+	resp := w.resp
+	if resp == nil {
+		w.isClosed = true
+		return nil, io.EOF
+	}
+	w.resp = nil
+	return resp, nil
+}
+
+func (w *fakeWire) Close() {
+	w.isClosed = true
+}
+
+// extensionResponse returns the command carrying the extension response.
+func extensionResponse(t *testing.T, command string, errorCode uint8, payload []byte) commands.Command {
+	b, err := s11n.SerializeExtensionResponse(&s11n.ExtensionResponse{
+		Command:   command,
+		ErrorCode: errorCode,
+		Payload:   payload,
+	})
+	require.NoError(t, err, "SerializeExtensionResponse()")
+	return &commands.Consensus{ErrorCode: commands.ConsensusOk, Payload: b}
+}
+
+// capabilitiesResponse returns the command carrying the capabilities.
+func capabilitiesResponse(t *testing.T, caps *s11n.Capabilities) commands.Command {
+	b, err := s11n.SerializeCapabilities(caps)
+	require.NoError(t, err, "SerializeCapabilities()")
+	return extensionResponse(t, s11n.ExtGetCapabilities, 0, b)
+}
+
+func TestNegotiate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	serverCaps := s11n.LocalCapabilities()
+	serverCaps.Features = []string{s11n.FeatureConsensusRange}
+
+	// Authorities that support the extensions respond with their
+	// capabilities.
+	a := &fakeAuthority{}
+	a.fn = func(w *fakeWire, cmd commands.Command) commands.Command {
+		return capabilitiesResponse(t, serverCaps)
+	}
+	c := a.newClient(t)
+	caps, err := c.GetCapabilities(context.Background())
+	require.NoError(err, "GetCapabilities()")
+	assert.Equal(serverCaps.Features, caps.Features, "Features")
+	assert.True(c.endpoints[0].negotiated, "negotiated")
+	assert.Equal([]string{s11n.ExtGetCapabilities}, a.extensions, "Extensions")
+
+	// Authorities that predate the extensions reject the request as a
+	// descriptor upload, or close the session if the peer is not allowed
+	// to post.
+	for _, v := range []struct {
+		name string
+		resp commands.Command
+	}{
+		{"Rejected", &commands.PostDescriptorStatus{ErrorCode: commands.DescriptorInvalid}},
+		{"Closed", nil},
+	} {
+		a = &fakeAuthority{}
+		a.fn = func(w *fakeWire, cmd commands.Command) commands.Command {
+			if w.nrCommands > 1 {
+				// Legacy authorities only handle a single command.
+				return nil
+			}
+			if _, ok := cmd.(*commands.PostDescriptor); ok {
+				return v.resp
+			}
+			return &commands.Consensus{ErrorCode: commands.ConsensusNotFound}
+		}
+		c = a.newClient(t)
+		caps, err = c.GetCapabilities(context.Background())
+		require.NoError(err, "%v: GetCapabilities()", v.name)
+		assert.Equal(s11n.LegacyCapabilities(), caps, "%v: Capabilities", v.name)
+		assert.Equal(2, a.nrDials(), "%v: Dials", v.name)
+
+		// The legacy authority is not re-probed on every request.
+		_, _, err = c.Get(context.Background(), 23)
+		assert.Equal(ErrNotYet, err, "%v: Get()", v.name)
+		assert.Equal(3, a.nrDials(), "%v: Get(): Dials", v.name)
+		assert.Len(a.extensions, 1, "%v: Extensions", v.name)
+	}
+
+	// Authorities that support the extensions, but have nothing in common
+	// with the client explain why.
+	a = &fakeAuthority{}
+	a.fn = func(w *fakeWire, cmd commands.Command) commands.Command {
+		return capabilitiesResponse(t, &s11n.Capabilities{Reason: "no common document version"})
+	}
+	c = a.newClient(t)
+	_, err = c.GetCapabilities(context.Background())
+	assert.Equal(ErrIncompatibleAuthority, err, "Incompatible: GetCapabilities()")
+
+	// Authorities that previously negotiated capabilities, that close the
+	// session are not mistaken for legacy authorities.
+	a = &fakeAuthority{}
+	a.fn = func(w *fakeWire, cmd commands.Command) commands.Command {
+		return nil
+	}
+	c = a.newClient(t)
+	c.endpoints[0].negotiated = true
+	_, err = c.GetCapabilities(context.Background())
+	assert.Error(err, "Negotiated: GetCapabilities()")
+	assert.True(c.endpoints[0].legacyUntil.IsZero(), "Negotiated: legacyUntil")
+}
+
+func newTestDescriptor(t *testing.T, epoch uint64) (*eddsa.PrivateKey, *pki.MixDescriptor) {
+	require := require.New(t)
+
+	signingKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "ecdh.NewKeypair()")
+	mixKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "ecdh.NewKeypair()")
+
+	return signingKey, &pki.MixDescriptor{
+		Name:        signingKey.PublicKey().String()[:8],
+		IdentityKey: signingKey.PublicKey(),
+		LinkKey:     linkKey.PublicKey(),
+		MixKeys:     map[uint64]*ecdh.PublicKey{epoch: mixKey.PublicKey()},
+		Addresses: map[pki.Transport][]string{
+			pki.TransportTCPv4: []string{"192.0.2.1:4242"},
+		},
+	}
+}
+
+func TestGetDescriptorStatus(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	const epoch = 23
+
+	// The authority reports the hash of the descriptor exactly as posted.
+	var posted []byte
+	a := &fakeAuthority{}
+	a.fn = func(w *fakeWire, cmd commands.Command) commands.Command {
+		c := cmd.(*commands.PostDescriptor)
+		if c.Epoch != s11n.ExtensionEpoch {
+			posted = c.Payload
+			return &commands.PostDescriptorStatus{ErrorCode: commands.DescriptorOk}
+		}
+		req, err := s11n.ParseExtensionRequest(c.Payload)
+		require.NoError(err, "ParseExtensionRequest()")
+		switch req.Command {
+		case s11n.ExtGetCapabilities:
+			return capabilitiesResponse(t, s11n.LocalCapabilities())
+		case s11n.ExtGetDescriptorStatus:
+			b, err := s11n.SerializeDescriptorStatus([]*s11n.DescriptorStatus{
+				&s11n.DescriptorStatus{Epoch: epoch, Hash: s11n.DescriptorHash(posted), Revision: 1},
+			})
+			require.NoError(err, "SerializeDescriptorStatus()")
+			return extensionResponse(t, req.Command, 0, b)
+		default:
+			return nil
+		}
+	}
+	c := a.newClient(t)
+
+	signingKey, d := newTestDescriptor(t, epoch)
+	signed, err := SignDescriptor(signingKey, d, 1)
+	require.NoError(err, "SignDescriptor()")
+	require.NoError(c.PostSigned(context.Background(), epoch, signingKey, signed), "PostSigned()")
+	assert.Equal(signed, posted, "PostSigned(): posted descriptor")
+
+	statuses, err := c.GetDescriptorStatus(context.Background(), signingKey)
+	require.NoError(err, "GetDescriptorStatus()")
+	require.Len(statuses, 1, "GetDescriptorStatus()")
+	assert.Equal(DescriptorHash(signed), statuses[0].Hash, "Hash")
+	assert.Equal(uint64(1), statuses[0].Revision, "Revision")
+
+	// Descriptors that are not signed by the signing key are not posted.
+	otherKey, _ := newTestDescriptor(t, epoch)
+	nrDials := a.nrDials()
+	assert.Error(c.PostSigned(context.Background(), epoch, otherKey, signed), "PostSigned(): wrong key")
+	assert.Error(c.PostSigned(context.Background(), epoch+1, signingKey, signed), "PostSigned(): wrong epoch")
+	assert.Equal(nrDials, a.nrDials(), "PostSigned(): invalid: Dials")
+
+	// Authorities that predate the extensions do not support the status.
+	a = &fakeAuthority{}
+	a.fn = func(w *fakeWire, cmd commands.Command) commands.Command {
+		return &commands.PostDescriptorStatus{ErrorCode: commands.DescriptorInvalid}
+	}
+	c = a.newClient(t)
+	_, err = c.GetDescriptorStatus(context.Background(), signingKey)
+	assert.Equal(ErrNotSupported, err, "Legacy: GetDescriptorStatus()")
+}
+
+func TestGetAuthorityStatus(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	status := &s11n.AuthorityStatus{Epoch: 23, Ready: true, Report: "providers 1/1"}
+	serverCaps := s11n.LocalCapabilities()
+	a := &fakeAuthority{}
+	a.fn = func(w *fakeWire, cmd commands.Command) commands.Command {
+		req, err := s11n.ParseExtensionRequest(cmd.(*commands.PostDescriptor).Payload)
+		require.NoError(err, "ParseExtensionRequest()")
+		switch req.Command {
+		case s11n.ExtGetCapabilities:
+			return capabilitiesResponse(t, serverCaps)
+		case s11n.ExtGetAuthorityStatus:
+			b, err := s11n.SerializeAuthorityStatus(status)
+			require.NoError(err, "SerializeAuthorityStatus()")
+			return extensionResponse(t, req.Command, 0, b)
+		default:
+			return nil
+		}
+	}
+	c := a.newClient(t)
+
+	rStatus, err := c.GetAuthorityStatus(context.Background())
+	require.NoError(err, "GetAuthorityStatus()")
+	assert.Equal(status, rStatus, "GetAuthorityStatus()")
+
+	// Listeners other than admin listeners do not serve the status, so it
+	// is not requested.
+	serverCaps.Features = []string{s11n.FeatureConsensusRange}
+	a = &fakeAuthority{fn: a.fn}
+	c = a.newClient(t)
+	_, err = c.GetAuthorityStatus(context.Background())
+	assert.Equal(ErrNotSupported, err, "Not admin: GetAuthorityStatus()")
+	assert.NotContains(a.extensions, s11n.ExtGetAuthorityStatus, "Not admin: requested")
+}
+
+func TestGetRange(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var nrGets int
+	onGet := func(cmd *commands.GetConsensus) commands.Command {
+		nrGets++
+		if cmd.Epoch == 23 {
+			return &commands.Consensus{ErrorCode: commands.ConsensusGone}
+		}
+		return &commands.Consensus{ErrorCode: commands.ConsensusNotFound}
+	}
+
+	// Authorities that support ranges are sent a single request.
+	a := &fakeAuthority{}
+	a.fn = func(w *fakeWire, cmd commands.Command) commands.Command {
+		switch c := cmd.(type) {
+		case *commands.GetConsensus:
+			return onGet(c)
+		case *commands.PostDescriptor:
+			req, err := s11n.ParseExtensionRequest(c.Payload)
+			require.NoError(err, "ParseExtensionRequest()")
+			switch req.Command {
+			case s11n.ExtGetCapabilities:
+				return capabilitiesResponse(t, s11n.LocalCapabilities())
+			case s11n.ExtGetConsensusRange:
+				assert.Equal(uint64(23), req.Epoch, "Epoch")
+				assert.Equal(uint64(25), req.EndEpoch, "EndEpoch")
+				b, err := s11n.SerializeConsensusRange([]*s11n.ConsensusRangeEntry{
+					&s11n.ConsensusRangeEntry{Epoch: 23, ErrorCode: commands.ConsensusGone},
+					&s11n.ConsensusRangeEntry{Epoch: 24, ErrorCode: commands.ConsensusNotFound},
+				})
+				require.NoError(err, "SerializeConsensusRange()")
+				return extensionResponse(t, req.Command, 0, b)
+			}
+		}
+		return nil
+	}
+	c := a.newClient(t)
+	res, err := c.GetRange(context.Background(), 23, 25)
+	require.NoError(err, "GetRange()")
+	require.Len(res, 3, "GetRange()")
+	assert.Equal(pki.ErrNoDocument, res[23].Err, "GetRange(): Gone")
+	assert.Equal(ErrNotYet, res[24].Err, "GetRange(): NotFound")
+	assert.Equal(errRangeOmitted, res[25].Err, "GetRange(): Omitted")
+	assert.Equal(0, nrGets, "GetRange(): get_consensus")
+	assert.Equal([]string{s11n.ExtGetCapabilities, s11n.ExtGetConsensusRange}, a.extensions, "Extensions")
+
+	// Authorities that do not support ranges are asked for each epoch.
+	caps := s11n.LocalCapabilities()
+	caps.Features = nil
+	a = &fakeAuthority{}
+	a.fn = func(w *fakeWire, cmd commands.Command) commands.Command {
+		switch c := cmd.(type) {
+		case *commands.GetConsensus:
+			return onGet(c)
+		default:
+			return capabilitiesResponse(t, caps)
+		}
+	}
+	c = a.newClient(t)
+	res, err = c.GetRange(context.Background(), 23, 25)
+	require.NoError(err, "Fallback: GetRange()")
+	require.Len(res, 3, "Fallback: GetRange()")
+	assert.Equal(pki.ErrNoDocument, res[23].Err, "Fallback: GetRange(): Gone")
+	assert.Equal(ErrNotYet, res[24].Err, "Fallback: GetRange(): NotFound")
+	assert.Equal(ErrNotYet, res[25].Err, "Fallback: GetRange(): NotFound")
+	assert.Equal(3, nrGets, "Fallback: GetRange(): get_consensus")
+	assert.NotContains(a.extensions, s11n.ExtGetConsensusRange, "Fallback: Extensions")
+}
+
+func TestGetWait(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Authorities that support long-polls are asked to hold the request.
+	var timeout uint32
+	a := &fakeAuthority{}
+	a.fn = func(w *fakeWire, cmd commands.Command) commands.Command {
+		c, ok := cmd.(*commands.PostDescriptor)
+		if !ok {
+			return nil
+		}
+		req, err := s11n.ParseExtensionRequest(c.Payload)
+		require.NoError(err, "ParseExtensionRequest()")
+		switch req.Command {
+		case s11n.ExtGetCapabilities:
+			return capabilitiesResponse(t, s11n.LocalCapabilities())
+		case s11n.ExtGetConsensusWait:
+			assert.Equal(uint64(23), req.Epoch, "Epoch")
+			timeout = req.Timeout
+			return extensionResponse(t, req.Command, commands.ConsensusGone, nil)
+		default:
+			return nil
+		}
+	}
+	c := a.newClient(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	_, _, err := c.GetWait(ctx, 23)
+	assert.Equal(pki.ErrNoDocument, err, "GetWait()")
+	assert.True(timeout > 0 && timeout <= 10, "GetWait(): Timeout: %v", timeout)
+
+	// Authorities that do not support long-polls are polled.
+	caps := s11n.LocalCapabilities()
+	caps.Features = nil
+	var nrGets int
+	ctx, cancelFn = context.WithCancel(context.Background())
+	defer cancelFn()
+	a = &fakeAuthority{}
+	a.fn = func(w *fakeWire, cmd commands.Command) commands.Command {
+		if _, ok := cmd.(*commands.GetConsensus); !ok {
+			return capabilitiesResponse(t, caps)
+		}
+		nrGets++
+		switch nrGets {
+		case 3:
+			return &commands.Consensus{ErrorCode: commands.ConsensusGone}
+		case 6:
+			cancelFn()
+		}
+		return &commands.Consensus{ErrorCode: commands.ConsensusNotFound}
+	}
+	c = a.newClient(t)
+	c.cfg.RetryPolicy = &RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	_, _, err = c.GetWait(context.Background(), 23)
+	assert.Equal(pki.ErrNoDocument, err, "Poll: GetWait()")
+	assert.Equal(3, nrGets, "Poll: get_consensus")
+
+	// ... till the context is done.
+	_, _, err = c.GetWait(ctx, 24)
+	assert.Equal(context.Canceled, err, "Poll: GetWait(): canceled")
+	assert.Equal(6, nrGets, "Poll: canceled: get_consensus")
+}
@@ -0,0 +1,220 @@
+// metrics.go - Katzenpost non-voting authority client metrics.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsNamespace = "katzenpost_nonvoting_client"
+
+// metricsBuckets are the upper bounds of the latency histogram buckets, in
+// seconds.  The larger buckets accommodate long-polled requests.
+var metricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(metricsBuckets))
+	}
+	for i, le := range metricsBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+type metricFamily struct {
+	name string
+	help string
+
+	counters   map[string]uint64
+	histograms map[string]*histogram
+}
+
+func (f *metricFamily) inc(labels string) {
+	if f.counters == nil {
+		f.counters = make(map[string]uint64)
+	}
+	f.counters[labels]++
+}
+
+func (f *metricFamily) observe(labels string, d time.Duration) {
+	if f.histograms == nil {
+		f.histograms = make(map[string]*histogram)
+	}
+	h, ok := f.histograms[labels]
+	if !ok {
+		h = new(histogram)
+		f.histograms[labels] = h
+	}
+	h.observe(d)
+}
+
+func (f *metricFamily) write(w io.Writer) {
+	if f.counters != nil {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", f.name, f.help, f.name)
+		for _, labels := range sortedKeys(f.counters) {
+			fmt.Fprintf(w, "%s{%s} %d\n", f.name, labels, f.counters[labels])
+		}
+	}
+	if f.histograms != nil {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", f.name, f.help, f.name)
+		labelSet := make([]string, 0, len(f.histograms))
+		for labels := range f.histograms {
+			labelSet = append(labelSet, labels)
+		}
+		sort.Strings(labelSet)
+		for _, labels := range labelSet {
+			h := f.histograms[labels]
+			for i, le := range metricsBuckets {
+				fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", f.name, labels, strconv.FormatFloat(le, 'g', -1, 64), h.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", f.name, labels, h.count)
+			fmt.Fprintf(w, "%s_sum{%s} %s\n", f.name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+			fmt.Fprintf(w, "%s_count{%s} %d\n", f.name, labels, h.count)
+		}
+	}
+}
+
+// MetricsObserver is an Observer that collects latency histograms and
+// result counters, and exposes them in the Prometheus text format.  The
+// zero value is ready to use.
+type MetricsObserver struct {
+	mu sync.Mutex
+
+	dials            metricFamily
+	dialSeconds      metricFamily
+	handshakes       metricFamily
+	handshakeSeconds metricFamily
+	commands         metricFamily
+	commandSeconds   metricFamily
+}
+
+// initFamilies names the metric families, if this has yet to be done.  The
+// caller must hold the lock.
+func (m *MetricsObserver) initFamilies() {
+	if m.dials.name != "" {
+		return
+	}
+	m.dials = metricFamily{name: metricsNamespace + "_dials_total", help: "Connection attempts to the authority."}
+	m.dialSeconds = metricFamily{name: metricsNamespace + "_dial_seconds", help: "Time taken to connect to the authority."}
+	m.handshakes = metricFamily{name: metricsNamespace + "_handshakes_total", help: "Wire protocol handshakes with the authority."}
+	m.handshakeSeconds = metricFamily{name: metricsNamespace + "_handshake_seconds", help: "Time taken to complete the wire protocol handshake."}
+	m.commands = metricFamily{name: metricsNamespace + "_commands_total", help: "Commands sent to the authority, by result."}
+	m.commandSeconds = metricFamily{name: metricsNamespace + "_command_seconds", help: "Command round trip time."}
+}
+
+// OnDial implements the Observer interface.
+func (m *MetricsObserver) OnDial(addr string, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.initFamilies()
+
+	labels := formatLabels("address", addr, "result", errorResult(err))
+	m.dials.inc(labels)
+	m.dialSeconds.observe(labels, elapsed)
+}
+
+// OnHandshake implements the Observer interface.
+func (m *MetricsObserver) OnHandshake(addr string, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.initFamilies()
+
+	labels := formatLabels("address", addr, "result", errorResult(err))
+	m.handshakes.inc(labels)
+	m.handshakeSeconds.observe(labels, elapsed)
+}
+
+// OnRoundTrip implements the Observer interface.
+func (m *MetricsObserver) OnRoundTrip(addr, command, result string, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.initFamilies()
+
+	m.commands.inc(formatLabels("address", addr, "command", command, "result", result))
+	m.commandSeconds.observe(formatLabels("address", addr, "command", command), elapsed)
+}
+
+// WriteMetrics writes the metrics to w in the Prometheus text format.
+func (m *MetricsObserver) WriteMetrics(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.initFamilies()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range []*metricFamily{&m.dials, &m.dialSeconds, &m.handshakes, &m.handshakeSeconds, &m.commands, &m.commandSeconds} {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP implements the http.Handler interface, to serve the metrics to a
+// Prometheus scraper.
+func (m *MetricsObserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteMetrics(w)
+}
+
+func errorResult(err error) string {
+	if err != nil {
+		return ResultError
+	}
+	return ResultOk
+}
+
+func formatLabels(kvs ...string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	l := make([]string, 0, len(kvs)/2)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		l = append(l, fmt.Sprintf("%s=\"%s\"", kvs[i], replacer.Replace(kvs[i+1])))
+	}
+	return strings.Join(l, ",")
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// NewMetricsObserver constructs a new MetricsObserver instance.
+func NewMetricsObserver() *MetricsObserver {
+	return new(MetricsObserver)
+}
+
+var _ Observer = (*MetricsObserver)(nil)
@@ -0,0 +1,115 @@
+// metrics_test.go - Katzenpost non-voting authority client metrics tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const expectedMetrics = `# HELP katzenpost_nonvoting_client_dials_total Connection attempts to the authority.
+# TYPE katzenpost_nonvoting_client_dials_total counter
+katzenpost_nonvoting_client_dials_total{address="192.0.2.1:29483",result="Ok"} 1
+# HELP katzenpost_nonvoting_client_dial_seconds Time taken to connect to the authority.
+# TYPE katzenpost_nonvoting_client_dial_seconds histogram
+katzenpost_nonvoting_client_dial_seconds_bucket{address="192.0.2.1:29483",result="Ok",le="0.005"} 0
+katzenpost_nonvoting_client_dial_seconds_bucket{address="192.0.2.1:29483",result="Ok",le="0.01"} 1
+katzenpost_nonvoting_client_dial_seconds_bucket{address="192.0.2.1:29483",result="Ok",le="0.025"} 1
+katzenpost_nonvoting_client_dial_seconds_bucket{address="192.0.2.1:29483",result="Ok",le="0.05"} 1
+katzenpost_nonvoting_client_dial_seconds_bucket{address="192.0.2.1:29483",result="Ok",le="0.1"} 1
+katzenpost_nonvoting_client_dial_seconds_bucket{address="192.0.2.1:29483",result="Ok",le="0.25"} 1
+katzenpost_nonvoting_client_dial_seconds_bucket{address="192.0.2.1:29483",result="Ok",le="0.5"} 1
+katzenpost_nonvoting_client_dial_seconds_bucket{address="192.0.2.1:29483",result="Ok",le="1"} 1
+katzenpost_nonvoting_client_dial_seconds_bucket{address="192.0.2.1:29483",result="Ok",le="2.5"} 1
+katzenpost_nonvoting_client_dial_seconds_bucket{address="192.0.2.1:29483",result="Ok",le="5"} 1
+katzenpost_nonvoting_client_dial_seconds_bucket{address="192.0.2.1:29483",result="Ok",le="10"} 1
+katzenpost_nonvoting_client_dial_seconds_bucket{address="192.0.2.1:29483",result="Ok",le="30"} 1
+katzenpost_nonvoting_client_dial_seconds_bucket{address="192.0.2.1:29483",result="Ok",le="60"} 1
+katzenpost_nonvoting_client_dial_seconds_bucket{address="192.0.2.1:29483",result="Ok",le="300"} 1
+katzenpost_nonvoting_client_dial_seconds_bucket{address="192.0.2.1:29483",result="Ok",le="+Inf"} 1
+katzenpost_nonvoting_client_dial_seconds_sum{address="192.0.2.1:29483",result="Ok"} 0.007
+katzenpost_nonvoting_client_dial_seconds_count{address="192.0.2.1:29483",result="Ok"} 1
+# HELP katzenpost_nonvoting_client_handshakes_total Wire protocol handshakes with the authority.
+# TYPE katzenpost_nonvoting_client_handshakes_total counter
+katzenpost_nonvoting_client_handshakes_total{address="192.0.2.1:29483",result="Error"} 1
+# HELP katzenpost_nonvoting_client_handshake_seconds Time taken to complete the wire protocol handshake.
+# TYPE katzenpost_nonvoting_client_handshake_seconds histogram
+katzenpost_nonvoting_client_handshake_seconds_bucket{address="192.0.2.1:29483",result="Error",le="0.005"} 0
+katzenpost_nonvoting_client_handshake_seconds_bucket{address="192.0.2.1:29483",result="Error",le="0.01"} 0
+katzenpost_nonvoting_client_handshake_seconds_bucket{address="192.0.2.1:29483",result="Error",le="0.025"} 0
+katzenpost_nonvoting_client_handshake_seconds_bucket{address="192.0.2.1:29483",result="Error",le="0.05"} 0
+katzenpost_nonvoting_client_handshake_seconds_bucket{address="192.0.2.1:29483",result="Error",le="0.1"} 0
+katzenpost_nonvoting_client_handshake_seconds_bucket{address="192.0.2.1:29483",result="Error",le="0.25"} 1
+katzenpost_nonvoting_client_handshake_seconds_bucket{address="192.0.2.1:29483",result="Error",le="0.5"} 1
+katzenpost_nonvoting_client_handshake_seconds_bucket{address="192.0.2.1:29483",result="Error",le="1"} 1
+katzenpost_nonvoting_client_handshake_seconds_bucket{address="192.0.2.1:29483",result="Error",le="2.5"} 1
+katzenpost_nonvoting_client_handshake_seconds_bucket{address="192.0.2.1:29483",result="Error",le="5"} 1
+katzenpost_nonvoting_client_handshake_seconds_bucket{address="192.0.2.1:29483",result="Error",le="10"} 1
+katzenpost_nonvoting_client_handshake_seconds_bucket{address="192.0.2.1:29483",result="Error",le="30"} 1
+katzenpost_nonvoting_client_handshake_seconds_bucket{address="192.0.2.1:29483",result="Error",le="60"} 1
+katzenpost_nonvoting_client_handshake_seconds_bucket{address="192.0.2.1:29483",result="Error",le="300"} 1
+katzenpost_nonvoting_client_handshake_seconds_bucket{address="192.0.2.1:29483",result="Error",le="+Inf"} 1
+katzenpost_nonvoting_client_handshake_seconds_sum{address="192.0.2.1:29483",result="Error"} 0.25
+katzenpost_nonvoting_client_handshake_seconds_count{address="192.0.2.1:29483",result="Error"} 1
+# HELP katzenpost_nonvoting_client_commands_total Commands sent to the authority, by result.
+# TYPE katzenpost_nonvoting_client_commands_total counter
+katzenpost_nonvoting_client_commands_total{address="a\"b\\c\nd",command="GetConsensus",result="Ok"} 2
+# HELP katzenpost_nonvoting_client_command_seconds Command round trip time.
+# TYPE katzenpost_nonvoting_client_command_seconds histogram
+katzenpost_nonvoting_client_command_seconds_bucket{address="a\"b\\c\nd",command="GetConsensus",le="0.005"} 0
+katzenpost_nonvoting_client_command_seconds_bucket{address="a\"b\\c\nd",command="GetConsensus",le="0.01"} 0
+katzenpost_nonvoting_client_command_seconds_bucket{address="a\"b\\c\nd",command="GetConsensus",le="0.025"} 0
+katzenpost_nonvoting_client_command_seconds_bucket{address="a\"b\\c\nd",command="GetConsensus",le="0.05"} 0
+katzenpost_nonvoting_client_command_seconds_bucket{address="a\"b\\c\nd",command="GetConsensus",le="0.1"} 0
+katzenpost_nonvoting_client_command_seconds_bucket{address="a\"b\\c\nd",command="GetConsensus",le="0.25"} 0
+katzenpost_nonvoting_client_command_seconds_bucket{address="a\"b\\c\nd",command="GetConsensus",le="0.5"} 0
+katzenpost_nonvoting_client_command_seconds_bucket{address="a\"b\\c\nd",command="GetConsensus",le="1"} 0
+katzenpost_nonvoting_client_command_seconds_bucket{address="a\"b\\c\nd",command="GetConsensus",le="2.5"} 0
+katzenpost_nonvoting_client_command_seconds_bucket{address="a\"b\\c\nd",command="GetConsensus",le="5"} 0
+katzenpost_nonvoting_client_command_seconds_bucket{address="a\"b\\c\nd",command="GetConsensus",le="10"} 0
+katzenpost_nonvoting_client_command_seconds_bucket{address="a\"b\\c\nd",command="GetConsensus",le="30"} 1
+katzenpost_nonvoting_client_command_seconds_bucket{address="a\"b\\c\nd",command="GetConsensus",le="60"} 1
+katzenpost_nonvoting_client_command_seconds_bucket{address="a\"b\\c\nd",command="GetConsensus",le="300"} 1
+katzenpost_nonvoting_client_command_seconds_bucket{address="a\"b\\c\nd",command="GetConsensus",le="+Inf"} 2
+katzenpost_nonvoting_client_command_seconds_sum{address="a\"b\\c\nd",command="GetConsensus"} 420
+katzenpost_nonvoting_client_command_seconds_count{address="a\"b\\c\nd",command="GetConsensus"} 2
+`
+
+func TestMetricsObserver(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	for _, m := range []*MetricsObserver{NewMetricsObserver(), new(MetricsObserver)} {
+		var b bytes.Buffer
+		require.NoError(m.WriteMetrics(&b), "WriteMetrics(): empty")
+		assert.Empty(b.String(), "WriteMetrics(): empty")
+
+		m.OnDial("192.0.2.1:29483", 7*time.Millisecond, nil)
+		m.OnHandshake("192.0.2.1:29483", 250*time.Millisecond, errors.New("handshake failed"))
+		m.OnRoundTrip("a\"b\\c\nd", "GetConsensus", ResultOk, 20*time.Second, nil)
+		m.OnRoundTrip("a\"b\\c\nd", "GetConsensus", ResultOk, 400*time.Second, nil)
+
+		b.Reset()
+		require.NoError(m.WriteMetrics(&b), "WriteMetrics()")
+		assert.Equal(expectedMetrics, b.String(), "WriteMetrics()")
+	}
+}
@@ -0,0 +1,73 @@
+// observer.go - Katzenpost non-voting authority client instrumentation.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"time"
+
+	"github.com/katzenpost/core/wire/commands"
+)
+
+const (
+	// ResultOk is the result reported for successful commands that do not
+	// have a more specific result code.
+	ResultOk = "Ok"
+
+	// ResultError is the result reported for commands that failed to
+	// complete due to a transport error.
+	ResultError = "Error"
+)
+
+// Observer receives instrumentation events from the Client.  The methods
+// are called synchronously, and must not block.
+type Observer interface {
+	// OnDial is called after each attempt to connect to one of the
+	// authority's addresses.
+	OnDial(addr string, elapsed time.Duration, err error)
+
+	// OnHandshake is called after each wire protocol handshake with one of
+	// the authority's addresses.
+	OnHandshake(addr string, elapsed time.Duration, err error)
+
+	// OnRoundTrip is called after each command sent to one of the
+	// authority's addresses, with the command name (eg: "get_consensus"),
+	// and the result code (eg: "NotFound" or "Conflict"), which is
+	// ResultError iff err is set.
+	OnRoundTrip(addr, command, result string, elapsed time.Duration, err error)
+}
+
+func commandName(cmd commands.Command) string {
+	switch cmd.(type) {
+	case *commands.GetConsensus:
+		return "get_consensus"
+	case *commands.PostDescriptor:
+		return "post_descriptor"
+	default:
+		return "unknown"
+	}
+}
+
+func resultCode(resp commands.Command) string {
+	switch r := resp.(type) {
+	case *commands.Consensus:
+		return getErrorToString(r.ErrorCode)
+	case *commands.PostDescriptorStatus:
+		return postErrorToString(r.ErrorCode)
+	default:
+		return ResultOk
+	}
+}
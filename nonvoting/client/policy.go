@@ -0,0 +1,156 @@
+// policy.go - Katzenpost non-voting authority client document policy.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/pki"
+)
+
+// DocumentPolicy is a client side policy that Documents must satisfy in
+// addition to being correctly signed, to guard against a misconfigured or
+// compromised authority publishing a degenerate network.  Unset (zero)
+// fields are not enforced, though Documents with non-finite parameters are
+// always rejected.
+type DocumentPolicy struct {
+	// MinProviders is the minimum number of providers.
+	MinProviders int
+
+	// MinNodesPerLayer is the minimum number of nodes in each layer.
+	MinNodesPerLayer int
+
+	// MinMixLambda and MaxMixLambda bound MixLambda.
+	MinMixLambda float64
+	MaxMixLambda float64
+
+	// MinMixMaxDelay and MaxMixMaxDelay bound MixMaxDelay.
+	MinMixMaxDelay uint64
+	MaxMixMaxDelay uint64
+
+	// MinSendShift and MaxSendShift bound SendShift.
+	MinSendShift uint64
+	MaxSendShift uint64
+
+	// RejectDuplicateAddresses is set to reject Documents where more than
+	// one node advertises the same address.
+	RejectDuplicateAddresses bool
+
+	// RequireFresh is set to reject Documents for epochs other than the
+	// previous, current and next epoch, which are the only ones that the
+	// authority serves, so that stale Documents can not be replayed.
+	RequireFresh bool
+}
+
+func (p *DocumentPolicy) validate() error {
+	if !isFinite(p.MinMixLambda) || !isFinite(p.MaxMixLambda) {
+		return fmt.Errorf("nonvoting/client: Invalid DocumentPolicy: non-finite bound")
+	}
+	if p.MinProviders < 0 || p.MinNodesPerLayer < 0 || p.MinMixLambda < 0 || p.MaxMixLambda < 0 {
+		return fmt.Errorf("nonvoting/client: Invalid DocumentPolicy: negative bound")
+	}
+	if p.MaxMixLambda != 0 && p.MinMixLambda > p.MaxMixLambda {
+		return fmt.Errorf("nonvoting/client: Invalid DocumentPolicy: MinMixLambda > MaxMixLambda")
+	}
+	if p.MaxMixMaxDelay != 0 && p.MinMixMaxDelay > p.MaxMixMaxDelay {
+		return fmt.Errorf("nonvoting/client: Invalid DocumentPolicy: MinMixMaxDelay > MaxMixMaxDelay")
+	}
+	if p.MaxSendShift != 0 && p.MinSendShift > p.MaxSendShift {
+		return fmt.Errorf("nonvoting/client: Invalid DocumentPolicy: MinSendShift > MaxSendShift")
+	}
+	return nil
+}
+
+// Check returns a descriptive error iff the Document violates the policy.
+func (p *DocumentPolicy) Check(doc *pki.Document) error {
+	now, _, _ := epochtime.Now()
+	return p.check(doc, now)
+}
+
+func (p *DocumentPolicy) check(doc *pki.Document, now uint64) error {
+	if p.RequireFresh {
+		switch doc.Epoch {
+		case now - 1, now, now + 1:
+		default:
+			return fmt.Errorf("nonvoting/client: Document for epoch %v is not fresh, current epoch is %v", doc.Epoch, now)
+		}
+	}
+
+	if len(doc.Providers) < p.MinProviders {
+		return fmt.Errorf("nonvoting/client: Document has %v providers, need %v", len(doc.Providers), p.MinProviders)
+	}
+	if p.MinNodesPerLayer > 0 && len(doc.Topology) == 0 {
+		// A Document without any layers trivially has enough nodes in
+		// each of them.
+		return fmt.Errorf("nonvoting/client: Document has no layers, need %v nodes per layer", p.MinNodesPerLayer)
+	}
+	for layer, nodes := range doc.Topology {
+		if len(nodes) < p.MinNodesPerLayer {
+			return fmt.Errorf("nonvoting/client: Document layer %v has %v nodes, need %v", layer, len(nodes), p.MinNodesPerLayer)
+		}
+	}
+
+	// Non-finite parameters compare false against every bound, so they
+	// are rejected outright.
+	if !isFinite(doc.MixLambda) || !isFinite(doc.SendLambda) {
+		return fmt.Errorf("nonvoting/client: Document has non-finite parameters")
+	}
+	if doc.MixLambda < p.MinMixLambda || (p.MaxMixLambda != 0 && doc.MixLambda > p.MaxMixLambda) {
+		return fmt.Errorf("nonvoting/client: Document MixLambda %v out of bounds", doc.MixLambda)
+	}
+	if doc.MixMaxDelay < p.MinMixMaxDelay || (p.MaxMixMaxDelay != 0 && doc.MixMaxDelay > p.MaxMixMaxDelay) {
+		return fmt.Errorf("nonvoting/client: Document MixMaxDelay %v out of bounds", doc.MixMaxDelay)
+	}
+	if doc.SendShift < p.MinSendShift || (p.MaxSendShift != 0 && doc.SendShift > p.MaxSendShift) {
+		return fmt.Errorf("nonvoting/client: Document SendShift %v out of bounds", doc.SendShift)
+	}
+
+	if p.RejectDuplicateAddresses {
+		addrs := make(map[string]*pki.MixDescriptor)
+		checkFn := func(desc *pki.MixDescriptor) error {
+			for _, v := range desc.Addresses {
+				for _, addr := range v {
+					if prev, ok := addrs[addr]; ok && prev != desc {
+						return fmt.Errorf("nonvoting/client: Document address %v is used by both %v and %v", addr, prev.Name, desc.Name)
+					}
+					addrs[addr] = desc
+				}
+			}
+			return nil
+		}
+		for _, nodes := range doc.Topology {
+			for _, desc := range nodes {
+				if err := checkFn(desc); err != nil {
+					return err
+				}
+			}
+		}
+		for _, desc := range doc.Providers {
+			if err := checkFn(desc); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
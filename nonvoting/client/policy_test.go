@@ -0,0 +1,163 @@
+// policy_test.go - Katzenpost non-voting authority client document policy tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"math"
+	"testing"
+
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPolicyDescriptor(name, addr string) *pki.MixDescriptor {
+	return &pki.MixDescriptor{
+		Name: name,
+		Addresses: map[pki.Transport][]string{
+			pki.TransportTCPv4: []string{addr},
+		},
+	}
+}
+
+// newTestPolicyDocument returns a Document for epoch 10, with 2 providers
+// and 2 layers of 2 nodes.
+func newTestPolicyDocument() *pki.Document {
+	return &pki.Document{
+		Epoch:       10,
+		MixLambda:   0.00025,
+		MixMaxDelay: 90000,
+		SendLambda:  15.0,
+		SendShift:   3,
+		Topology: [][]*pki.MixDescriptor{
+			{newTestPolicyDescriptor("mix-0", "192.0.2.1:1"), newTestPolicyDescriptor("mix-1", "192.0.2.2:1")},
+			{newTestPolicyDescriptor("mix-2", "192.0.2.3:1"), newTestPolicyDescriptor("mix-3", "192.0.2.4:1")},
+		},
+		Providers: []*pki.MixDescriptor{
+			newTestPolicyDescriptor("provider-0", "192.0.2.5:1"),
+			newTestPolicyDescriptor("provider-1", "192.0.2.6:1"),
+		},
+	}
+}
+
+func TestDocumentPolicyCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	const now = 10
+	for _, v := range []struct {
+		name     string
+		policy   DocumentPolicy
+		mutateFn func(*pki.Document)
+		ok       bool
+	}{
+		{"Empty policy", DocumentPolicy{}, nil, true},
+
+		{"MinProviders: met", DocumentPolicy{MinProviders: 2}, nil, true},
+		{"MinProviders: violated", DocumentPolicy{MinProviders: 3}, nil, false},
+
+		{"MinNodesPerLayer: met", DocumentPolicy{MinNodesPerLayer: 2}, nil, true},
+		{"MinNodesPerLayer: violated", DocumentPolicy{MinNodesPerLayer: 2}, func(d *pki.Document) {
+			d.Topology[1] = d.Topology[1][:1]
+		}, false},
+		{"MinNodesPerLayer: no layers", DocumentPolicy{MinNodesPerLayer: 1}, func(d *pki.Document) {
+			d.Topology = nil
+		}, false},
+		{"No layers, no MinNodesPerLayer", DocumentPolicy{}, func(d *pki.Document) {
+			d.Topology = nil
+		}, true},
+
+		{"MixLambda: in bounds", DocumentPolicy{MinMixLambda: 0.0001, MaxMixLambda: 0.001}, nil, true},
+		{"MixLambda: too low", DocumentPolicy{MinMixLambda: 0.001}, nil, false},
+		{"MixLambda: too high", DocumentPolicy{MaxMixLambda: 0.0001}, nil, false},
+		{"MixLambda: NaN", DocumentPolicy{MinMixLambda: 0.0001, MaxMixLambda: 0.001}, func(d *pki.Document) {
+			d.MixLambda = math.NaN()
+		}, false},
+		{"MixLambda: NaN, no bounds", DocumentPolicy{}, func(d *pki.Document) {
+			d.MixLambda = math.NaN()
+		}, false},
+		{"MixLambda: Inf", DocumentPolicy{MinMixLambda: 0.0001}, func(d *pki.Document) {
+			d.MixLambda = math.Inf(1)
+		}, false},
+		{"SendLambda: Inf", DocumentPolicy{}, func(d *pki.Document) {
+			d.SendLambda = math.Inf(-1)
+		}, false},
+
+		{"MixMaxDelay: in bounds", DocumentPolicy{MinMixMaxDelay: 90000, MaxMixMaxDelay: 90000}, nil, true},
+		{"MixMaxDelay: too low", DocumentPolicy{MinMixMaxDelay: 90001}, nil, false},
+		{"MixMaxDelay: too high", DocumentPolicy{MaxMixMaxDelay: 89999}, nil, false},
+
+		{"SendShift: in bounds", DocumentPolicy{MinSendShift: 1, MaxSendShift: 5}, nil, true},
+		{"SendShift: too low", DocumentPolicy{MinSendShift: 4}, nil, false},
+		{"SendShift: too high", DocumentPolicy{MaxSendShift: 2}, nil, false},
+
+		{"RejectDuplicateAddresses: unique", DocumentPolicy{RejectDuplicateAddresses: true}, nil, true},
+		{"RejectDuplicateAddresses: mix and provider", DocumentPolicy{RejectDuplicateAddresses: true}, func(d *pki.Document) {
+			d.Providers[1].Addresses[pki.TransportTCPv4] = []string{"192.0.2.1:1"}
+		}, false},
+		{"RejectDuplicateAddresses: same node", DocumentPolicy{RejectDuplicateAddresses: true}, func(d *pki.Document) {
+			d.Providers[0].Addresses[pki.TransportTCPv6] = d.Providers[0].Addresses[pki.TransportTCPv4]
+		}, true},
+		{"Duplicate addresses allowed", DocumentPolicy{}, func(d *pki.Document) {
+			d.Providers[1].Addresses[pki.TransportTCPv4] = []string{"192.0.2.1:1"}
+		}, true},
+
+		{"RequireFresh: current", DocumentPolicy{RequireFresh: true}, nil, true},
+		{"RequireFresh: previous", DocumentPolicy{RequireFresh: true}, func(d *pki.Document) { d.Epoch = now - 1 }, true},
+		{"RequireFresh: next", DocumentPolicy{RequireFresh: true}, func(d *pki.Document) { d.Epoch = now + 1 }, true},
+		{"RequireFresh: stale", DocumentPolicy{RequireFresh: true}, func(d *pki.Document) { d.Epoch = now - 2 }, false},
+		{"RequireFresh: future", DocumentPolicy{RequireFresh: true}, func(d *pki.Document) { d.Epoch = now + 2 }, false},
+		{"Stale allowed", DocumentPolicy{}, func(d *pki.Document) { d.Epoch = 1 }, true},
+	} {
+		doc := newTestPolicyDocument()
+		if v.mutateFn != nil {
+			v.mutateFn(doc)
+		}
+		err := v.policy.check(doc, now)
+		if v.ok {
+			assert.NoError(err, v.name)
+		} else {
+			assert.Error(err, v.name)
+		}
+	}
+}
+
+func TestDocumentPolicyValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, v := range []struct {
+		name   string
+		policy DocumentPolicy
+		ok     bool
+	}{
+		{"Empty", DocumentPolicy{}, true},
+		{"Bounds", DocumentPolicy{MinMixLambda: 0.1, MaxMixLambda: 0.2, MinMixMaxDelay: 1, MaxMixMaxDelay: 2, MinSendShift: 1, MaxSendShift: 2}, true},
+		{"Negative MinProviders", DocumentPolicy{MinProviders: -1}, false},
+		{"Negative MinNodesPerLayer", DocumentPolicy{MinNodesPerLayer: -1}, false},
+		{"Negative MinMixLambda", DocumentPolicy{MinMixLambda: -1}, false},
+		{"NaN MinMixLambda", DocumentPolicy{MinMixLambda: math.NaN()}, false},
+		{"Inf MaxMixLambda", DocumentPolicy{MaxMixLambda: math.Inf(1)}, false},
+		{"Inverted MixLambda", DocumentPolicy{MinMixLambda: 0.2, MaxMixLambda: 0.1}, false},
+		{"Inverted MixMaxDelay", DocumentPolicy{MinMixMaxDelay: 2, MaxMixMaxDelay: 1}, false},
+		{"Inverted SendShift", DocumentPolicy{MinSendShift: 2, MaxSendShift: 1}, false},
+	} {
+		err := v.policy.validate()
+		if v.ok {
+			assert.NoError(err, v.name)
+		} else {
+			assert.Error(err, v.name)
+		}
+	}
+}
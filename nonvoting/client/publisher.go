@@ -0,0 +1,340 @@
+// publisher.go - Katzenpost non-voting authority descriptor publisher.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/authority/nonvoting/internal/s11n"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/worker"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// publisherPostTimeout is the maximum time a single post may take.
+const publisherPostTimeout = 60 * time.Second
+
+// MixKeyFn returns the node's public mix key for the epoch.
+type MixKeyFn func(epoch uint64) (*ecdh.PublicKey, error)
+
+// PublisherConfig is a Publisher configuration.
+type PublisherConfig struct {
+	// LogBackend is the `core/log` Backend instance to use for logging.
+	LogBackend *log.Backend
+
+	// Client is the Client used to post descriptors.
+	Client Client
+
+	// SigningKey is the node's identity key, used to sign descriptors.
+	SigningKey *eddsa.PrivateKey
+
+	// Descriptor is the template for the node's descriptor.  The MixKeys
+	// are supplied by MixKeyFn for each epoch.
+	Descriptor *pki.MixDescriptor
+
+	// MixKeyFn is the function that supplies the node's mix keys.  If it
+	// fails, the descriptor for the epoch is not posted, and the failure
+	// is not retried.
+	MixKeyFn MixKeyFn
+
+	// RetryPolicy is the optional policy for retrying failed posts.  If
+	// unset, failed posts are retried with the default backoff till the
+	// authority will no longer accept the descriptor.
+	RetryPolicy *RetryPolicy
+}
+
+func (cfg *PublisherConfig) validate() error {
+	if cfg.LogBackend == nil {
+		return fmt.Errorf("nonvoting/client: LogBackend is mandatory")
+	}
+	if cfg.Client == nil {
+		return fmt.Errorf("nonvoting/client: Client is mandatory")
+	}
+	if cfg.SigningKey == nil {
+		return fmt.Errorf("nonvoting/client: SigningKey is mandatory")
+	}
+	if cfg.Descriptor == nil {
+		return fmt.Errorf("nonvoting/client: Descriptor is mandatory")
+	}
+	if cfg.Descriptor.IdentityKey == nil || !cfg.Descriptor.IdentityKey.Equal(cfg.SigningKey.PublicKey()) {
+		return fmt.Errorf("nonvoting/client: Descriptor IdentityKey does not match SigningKey")
+	}
+	if cfg.MixKeyFn == nil {
+		return fmt.Errorf("nonvoting/client: MixKeyFn is mandatory")
+	}
+	if cfg.RetryPolicy != nil {
+		return cfg.RetryPolicy.validate()
+	}
+	return nil
+}
+
+// PublisherStatus is the status of publishing the node's descriptor for a
+// given epoch.
+type PublisherStatus struct {
+	// Epoch is the epoch that the descriptor is for.
+	Epoch uint64
+
+	// Posted is true iff the authority accepted the descriptor.
+	Posted bool
+
+	// Final is true iff the publisher will not post the descriptor again.
+	Final bool
+
+	// Attempts is the number of times the descriptor was posted.
+	Attempts int
+
+	// LastAttempt is the time of the last attempt to post the descriptor.
+	LastAttempt time.Time
+
+	// Err is the error returned by the last attempt, if any.  If the
+	// authority holds a conflicting descriptor, this is
+	// pki.ErrInvalidPostEpoch, and the descriptor is not posted again,
+	// unless the authority is too old to distinguish conflicts from other
+	// failures.
+	Err error
+
+	nextAttempt time.Time
+}
+
+// Publisher is a background worker that posts the node's descriptor for
+// the current and next epoch to the authority, retrying as required.
+type Publisher struct {
+	worker.Worker
+
+	mu sync.Mutex
+
+	cfg *PublisherConfig
+	log *logging.Logger
+
+	status map[uint64]*PublisherStatus
+	rng    *lockedRand
+	clock  epochClock
+}
+
+// Status returns the status of publishing the descriptor, for each epoch
+// that the publisher has attempted, in ascending order of epoch.
+func (p *Publisher) Status() []*PublisherStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ret := make([]*PublisherStatus, 0, len(p.status))
+	for _, v := range p.status {
+		st := *v
+		ret = append(ret, &st)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Epoch < ret[j].Epoch })
+	return ret
+}
+
+func (p *Publisher) worker() {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	p.Go(func() {
+		<-p.HaltCh()
+		cancelFn()
+	})
+
+	policy := p.cfg.RetryPolicy
+	if policy == nil {
+		policy = &RetryPolicy{}
+	}
+
+	for {
+		now, _, till := p.clock()
+		wakeAt := time.Now().Add(till)
+		p.pruneStatus(now)
+
+		// Nodes publish the descriptor for the current epoch, in case they
+		// were just started, and for the next epoch.
+		for _, epoch := range []uint64{now, now + 1} {
+			st := p.statusForEpoch(epoch)
+			if st.Final {
+				continue
+			}
+			if time.Now().Before(st.nextAttempt) {
+				wakeAt = minTime(wakeAt, st.nextAttempt)
+				continue
+			}
+
+			err := p.post(ctx, epoch)
+			if ctx.Err() != nil {
+				return
+			}
+
+			// Authorities that predate the late and internal error status
+			// codes report those as conflicts, so a conflict is only known
+			// to be final if the authority has the status codes.
+			isConflictFinal := false
+			if err == pki.ErrInvalidPostEpoch {
+				isConflictFinal = p.hasErrorCodes(ctx)
+			}
+
+			p.mu.Lock()
+			st.Attempts++
+			st.LastAttempt = time.Now()
+			st.Err = err
+			switch err {
+			case nil:
+				p.log.Noticef("Posted descriptor for epoch %v.", epoch)
+				st.Posted, st.Final = true, true
+			case ErrLateDescriptor, ErrIncompatibleAuthority, ErrNotSupported:
+				p.log.Errorf("Authority rejected descriptor for epoch %v: %v", epoch, err)
+				st.Final = true
+			case pki.ErrInvalidPostEpoch:
+				if isConflictFinal {
+					p.log.Errorf("Authority rejected descriptor for epoch %v: %v", epoch, err)
+					st.Final = true
+					break
+				}
+				fallthrough
+			default:
+				if pe, ok := err.(*permanentError); ok {
+					p.log.Errorf("Failed to build descriptor for epoch %v: %v", epoch, pe.err)
+					st.Err, st.Final = pe.err, true
+					break
+				}
+				if policy.MaxAttempts > 0 && st.Attempts >= policy.MaxAttempts {
+					p.log.Errorf("Failed to post descriptor for epoch %v, giving up: %v", epoch, err)
+					st.Final = true
+					break
+				}
+				delay := policy.backoff(st.Attempts, p.rng)
+				st.nextAttempt = st.LastAttempt.Add(delay)
+				p.log.Warningf("Failed to post descriptor for epoch %v, retrying in %v: %v", epoch, delay, err)
+				wakeAt = minTime(wakeAt, st.nextAttempt)
+			}
+			p.mu.Unlock()
+		}
+
+		// Wait till the next retry, or the start of the next epoch.
+		t := time.NewTimer(time.Until(wakeAt))
+		select {
+		case <-p.HaltCh():
+			t.Stop()
+			p.log.Debugf("Terminating gracefully.")
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (p *Publisher) post(ctx context.Context, epoch uint64) error {
+	// Fill in the mix keys for the epochs that the descriptor must cover.
+	d := new(pki.MixDescriptor)
+	*d = *p.cfg.Descriptor
+	d.MixKeys = make(map[uint64]*ecdh.PublicKey)
+	for e := epoch; e < epoch+3; e++ {
+		k, err := p.cfg.MixKeyFn(e)
+		if err != nil {
+			// The node failing to supply its keys is not something that
+			// retrying the post will resolve.
+			return &permanentError{fmt.Errorf("nonvoting/client: failed to get mix key for epoch %v: %v", e, err)}
+		}
+		d.MixKeys[e] = k
+	}
+	if err := s11n.IsDescriptorWellFormed(d, epoch); err != nil {
+		return &permanentError{err}
+	}
+
+	ctx, cancelFn := context.WithTimeout(ctx, publisherPostTimeout)
+	defer cancelFn()
+	return p.cfg.Client.Post(ctx, epoch, p.cfg.SigningKey, d)
+}
+
+func (p *Publisher) hasErrorCodes(ctx context.Context) bool {
+	ctx, cancelFn := context.WithTimeout(ctx, publisherPostTimeout)
+	defer cancelFn()
+
+	caps, err := p.cfg.Client.GetCapabilities(ctx)
+	if err != nil {
+		p.log.Warningf("Failed to query authority capabilities: %v", err)
+		return false
+	}
+	return caps.HasFeature(FeatureDescriptorErrorCodes)
+}
+
+func (p *Publisher) statusForEpoch(epoch uint64) *PublisherStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st, ok := p.status[epoch]
+	if !ok {
+		st = &PublisherStatus{Epoch: epoch}
+		p.status[epoch] = st
+	}
+	return st
+}
+
+func (p *Publisher) pruneStatus(now uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for epoch := range p.status {
+		if epoch < now {
+			delete(p.status, epoch)
+		}
+	}
+}
+
+// permanentError is an error that retrying the post will not resolve.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// NewPublisher constructs and starts a new Publisher instance.  The
+// Publisher must be stopped with Halt.
+func NewPublisher(cfg *PublisherConfig) (*Publisher, error) {
+	return newPublisher(cfg, epochtime.Now)
+}
+
+func newPublisher(cfg *PublisherConfig, clock epochClock) (*Publisher, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("nonvoting/client: cfg is mandatory")
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	p := new(Publisher)
+	p.cfg = cfg
+	p.log = cfg.LogBackend.GetLogger("pki/nonvoting/publisher")
+	p.status = make(map[uint64]*PublisherStatus)
+	p.rng = newLockedRand()
+	p.clock = clock
+	p.Go(p.worker)
+
+	return p, nil
+}
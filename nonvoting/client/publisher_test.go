@@ -0,0 +1,273 @@
+// publisher_test.go - Katzenpost non-voting authority publisher tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/authority/nonvoting/client"
+	"github.com/katzenpost/authority/nonvoting/client/clienttest"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClock is an epoch clock that only advances when told to.  Epochs are
+// reported as ending shortly, so that the workers re-examine the epoch
+// often.
+type testClock struct {
+	sync.Mutex
+
+	epoch uint64
+}
+
+func (c *testClock) Now() (uint64, time.Duration, time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.epoch, 0, 10 * time.Millisecond
+}
+
+func (c *testClock) Set(epoch uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.epoch = epoch
+}
+
+type testNode struct {
+	signingKey *eddsa.PrivateKey
+	desc       *pki.MixDescriptor
+}
+
+func (n *testNode) mixKey(epoch uint64) (*ecdh.PublicKey, error) {
+	k, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return k.PublicKey(), nil
+}
+
+// descriptor returns the node's descriptor for the epoch.
+func (n *testNode) descriptor(t *testing.T, epoch uint64) *pki.MixDescriptor {
+	d := new(pki.MixDescriptor)
+	*d = *n.desc
+	d.MixKeys = make(map[uint64]*ecdh.PublicKey)
+	for e := epoch; e < epoch+3; e++ {
+		k, err := n.mixKey(e)
+		require.NoError(t, err, "mixKey()")
+		d.MixKeys[e] = k
+	}
+	return d
+}
+
+func newTestNode(t *testing.T, layer uint8) *testNode {
+	require := require.New(t)
+
+	signingKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "ecdh.NewKeypair()")
+
+	return &testNode{
+		signingKey: signingKey,
+		desc: &pki.MixDescriptor{
+			Name:        signingKey.PublicKey().String()[:8],
+			IdentityKey: signingKey.PublicKey(),
+			LinkKey:     linkKey.PublicKey(),
+			Addresses: map[pki.Transport][]string{
+				pki.TransportTCPv4: []string{"192.0.2.1:4242"},
+			},
+			Layer: layer,
+		},
+	}
+}
+
+func newTestLogBackend(t *testing.T) *log.Backend {
+	logBackend, err := log.New("", "DEBUG", true)
+	require.NoError(t, err, "log.New()")
+	return logBackend
+}
+
+func newTestPublisher(t *testing.T, c client.Client, n *testNode, clock *testClock, maxAttempts int) *client.Publisher {
+	p, err := client.NewPublisherWithClock(&client.PublisherConfig{
+		LogBackend: newTestLogBackend(t),
+		Client:     c,
+		SigningKey: n.signingKey,
+		Descriptor: n.desc,
+		MixKeyFn:   n.mixKey,
+		RetryPolicy: &client.RetryPolicy{
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     2 * time.Millisecond,
+			MaxAttempts:    maxAttempts,
+		},
+	}, clock.Now)
+	require.NoError(t, err, "NewPublisher()")
+	return p
+}
+
+// waitFor polls till cond is true, and fails the test if it takes too long.
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	require.FailNow(t, "Timed out waiting: "+msg)
+}
+
+// publisherStatus returns the Publisher's status for the epoch.
+func publisherStatus(p *client.Publisher, epoch uint64) *client.PublisherStatus {
+	for _, v := range p.Status() {
+		if v.Epoch == epoch {
+			return v
+		}
+	}
+	return nil
+}
+
+func isFinal(p *client.Publisher, epoch uint64) func() bool {
+	return func() bool {
+		st := publisherStatus(p, epoch)
+		return st != nil && st.Final
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	a, err := clienttest.New(nil)
+	require.NoError(err, "clienttest.New()")
+	a.SetEpoch(10)
+	clock := &testClock{epoch: 10}
+	n := newTestNode(t, 0)
+
+	// The current and next epoch's descriptors are posted immediately.
+	p := newTestPublisher(t, a, n, clock, 0)
+	defer p.Halt()
+	waitFor(t, "epoch 10", isFinal(p, 10))
+	waitFor(t, "epoch 11", isFinal(p, 11))
+	for _, epoch := range []uint64{10, 11} {
+		st := publisherStatus(p, epoch)
+		assert.True(st.Posted, "Posted: %v", epoch)
+		assert.Equal(1, st.Attempts, "Attempts: %v", epoch)
+		assert.NoError(st.Err, "Err: %v", epoch)
+		require.Len(a.Descriptors(epoch), 1, "Descriptors: %v", epoch)
+		assert.True(a.Descriptors(epoch)[0].IdentityKey.Equal(n.signingKey.PublicKey()), "Descriptor: %v", epoch)
+	}
+
+	// Transient failures are retried, till the post succeeds.
+	errTransient := errors.New("transient failure")
+	a.SetPostResponse(n.signingKey.PublicKey(), errTransient)
+	clock.Set(11)
+	a.SetEpoch(11)
+	waitFor(t, "epoch 12 retries", func() bool {
+		st := publisherStatus(p, 12)
+		return st != nil && st.Attempts >= 3
+	})
+	st := publisherStatus(p, 12)
+	assert.False(st.Final, "Transient: Final")
+	assert.Equal(errTransient, st.Err, "Transient: Err")
+
+	a.SetPostResponse(n.signingKey.PublicKey(), nil)
+	waitFor(t, "epoch 12", isFinal(p, 12))
+	assert.True(publisherStatus(p, 12).Posted, "Posted: 12")
+	assert.Len(a.Descriptors(12), 1, "Descriptors: 12")
+
+	// Past epochs are pruned from the status.
+	var epochs []uint64
+	for _, v := range p.Status() {
+		epochs = append(epochs, v.Epoch)
+	}
+	assert.Equal([]uint64{11, 12}, epochs, "Status() epochs")
+}
+
+func TestPublisherRejected(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	for _, v := range []struct {
+		name     string
+		legacy   bool
+		err      error
+		attempts int
+	}{
+		{"Conflict", false, pki.ErrInvalidPostEpoch, 1},
+		{"Late", false, client.ErrLateDescriptor, 1},
+		{"Forbidden", false, client.ErrForbidden, 3},
+
+		// Legacy authorities also report late uploads and internal
+		// errors as conflicts, so they are retried.
+		{"Legacy conflict", true, pki.ErrInvalidPostEpoch, 3},
+	} {
+		a, err := clienttest.New(nil)
+		require.NoError(err, "clienttest.New()")
+		a.SetEpoch(10)
+		n := newTestNode(t, 0)
+		a.SetPostResponse(n.signingKey.PublicKey(), v.err)
+		a.SetLegacy(v.legacy)
+
+		p := newTestPublisher(t, a, n, &testClock{epoch: 10}, 3)
+		waitFor(t, v.name, isFinal(p, 10))
+		p.Halt()
+
+		st := publisherStatus(p, 10)
+		assert.False(st.Posted, "%v: Posted", v.name)
+		assert.Equal(v.err, st.Err, "%v: Err", v.name)
+		assert.Equal(v.attempts, st.Attempts, "%v: Attempts", v.name)
+	}
+}
+
+func TestPublisherMixKeyFailure(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	a, err := clienttest.New(nil)
+	require.NoError(err, "clienttest.New()")
+	a.SetEpoch(10)
+	n := newTestNode(t, 0)
+
+	// Failing to supply the mix keys is permanent, and nothing is posted.
+	errNoKey := errors.New("no mix key")
+	p, err := client.NewPublisherWithClock(&client.PublisherConfig{
+		LogBackend: newTestLogBackend(t),
+		Client:     a,
+		SigningKey: n.signingKey,
+		Descriptor: n.desc,
+		MixKeyFn: func(epoch uint64) (*ecdh.PublicKey, error) {
+			return nil, errNoKey
+		},
+	}, (&testClock{epoch: 10}).Now)
+	require.NoError(err, "NewPublisher()")
+	waitFor(t, "epoch 10", isFinal(p, 10))
+	p.Halt()
+
+	st := publisherStatus(p, 10)
+	assert.False(st.Posted, "Posted")
+	assert.Equal(1, st.Attempts, "Attempts")
+	require.Error(st.Err, "Err")
+	assert.Contains(st.Err.Error(), errNoKey.Error(), "Err")
+	assert.Empty(a.Descriptors(10), "Descriptors")
+}
@@ -0,0 +1,102 @@
+// retry.go - Katzenpost non-voting authority client retry policy.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	cryptorand "github.com/katzenpost/core/crypto/rand"
+)
+
+const (
+	defaultRetryInitialBackoff = 5 * time.Second
+	defaultRetryMaxBackoff     = 2 * time.Minute
+)
+
+// RetryPolicy is the policy for retrying requests that fail with transient
+// errors, such as Get returning ErrNotYet, or none of the authority's
+// addresses being reachable.  Retries are always bounded by the caller's
+// context.
+type RetryPolicy struct {
+	// InitialBackoff is the base delay before the first retry, doubled
+	// on each subsequent retry.  If unset, a default of 5 seconds is used.
+	InitialBackoff time.Duration
+
+	// MaxBackoff is the maximum base delay between retries.  If unset, a
+	// default of 2 minutes is used.
+	MaxBackoff time.Duration
+
+	// MaxAttempts is the maximum number of attempts, including the
+	// initial one.  If unset, attempts are only bounded by the context.
+	MaxAttempts int
+}
+
+func (p *RetryPolicy) validate() error {
+	if p.InitialBackoff < 0 || p.MaxBackoff < 0 || p.MaxAttempts < 0 {
+		return fmt.Errorf("nonvoting/client: Invalid RetryPolicy: %+v", *p)
+	}
+	return nil
+}
+
+// backoff returns the jittered delay to wait after the attempt'th attempt
+// fails.
+func (p *RetryPolicy) backoff(attempt int, rng *lockedRand) time.Duration {
+	initial, max := p.InitialBackoff, p.MaxBackoff
+	if initial == 0 {
+		initial = defaultRetryInitialBackoff
+	}
+	if max == 0 {
+		max = defaultRetryMaxBackoff
+	}
+
+	d := initial
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	// Jitter the delay to between half and all of the base delay, so that
+	// clients started at the same time do not retry in lockstep.
+	return d/2 + time.Duration(rng.Int63n(int64(d/2)+1))
+}
+
+// lockedRand is a seeded math/rand source that is safe for concurrent use.
+type lockedRand struct {
+	sync.Mutex
+	rng *rand.Rand
+}
+
+func (r *lockedRand) Int63n(n int64) int64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.rng.Int63n(n)
+}
+
+func (r *lockedRand) Shuffle(n int, swap func(i, j int)) {
+	r.Lock()
+	defer r.Unlock()
+	r.rng.Shuffle(n, swap)
+}
+
+func newLockedRand() *lockedRand {
+	return &lockedRand{rng: cryptorand.NewMath()}
+}
@@ -0,0 +1,105 @@
+// retry_test.go - Katzenpost non-voting authority client retry policy tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	rng := newLockedRand()
+	for _, v := range []struct {
+		policy   *RetryPolicy
+		attempts []time.Duration
+	}{
+		{
+			&RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 8 * time.Second},
+			[]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second, 8 * time.Second},
+		},
+		{
+			&RetryPolicy{},
+			[]time.Duration{defaultRetryInitialBackoff, 2 * defaultRetryInitialBackoff, 4 * defaultRetryInitialBackoff},
+		},
+		{
+			&RetryPolicy{InitialBackoff: time.Hour},
+			[]time.Duration{defaultRetryMaxBackoff, defaultRetryMaxBackoff},
+		},
+	} {
+		for i, base := range v.attempts {
+			attempt := i + 1
+			for j := 0; j < 100; j++ {
+				d := v.policy.backoff(attempt, rng)
+				assert.True(d >= base/2 && d <= base, "%+v: attempt %d: %v not in [%v, %v]", *v.policy, attempt, d, base/2, base)
+			}
+		}
+	}
+
+	// Absurd attempt counts must not overflow.
+	d := (&RetryPolicy{}).backoff(1<<30, rng)
+	assert.True(d >= defaultRetryMaxBackoff/2 && d <= defaultRetryMaxBackoff, "Huge attempt: %v", d)
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", true)
+	require.NoError(err, "log.New()")
+	k, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+
+	// Every dial fails, so each attempt is a single (failed) dial.
+	var nrDials int32
+	errDial := errors.New("dial failed")
+	c, err := New(&Config{
+		LogBackend: logBackend,
+		Address:    "192.0.2.1:2323",
+		PublicKey:  k.PublicKey(),
+		RetryPolicy: &RetryPolicy{
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+			MaxAttempts:    3,
+		},
+		DialContextFn: func(ctx context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt32(&nrDials, 1)
+			return nil, errDial
+		},
+	})
+	require.NoError(err, "New()")
+
+	_, _, err = c.Get(context.Background(), 42)
+	require.Error(err, "Get()")
+	require.Equal(int32(3), atomic.LoadInt32(&nrDials), "Get(): attempts")
+
+	// Watch does its own retries, so a single fetch is never retried.
+	atomic.StoreInt32(&nrDials, 0)
+	_, _, err = c.(*client).get(context.Background(), 42, false)
+	require.Error(err, "get(): no retry")
+	require.Equal(int32(1), atomic.LoadInt32(&nrDials), "get(): attempts")
+}
@@ -0,0 +1,634 @@
+// session.go - Katzenpost non-voting authority client sessions.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/authority/nonvoting/internal/s11n"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	cryptorand "github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/wire"
+	"github.com/katzenpost/core/wire/commands"
+)
+
+const (
+	defaultEndpointBackoff = 30 * time.Second
+	maxEndpointBackoff     = 10 * time.Minute
+
+	// legacyReprobeInterval is how often authorities that predate
+	// capability advertisement are re-probed, in case they have been
+	// upgraded.
+	legacyReprobeInterval = 1 * time.Hour
+
+	// sessionIdleTimeout is how long idle sessions are kept for reuse,
+	// which is shorter than the time the authority keeps them open for.
+	sessionIdleTimeout = 30 * time.Second
+)
+
+// endpoint is one of the authority's addresses, along with the client's
+// view of its health and capabilities.
+type endpoint struct {
+	sync.Mutex
+
+	addr string
+
+	failures  int
+	downUntil time.Time
+
+	negotiated  bool
+	legacyUntil time.Time
+
+	// reusable is set iff the last session established with the endpoint
+	// may be reused, in which case requests are serialized per key, so
+	// that concurrent callers share a single session.
+	reusable bool
+	inUse    map[[eddsa.PublicKeySize]byte]chan interface{}
+
+	idle     map[[eddsa.PublicKeySize]byte]*session
+	isClosed bool
+}
+
+// acquire waits till the caller may use the session for the key, and
+// returns the function that releases it.  Callers only wait if sessions
+// are reusable, as otherwise each request is made over its own session.
+func (ep *endpoint) acquire(ctx context.Context, keyID [eddsa.PublicKeySize]byte) (func(), error) {
+	ep.Lock()
+	if !ep.reusable {
+		ep.Unlock()
+		return func() {}, nil
+	}
+	if ep.inUse == nil {
+		ep.inUse = make(map[[eddsa.PublicKeySize]byte]chan interface{})
+	}
+	ch, ok := ep.inUse[keyID]
+	if !ok {
+		ch = make(chan interface{}, 1)
+		ep.inUse[keyID] = ch
+	}
+	ep.Unlock()
+
+	select {
+	case ch <- true:
+		return func() { <-ch }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// takeIdle removes and returns the idle session authenticated with the
+// key, if any.
+func (ep *endpoint) takeIdle(keyID [eddsa.PublicKeySize]byte) *session {
+	ep.Lock()
+	defer ep.Unlock()
+
+	s, ok := ep.idle[keyID]
+	if !ok {
+		return nil
+	}
+	delete(ep.idle, keyID)
+	if !s.idleTimer.Stop() {
+		// The session expired, and is being closed.
+		return nil
+	}
+	return s
+}
+
+// putIdle makes the session available for reuse, till it expires.  Only
+// one idle session is kept per key, as sessions are only ever used by a
+// single caller at a time.
+func (ep *endpoint) putIdle(s *session) {
+	ep.Lock()
+	defer ep.Unlock()
+
+	if _, ok := ep.idle[s.keyID]; ok || ep.isClosed {
+		s.Close()
+		return
+	}
+	if ep.idle == nil {
+		ep.idle = make(map[[eddsa.PublicKeySize]byte]*session)
+	}
+	ep.idle[s.keyID] = s
+	s.idleTimer = time.AfterFunc(sessionIdleTimeout, func() {
+		ep.Lock()
+		if ep.idle[s.keyID] == s {
+			delete(ep.idle, s.keyID)
+		}
+		ep.Unlock()
+		s.Close()
+	})
+}
+
+// closeIdle closes the idle sessions, and ensures that sessions currently in
+// use are closed rather than kept for reuse.
+func (ep *endpoint) closeIdle() {
+	ep.Lock()
+	defer ep.Unlock()
+
+	ep.isClosed = true
+	for keyID, s := range ep.idle {
+		delete(ep.idle, keyID)
+		if s.idleTimer.Stop() {
+			// Otherwise the session expired, and is being closed.
+			s.Close()
+		}
+	}
+}
+
+func (ep *endpoint) isDown(now time.Time) bool {
+	ep.Lock()
+	defer ep.Unlock()
+
+	return now.Before(ep.downUntil)
+}
+
+func (ep *endpoint) onSuccess() {
+	ep.Lock()
+	defer ep.Unlock()
+
+	ep.failures = 0
+	ep.downUntil = time.Time{}
+}
+
+func (ep *endpoint) onFailure(backoff time.Duration) time.Duration {
+	ep.Lock()
+	defer ep.Unlock()
+
+	if backoff == 0 {
+		backoff = defaultEndpointBackoff
+	}
+
+	// Exponentially back off on consecutive failures.
+	ep.failures++
+	for i := 1; i < ep.failures && backoff < maxEndpointBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxEndpointBackoff {
+		backoff = maxEndpointBackoff
+	}
+	ep.downUntil = time.Now().Add(backoff)
+	return backoff
+}
+
+// wireSession is the subset of the wire.Session interface that sessions
+// use.
+type wireSession interface {
+	Initialize(conn net.Conn) error
+	SendCommand(cmd commands.Command) error
+	RecvCommand() (commands.Command, error)
+	Close()
+}
+
+func newWireSession(cfg *wire.SessionConfig) (wireSession, error) {
+	w, err := wire.NewSession(cfg, true)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// session is an established wire protocol session with an endpoint.
+type session struct {
+	ep      *endpoint
+	keyID   [eddsa.PublicKeySize]byte
+	conn    net.Conn
+	wire    wireSession
+	caps    *s11n.Capabilities
+	linkKey *ecdh.PrivateKey
+	obs     Observer
+
+	idleTimer *time.Timer
+}
+
+// bind arranges for the connection to be closed if the context is done
+// before the returned function is called.  The returned function returns
+// false iff the connection was closed.
+func (s *session) bind(ctx context.Context) func() bool {
+	doneCh := make(chan interface{})
+	closedCh := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.conn.Close()
+			closedCh <- true
+		case <-doneCh:
+			closedCh <- false
+		}
+	}()
+	return func() bool {
+		close(doneCh)
+		return !<-closedCh
+	}
+}
+
+// isReusable returns true iff further commands may be issued over the
+// session.
+func (s *session) isReusable() bool {
+	return s.caps.HasFeature(s11n.FeatureSessionReuse)
+}
+
+// roundTrip sends the command and returns the response.  All errors are
+// transport errors.
+func (s *session) roundTrip(cmd commands.Command) (commands.Command, error) {
+	return s.namedRoundTrip(commandName(cmd), cmd)
+}
+
+// extRoundTrip sends the wire protocol extension request and returns the
+// response.  Authorities that predate the extensions treat the request as
+// a descriptor upload, which is reported as errLegacyAuthority.
+func (s *session) extRoundTrip(req *s11n.ExtensionRequest) (*s11n.ExtensionResponse, error) {
+	b, err := s11n.SerializeExtensionRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &commands.PostDescriptor{
+		Epoch:   s11n.ExtensionEpoch,
+		Payload: b,
+	}
+	resp, err := s.namedRoundTrip(req.Command, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r := resp.(type) {
+	case *commands.Consensus:
+		if r.ErrorCode != commands.ConsensusOk {
+			break
+		}
+		ext, err := s11n.ParseExtensionResponse(r.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if ext.Command != req.Command {
+			return nil, fmt.Errorf("nonvoting/client: unexpected %v reply: '%v'", req.Command, ext.Command)
+		}
+		return ext, nil
+	case *commands.PostDescriptorStatus:
+		return nil, errLegacyAuthority
+	}
+	return nil, fmt.Errorf("nonvoting/client: unexpected %v reply: %T", req.Command, resp)
+}
+
+func (s *session) namedRoundTrip(name string, cmd commands.Command) (resp commands.Command, err error) {
+	if s.obs != nil {
+		start := time.Now()
+		defer func() {
+			result := ResultError
+			if err == nil {
+				result = resultCode(resp)
+			}
+			s.obs.OnRoundTrip(s.ep.addr, name, result, time.Since(start), err)
+		}()
+	}
+
+	if err = s.wire.SendCommand(cmd); err != nil {
+		return nil, &transportError{err}
+	}
+	if resp, err = s.wire.RecvCommand(); err != nil {
+		return nil, &transportError{err}
+	}
+	return resp, nil
+}
+
+func (s *session) Close() {
+	s.wire.Close()
+	s.conn.Close()
+	s.linkKey.Reset()
+}
+
+// transportError is an error caused by the connection to an endpoint, as
+// opposed to the endpoint's response.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string {
+	return e.err.Error()
+}
+
+// sessionRequest is a request to be made over a session with one of the
+// authority's endpoints.
+type sessionRequest struct {
+	// signingKey is the node's signing key, or nil for anonymous sessions.
+	signingKey *eddsa.PrivateKey
+
+	// holdTime is the additional time the authority may take to respond.
+	holdTime time.Duration
+
+	// isFinal returns true iff the (non-transport) error returned by fn is
+	// the authority's definitive answer, and the request should not be
+	// made to another endpoint.
+	isFinal func(error) bool
+
+	// isRetriable returns true iff the (non-transport) error returned by fn
+	// is transient, and the request should be retried as per the
+	// RetryPolicy.  Requests without isRetriable are never retried, and
+	// transport errors are always considered transient.
+	isRetriable func(error) bool
+
+	// fn makes the request over the session.
+	fn func(context.Context, *session) error
+}
+
+// withSession makes the request to each of the authority's endpoints in
+// turn, until one succeeds, or responds with a final error, retrying as per
+// the RetryPolicy if appropriate.
+func (c *client) withSession(ctx context.Context, req *sessionRequest) error {
+	policy := c.cfg.RetryPolicy
+	for attempt := 1; ; attempt++ {
+		err := c.tryEndpoints(ctx, req)
+		te, isTransport := err.(*transportError)
+		if isTransport {
+			err = te.err
+		}
+
+		switch {
+		case err == nil, policy == nil, req.isRetriable == nil:
+			return err
+		case !isTransport && !req.isRetriable(err):
+			return err
+		case policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts:
+			return err
+		}
+
+		delay := policy.backoff(attempt, c.rng)
+		c.log.Debugf("nonvoting/Client: Retrying in %v: %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// tryEndpoints makes the request to each of the authority's endpoints in
+// turn, and returns a transportError iff no endpoint responded.
+func (c *client) tryEndpoints(ctx context.Context, req *sessionRequest) error {
+	var authErr, lastErr error
+	for _, ep := range c.orderedEndpoints() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := c.attempt(ctx, ep, req)
+		if err == nil {
+			ep.onSuccess()
+			return nil
+		}
+
+		if te, ok := err.(*transportError); ok {
+			if ctx.Err() == nil {
+				backoff := ep.onFailure(c.cfg.EndpointBackoff)
+				c.log.Warningf("nonvoting/Client: Authority %v failed, skipping for %v: %v", ep.addr, backoff, te.err)
+			}
+			lastErr = te
+			continue
+		}
+
+		// The endpoint responded, so it is alive, even if the response
+		// was an error.
+		ep.onSuccess()
+		if req.isFinal != nil && req.isFinal(err) {
+			return err
+		}
+		c.log.Debugf("nonvoting/Client: Authority %v: %v", ep.addr, err)
+		if authErr == nil {
+			authErr = err
+		}
+		lastErr = err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if authErr != nil {
+		// Prefer reporting what an authority said over transport errors.
+		return authErr
+	}
+	return lastErr
+}
+
+func (c *client) attempt(ctx context.Context, ep *endpoint, req *sessionRequest) error {
+	// Sessions are pooled per key, with the all zero key being used for
+	// anonymous sessions.
+	var keyID [eddsa.PublicKeySize]byte
+	var signingKey *eddsa.PublicKey
+	if req.signingKey != nil {
+		signingKey = req.signingKey.PublicKey()
+		keyID = signingKey.ByteArray()
+	}
+
+	// Wait for the caller using the pooled session to finish with it,
+	// instead of establishing another session.  The wait is bounded by the
+	// attempts of the callers ahead, so it does not count towards this
+	// attempt.  Requests that the authority may hold would monopolize the
+	// session, so they use their own.
+	if req.holdTime == 0 {
+		release, err := ep.acquire(ctx, keyID)
+		if err != nil {
+			// The context is done, which is not the endpoint's fault.
+			return &transportError{err}
+		}
+		defer release()
+	}
+
+	ctx, cancelFn := context.WithTimeout(ctx, c.attemptTimeout+req.holdTime)
+	defer cancelFn()
+
+	// Reuse an idle session if possible.
+	if s := ep.takeIdle(keyID); s != nil {
+		err := c.useSession(ctx, s, req)
+		if _, ok := err.(*transportError); !ok || ctx.Err() != nil {
+			return err
+		}
+
+		// The authority may have closed the session, so transparently
+		// retry over a new one.
+		c.log.Debugf("nonvoting/Client: Authority %v: Reused session failed, reconnecting: %v", ep.addr, err)
+	}
+
+	// Derive the link key from the signing key, or generate a random
+	// ecdh keypair to use for the link authentication.
+	var linkKey *ecdh.PrivateKey
+	if req.signingKey != nil {
+		linkKey = req.signingKey.ToECDH()
+	} else {
+		var err error
+		if linkKey, err = ecdh.NewKeypair(cryptorand.Reader); err != nil {
+			return err
+		}
+	}
+
+	s, err := c.initSession(ctx, ep, keyID, signingKey, linkKey)
+	if err != nil {
+		linkKey.Reset()
+		return err
+	}
+	return c.useSession(ctx, s, req)
+}
+
+// useSession makes the request over the session, and either closes the
+// session or makes it available for reuse.
+func (c *client) useSession(ctx context.Context, s *session, req *sessionRequest) error {
+	unbind := s.bind(ctx)
+	err := req.fn(ctx, s)
+	isOpen := unbind()
+
+	// Sessions are not reused after transport errors, as it is unknown what
+	// state they are in.
+	if _, ok := err.(*transportError); !ok && isOpen && s.isReusable() {
+		s.ep.putIdle(s)
+	} else {
+		s.Close()
+	}
+	return err
+}
+
+// orderedEndpoints returns the endpoints in the order that they should be
+// tried, with the ones that recently failed last.
+func (c *client) orderedEndpoints() []*endpoint {
+	eps := make([]*endpoint, len(c.endpoints))
+	copy(eps, c.endpoints)
+	if c.cfg.RandomizeAddresses {
+		c.rng.Shuffle(len(eps), func(i, j int) { eps[i], eps[j] = eps[j], eps[i] })
+	}
+
+	// Endpoints that are down are tried as a last resort, soonest to
+	// recover first.
+	now := time.Now()
+	sort.SliceStable(eps, func(i, j int) bool {
+		iDown, jDown := eps[i].isDown(now), eps[j].isDown(now)
+		switch {
+		case iDown && jDown:
+			eps[i].Lock()
+			iUntil := eps[i].downUntil
+			eps[i].Unlock()
+			eps[j].Lock()
+			defer eps[j].Unlock()
+			return iUntil.Before(eps[j].downUntil)
+		default:
+			return !iDown && jDown
+		}
+	})
+	return eps
+}
+
+func (c *client) initSession(ctx context.Context, ep *endpoint, keyID [eddsa.PublicKeySize]byte, signingKey *eddsa.PublicKey, linkKey *ecdh.PrivateKey) (*session, error) {
+	s, err := c.dialSession(ctx, ep, signingKey, linkKey)
+	if err != nil {
+		return nil, err
+	}
+
+	unbind := s.bind(ctx)
+	caps, err := c.negotiate(ctx, s)
+	unbind()
+	if err == errLegacyAuthority {
+		// The authority dropped the connection in response to the
+		// capabilities, so retry without advertising them.
+		s.wire.Close()
+		s.conn.Close()
+		if s, err = c.dialSession(ctx, ep, signingKey, linkKey); err != nil {
+			return nil, err
+		}
+		caps = s11n.LegacyCapabilities()
+	} else if err != nil {
+		s.wire.Close()
+		s.conn.Close()
+		return nil, err
+	}
+	s.keyID = keyID
+	s.caps = caps
+
+	ep.Lock()
+	ep.reusable = s.isReusable()
+	ep.Unlock()
+
+	return s, nil
+}
+
+func (c *client) dialSession(ctx context.Context, ep *endpoint, signingKey *eddsa.PublicKey, linkKey *ecdh.PrivateKey) (*session, error) {
+	// Connect to the peer.
+	dialFn := c.cfg.DialContextFn
+	if dialFn == nil {
+		dialFn = defaultDialer.DialContext
+	}
+	start := time.Now()
+	conn, err := dialFn(ctx, "tcp", ep.addr)
+	if c.cfg.Observer != nil {
+		c.cfg.Observer.OnDial(ep.addr, time.Since(start), err)
+	}
+	if err != nil {
+		return nil, &transportError{err}
+	}
+
+	var isOk bool
+	defer func() {
+		if !isOk {
+			conn.Close()
+		}
+	}()
+
+	var ad []byte
+	if signingKey != nil {
+		ad = signingKey.Bytes()
+	}
+
+	// Initialize the wire protocol session.
+	cfg := &wire.SessionConfig{
+		Authenticator:     c,
+		AdditionalData:    ad,
+		AuthenticationKey: linkKey,
+		RandomReader:      cryptorand.Reader,
+	}
+	newWireFn := c.newWireFn
+	if newWireFn == nil {
+		newWireFn = newWireSession
+	}
+	w, err := newWireFn(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		ep:      ep,
+		conn:    conn,
+		wire:    w,
+		linkKey: linkKey,
+		obs:     c.cfg.Observer,
+	}
+
+	// Handshake.
+	start = time.Now()
+	unbind := s.bind(ctx)
+	err = w.Initialize(conn)
+	unbind()
+	if c.cfg.Observer != nil {
+		c.cfg.Observer.OnHandshake(ep.addr, time.Since(start), err)
+	}
+	if err != nil {
+		w.Close()
+		return nil, &transportError{err}
+	}
+
+	isOk = true
+	return s, nil
+}
@@ -0,0 +1,164 @@
+// watch.go - Katzenpost non-voting authority client document watch.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/katzenpost/core/pki"
+)
+
+const (
+	// watchPublishDeadline is the time prior to the end of an epoch by
+	// which the authority generates the Document for the next epoch.
+	watchPublishDeadline = 3600 * time.Second
+
+	watchChannelSize = 2
+)
+
+// ErrMissedEpoch is the error reported by Watch when the epoch ended before
+// the Document for the epoch could be fetched.
+var ErrMissedEpoch = errors.New("nonvoting/client: Watch() missed the Document for the epoch")
+
+// WatchEvent is the result of fetching the Document for a single epoch, as
+// delivered by Watch.
+type WatchEvent struct {
+	// Epoch is the epoch.
+	Epoch uint64
+
+	// Doc is the validated Document iff Err is nil.
+	Doc *pki.Document
+
+	// Raw is the serialized Document iff Err is nil.
+	Raw []byte
+
+	// Err is the error iff there is no Document for the epoch, either
+	// pki.ErrNoDocument if the authority did not generate one, or
+	// ErrMissedEpoch if it could not be fetched in time.
+	Err error
+}
+
+func (c *client) Watch(ctx context.Context) <-chan *WatchEvent {
+	c.log.Debugf("Watch(ctx)")
+
+	ch := make(chan *WatchEvent, watchChannelSize)
+	go c.watchWorker(ctx, ch, func(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
+		// Failed fetches are retried by the worker, so the fetch itself
+		// is not.
+		return c.get(ctx, epoch, false)
+	})
+	return ch
+}
+
+func (c *client) watchWorker(ctx context.Context, ch chan<- *WatchEvent, fetchFn func(context.Context, uint64) (*pki.Document, []byte, error)) {
+	defer close(ch)
+
+	policy := c.cfg.RetryPolicy
+	if policy == nil {
+		policy = &RetryPolicy{}
+	}
+
+	next, _, _ := c.clock()
+	attempt := 0
+	for {
+		now, _, till := c.clock()
+		switch {
+		case next+1 < now:
+			// The authority no longer serves the Document for the epoch.
+			c.log.Warningf("nonvoting/Client: Watch() missed epoch %v.", next)
+			if !c.deliverWatchEvent(ctx, ch, &WatchEvent{Epoch: next, Err: ErrMissedEpoch}) {
+				return
+			}
+			next, attempt = next+1, 0
+			continue
+		case next == now+1 && till > watchPublishDeadline:
+			// Prefetch the next epoch's Document once it is published.
+			if !sleepCtx(ctx, till-watchPublishDeadline) {
+				return
+			}
+			continue
+		case next > now+1:
+			if !sleepCtx(ctx, till) {
+				return
+			}
+			continue
+		}
+
+		// Bound the fetch by the end of the current epoch, after which the
+		// state of the world will have changed.
+		fetchCtx, cancelFn := context.WithTimeout(ctx, till)
+		doc, raw, err := fetchFn(fetchCtx, next)
+		cancelFn()
+		if ctx.Err() != nil {
+			return
+		}
+
+		switch err {
+		case nil:
+			if !c.deliverWatchEvent(ctx, ch, &WatchEvent{Epoch: next, Doc: doc, Raw: raw}) {
+				return
+			}
+			next, attempt = next+1, 0
+		case pki.ErrNoDocument:
+			c.log.Warningf("nonvoting/Client: Watch() authority has no Document for epoch %v.", next)
+			if !c.deliverWatchEvent(ctx, ch, &WatchEvent{Epoch: next, Err: err}) {
+				return
+			}
+			next, attempt = next+1, 0
+		default:
+			if err != ErrNotYet && err != context.DeadlineExceeded {
+				c.log.Warningf("nonvoting/Client: Watch() failed to fetch Document for epoch %v: %v", next, err)
+			}
+			attempt++
+			if _, _, till = c.clock(); !sleepCtx(ctx, minDuration(policy.backoff(attempt, c.rng), till)) {
+				return
+			}
+		}
+	}
+}
+
+func (c *client) deliverWatchEvent(ctx context.Context, ch chan<- *WatchEvent, ev *WatchEvent) bool {
+	select {
+	case ch <- ev:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sleepCtx sleeps for the duration, and returns false iff the context is
+// done first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
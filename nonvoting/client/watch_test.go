@@ -0,0 +1,103 @@
+// watch_test.go - Katzenpost non-voting authority client watch tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/authority/nonvoting/client"
+	"github.com/katzenpost/authority/nonvoting/client/clienttest"
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// generateTestDocument posts the descriptors for a minimal topology, and
+// generates the Document for the epoch.
+func generateTestDocument(t *testing.T, a *clienttest.Authority, epoch uint64) {
+	require := require.New(t)
+
+	for _, layer := range []uint8{pki.LayerProvider, 0} {
+		n := newTestNode(t, layer)
+		err := a.Post(context.Background(), epoch, n.signingKey, n.descriptor(t, epoch))
+		require.NoError(err, "Post(): %v", epoch)
+	}
+	_, err := a.GenerateDocument(epoch)
+	require.NoError(err, "GenerateDocument(): %v", epoch)
+}
+
+func recvWatchEvent(t *testing.T, ch <-chan *client.WatchEvent) *client.WatchEvent {
+	select {
+	case ev, ok := <-ch:
+		require.True(t, ok, "Watch(): closed")
+		return ev
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "Watch(): timed out")
+	}
+	return nil
+}
+
+func TestWatch(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	a, err := clienttest.New(nil)
+	require.NoError(err, "clienttest.New()")
+	a.SetParameters(&clienttest.Parameters{Layers: 1})
+	a.SetEpoch(10)
+	clock := &testClock{epoch: 10}
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	policy := &client.RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+	ch := client.WatchWithClock(ctx, newTestLogBackend(t), policy, clock.Now, a.Get)
+
+	// The current epoch's Document is delivered once it is generated.
+	time.Sleep(20 * time.Millisecond)
+	generateTestDocument(t, a, 10)
+	ev := recvWatchEvent(t, ch)
+	assert.Equal(uint64(10), ev.Epoch, "Generated: Epoch")
+	assert.NoError(ev.Err, "Generated: Err")
+	require.NotNil(ev.Doc, "Generated: Doc")
+	assert.Equal(uint64(10), ev.Doc.Epoch, "Generated: Doc.Epoch")
+	assert.NotEmpty(ev.Raw, "Generated: Raw")
+
+	// Epochs that the authority has no Document for are reported.
+	a.SetGetResponse(11, pki.ErrNoDocument)
+	ev = recvWatchEvent(t, ch)
+	assert.Equal(uint64(11), ev.Epoch, "No Document: Epoch")
+	assert.Equal(pki.ErrNoDocument, ev.Err, "No Document: Err")
+
+	// Epochs that end before their Document is fetched are missed.
+	clock.Set(14)
+	a.SetEpoch(14)
+	ev = recvWatchEvent(t, ch)
+	assert.Equal(uint64(12), ev.Epoch, "Missed: Epoch")
+	assert.Equal(client.ErrMissedEpoch, ev.Err, "Missed: Err")
+
+	generateTestDocument(t, a, 13)
+	ev = recvWatchEvent(t, ch)
+	assert.Equal(uint64(13), ev.Epoch, "After missed: Epoch")
+	assert.NoError(ev.Err, "After missed: Err")
+
+	// The channel is closed once the context is done.
+	cancelFn()
+	for range ch {
+	}
+}
@@ -0,0 +1,172 @@
+// capabilities.go - Katzenpost Non-voting authority capabilities s11n.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package s11n
+
+import (
+	"fmt"
+
+	"github.com/ugorji/go/codec"
+)
+
+const capabilitiesVersion = "nonvoting-capabilities-v0"
+
+const (
+	// FeatureConsensusRange is the feature for the consensus range command.
+	FeatureConsensusRange = "consensus-range"
+
+	// FeatureConsensusWait is the feature for the long-poll consensus
+	// command.
+	FeatureConsensusWait = "consensus-wait"
+
+	// FeatureDescriptorStatus is the feature for the descriptor status
+	// query command.
+	FeatureDescriptorStatus = "descriptor-status"
+
+	// FeatureDescriptorRevision is the feature for replacing descriptors
+	// with higher revisions.
+	FeatureDescriptorRevision = "descriptor-revision"
+
+	// FeatureDescriptorErrorCodes is the feature for the late and internal
+	// error descriptor upload status codes.
+	FeatureDescriptorErrorCodes = "descriptor-error-codes"
+
+	// FeatureSessionReuse is the feature for issuing multiple commands
+	// over a single wire protocol session.
+	FeatureSessionReuse = "session-reuse"
+
+	// FeatureAuthorityStatus is the feature for the authority status
+	// query command.
+	FeatureAuthorityStatus = "authority-status"
+)
+
+// Capabilities is the set of formats and optional features supported by one
+// side of an authority wire protocol session.
+type Capabilities struct {
+	// DescriptorVersions is the list of supported descriptor formats.
+	DescriptorVersions []string
+
+	// DocumentVersions is the list of supported document formats.
+	DocumentVersions []string
+
+	// Features is the list of supported optional features.
+	Features []string
+
+	// Reason is the human readable reason why the peer's capabilities are
+	// unacceptable, if any.  It is only ever set by the authority.
+	Reason string
+}
+
+type capabilities struct {
+	// Version uniquely identifies the capabilities format so that it can be
+	// rejected if the version changes.
+	Version string
+
+	Capabilities
+}
+
+// LocalCapabilities returns the Capabilities of this implementation.
+func LocalCapabilities() *Capabilities {
+	return &Capabilities{
+		DescriptorVersions: []string{nodeDescriptorVersion},
+		DocumentVersions:   []string{documentVersion},
+		Features: []string{
+			FeatureConsensusRange,
+			FeatureConsensusWait,
+			FeatureDescriptorStatus,
+			FeatureDescriptorRevision,
+			FeatureDescriptorErrorCodes,
+			FeatureSessionReuse,
+			FeatureAuthorityStatus,
+		},
+	}
+}
+
+// LegacyCapabilities returns the Capabilities implied by a peer that does
+// not support capability advertisement.
+func LegacyCapabilities() *Capabilities {
+	return &Capabilities{
+		DescriptorVersions: []string{nodeDescriptorVersion},
+		DocumentVersions:   []string{documentVersion},
+	}
+}
+
+// HasFeature returns true iff the feature is supported.
+func (c *Capabilities) HasFeature(feature string) bool {
+	return contains(c.Features, feature)
+}
+
+// Negotiate compares the peer's capabilities against the local ones, and
+// returns a descriptive error iff there is no common descriptor and
+// document format.
+func (c *Capabilities) Negotiate(peer *Capabilities) error {
+	if !containsAny(c.DescriptorVersions, peer.DescriptorVersions) {
+		return fmt.Errorf("nonvoting: No common descriptor version (supported: %v, peer: %v)", c.DescriptorVersions, peer.DescriptorVersions)
+	}
+	if !containsAny(c.DocumentVersions, peer.DocumentVersions) {
+		return fmt.Errorf("nonvoting: No common document version (supported: %v, peer: %v)", c.DocumentVersions, peer.DocumentVersions)
+	}
+	return nil
+}
+
+// SerializeCapabilities serializes the capabilities.
+//
+// Note: The capabilities are not signed, and rely on the authenticated wire
+// protocol session for integrity.
+func SerializeCapabilities(c *Capabilities) ([]byte, error) {
+	cc := &capabilities{
+		Version:      capabilitiesVersion,
+		Capabilities: *c,
+	}
+
+	var b []byte
+	enc := codec.NewEncoderBytes(&b, jsonHandle)
+	if err := enc.Encode(cc); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ParseCapabilities deserializes the capabilities.
+func ParseCapabilities(b []byte) (*Capabilities, error) {
+	cc := new(capabilities)
+	dec := codec.NewDecoderBytes(b, jsonHandle)
+	if err := dec.Decode(cc); err != nil {
+		return nil, err
+	}
+	if cc.Version != capabilitiesVersion {
+		return nil, fmt.Errorf("nonvoting: Invalid Capabilities Version: '%v'", cc.Version)
+	}
+	return &cc.Capabilities, nil
+}
+
+func contains(l []string, v string) bool {
+	for _, s := range l {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(l, vs []string) bool {
+	for _, v := range vs {
+		if contains(l, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+// capabilities_test.go - Capabilities s11n tests.
+// Copyright (C) 2018  Yawning Angel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package s11n
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapabilities(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	caps := LocalCapabilities()
+	b, err := SerializeCapabilities(caps)
+	require.NoError(err, "SerializeCapabilities()")
+
+	t.Logf("Serialized capabilities: '%v'", string(b))
+
+	dCaps, err := ParseCapabilities(b)
+	require.NoError(err, "ParseCapabilities()")
+	require.Equal(caps, dCaps, "ParseCapabilities(): Capabilities")
+	assert.True(dCaps.HasFeature(FeatureConsensusWait), "HasFeature(known)")
+	assert.False(dCaps.HasFeature("bogus"), "HasFeature(unknown)")
+
+	// Negotiation.
+	assert.NoError(caps.Negotiate(LegacyCapabilities()), "Negotiate(legacy)")
+	assert.False(LegacyCapabilities().HasFeature(FeatureDescriptorErrorCodes), "Legacy HasFeature()")
+	future := &Capabilities{
+		DescriptorVersions: []string{"nonvoting-v23"},
+		DocumentVersions:   []string{documentVersion},
+	}
+	assert.Error(caps.Negotiate(future), "Negotiate(descriptor mismatch)")
+	future.DescriptorVersions = append(future.DescriptorVersions, nodeDescriptorVersion)
+	assert.NoError(caps.Negotiate(future), "Negotiate(descriptor overlap)")
+	future.DocumentVersions = []string{"nonvoting-document-v23"}
+	assert.Error(caps.Negotiate(future), "Negotiate(document mismatch)")
+
+	// Invalid versions are rejected.
+	_, err = ParseCapabilities([]byte(`{"Version":"bogus"}`))
+	assert.Error(err, "ParseCapabilities(bad version)")
+}
@@ -0,0 +1,83 @@
+// consensus_range.go - Katzenpost Non-voting authority consensus range s11n.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package s11n
+
+import (
+	"fmt"
+
+	"github.com/ugorji/go/codec"
+)
+
+const consensusRangeVersion = "nonvoting-consensus-range-v0"
+
+// ConsensusRangeEntry is the authority's response for a single epoch of a
+// consensus range request.
+type ConsensusRangeEntry struct {
+	// Epoch is the epoch that the entry is for.
+	Epoch uint64
+
+	// ErrorCode is the per-epoch `commands.Consensus` error code.
+	ErrorCode uint8
+
+	// Payload is the signed Document iff ErrorCode is `ConsensusOk`.
+	Payload []byte
+}
+
+type consensusRange struct {
+	// Version uniquely identifies the consensus range format so that it
+	// can be rejected if the version changes.
+	Version string
+
+	Entries []*ConsensusRangeEntry
+}
+
+// SerializeConsensusRange serializes the entries of a consensus range
+// response.
+//
+// Note: The entries are not signed, however each Document is, and must be
+// validated with VerifyAndParseDocument.
+func SerializeConsensusRange(entries []*ConsensusRangeEntry) ([]byte, error) {
+	r := &consensusRange{
+		Version: consensusRangeVersion,
+		Entries: entries,
+	}
+
+	var b []byte
+	enc := codec.NewEncoderBytes(&b, jsonHandle)
+	if err := enc.Encode(r); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ParseConsensusRange deserializes the entries of a consensus range response.
+func ParseConsensusRange(b []byte) ([]*ConsensusRangeEntry, error) {
+	r := new(consensusRange)
+	dec := codec.NewDecoderBytes(b, jsonHandle)
+	if err := dec.Decode(r); err != nil {
+		return nil, err
+	}
+	if r.Version != consensusRangeVersion {
+		return nil, fmt.Errorf("nonvoting: Invalid Consensus Range Version: '%v'", r.Version)
+	}
+	for _, v := range r.Entries {
+		if v == nil {
+			return nil, fmt.Errorf("nonvoting: Consensus Range contains a nil entry")
+		}
+	}
+	return r.Entries, nil
+}
@@ -0,0 +1,55 @@
+// consensus_range_test.go - Consensus range s11n tests.
+// Copyright (C) 2018  Yawning Angel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package s11n
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsensusRange(t *testing.T) {
+	require := require.New(t)
+
+	entries := []*ConsensusRangeEntry{
+		&ConsensusRangeEntry{
+			Epoch:   debugTestEpoch,
+			Payload: []byte("not actually a document"),
+		},
+		&ConsensusRangeEntry{
+			Epoch:     debugTestEpoch + 1,
+			ErrorCode: 1,
+		},
+	}
+
+	b, err := SerializeConsensusRange(entries)
+	require.NoError(err, "SerializeConsensusRange()")
+
+	t.Logf("Serialized range: '%v'", string(b))
+
+	dEntries, err := ParseConsensusRange(b)
+	require.NoError(err, "ParseConsensusRange()")
+	require.Len(dEntries, len(entries), "ParseConsensusRange(): Entries")
+	for i, v := range entries {
+		require.Equal(v.Epoch, dEntries[i].Epoch, "[%d]: Epoch", i)
+		require.Equal(v.ErrorCode, dEntries[i].ErrorCode, "[%d]: ErrorCode", i)
+		require.Equal(len(v.Payload), len(dEntries[i].Payload), "[%d]: len(Payload)", i)
+	}
+
+	_, err = ParseConsensusRange([]byte("{\"Version\":\"bogus\"}"))
+	require.Error(err, "ParseConsensusRange(bad)")
+}
@@ -35,22 +35,50 @@ import (
 
 const nodeDescriptorVersion = "nonvoting-v0"
 
+// DescriptorVersionError is the error returned when a correctly signed
+// descriptor is in an unsupported format, as posted by nodes that need to be
+// upgraded.
+type DescriptorVersionError struct {
+	// Version is the descriptor's format version.
+	Version string
+}
+
+func (e *DescriptorVersionError) Error() string {
+	return fmt.Sprintf("nonvoting: Invalid Descriptor Version: '%v' (supported: '%v')", e.Version, nodeDescriptorVersion)
+}
+
 type nodeDescriptor struct {
 	// Version uniquely identifies the descriptor format as being for the
 	// non-voting authority so that it can be rejected when unexpectedly
 	// posted to, or received from an authority, or if the version changes.
 	Version string
 
+	// Revision is the monotonically increasing revision of the descriptor
+	// for a given epoch, allowing a node to replace a descriptor that it
+	// previously posted.  It is omitted when zero for compatibility.
+	Revision uint64 `codec:",omitempty"`
+
 	pki.MixDescriptor
 }
 
 // SignDescriptor signs and serializes the descriptor with the provided signing
 // key.
 func SignDescriptor(signingKey *eddsa.PrivateKey, base *pki.MixDescriptor) (string, error) {
+	return SignDescriptorRevision(signingKey, base, 0)
+}
+
+// SignDescriptorRevision signs and serializes the descriptor with the provided
+// signing key and revision.
+func SignDescriptorRevision(signingKey *eddsa.PrivateKey, base *pki.MixDescriptor, revision uint64) (string, error) {
 	d := new(nodeDescriptor)
 	d.MixDescriptor = *base
 	d.Version = nodeDescriptorVersion
+	d.Revision = revision
+
+	return signNodeDescriptor(signingKey, d)
+}
 
+func signNodeDescriptor(signingKey *eddsa.PrivateKey, d *nodeDescriptor) (string, error) {
 	// Serialize the descriptor.
 	var payload []byte
 	enc := codec.NewEncoderBytes(&payload, jsonHandle)
@@ -81,9 +109,17 @@ func SignDescriptor(signingKey *eddsa.PrivateKey, base *pki.MixDescriptor) (stri
 // to have been correctly self signed by the IdentityKey listed in the
 // MixDescriptor.
 func VerifyAndParseDescriptor(b []byte, epoch uint64) (*pki.MixDescriptor, error) {
+	desc, _, err := VerifyAndParseDescriptorRevision(b, epoch)
+	return desc, err
+}
+
+// VerifyAndParseDescriptorRevision verifies the signature and deserializes the
+// descriptor like VerifyAndParseDescriptor, additionally returning the
+// descriptor's revision.
+func VerifyAndParseDescriptorRevision(b []byte, epoch uint64) (*pki.MixDescriptor, uint64, error) {
 	signed, err := jose.ParseSigned(string(b))
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// So the descriptor is going to be signed by the node's key, which may
@@ -99,15 +135,15 @@ func VerifyAndParseDescriptor(b []byte, epoch uint64) (*pki.MixDescriptor, error
 	// twice, but this isn't a critical path operation, nor is the non-voting
 	// authority something that will do this a lot.
 	if len(signed.Signatures) != 1 {
-		return nil, fmt.Errorf("nonvoting: Expected 1 signature, got: %v", len(signed.Signatures))
+		return nil, 0, fmt.Errorf("nonvoting: Expected 1 signature, got: %v", len(signed.Signatures))
 	}
 	alg := signed.Signatures[0].Header.Algorithm
 	if alg != "EdDSA" {
-		return nil, fmt.Errorf("nonvoting: Unsupported signature algorithm: '%v'", alg)
+		return nil, 0, fmt.Errorf("nonvoting: Unsupported signature algorithm: '%v'", alg)
 	}
 	candidatePk, err := extractSignedDescriptorPublicKey(b)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// Verify that the descriptor is signed by the key in the header.
@@ -116,31 +152,31 @@ func VerifyAndParseDescriptor(b []byte, epoch uint64) (*pki.MixDescriptor, error
 		if err == jose.ErrCryptoFailure {
 			err = fmt.Errorf("nonvoting: Invalid descriptor signature")
 		}
-		return nil, err
+		return nil, 0, err
 	}
 
 	// Parse the payload.
 	d := new(nodeDescriptor)
 	dec := codec.NewDecoderBytes(payload, jsonHandle)
 	if err = dec.Decode(d); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// Ensure the descriptor is well formed.
 	if d.Version != nodeDescriptorVersion {
-		return nil, fmt.Errorf("nonvoting: Invalid Descriptor Version: '%v'", d.Version)
+		return nil, 0, &DescriptorVersionError{Version: d.Version}
 	}
 	if err = IsDescriptorWellFormed(&d.MixDescriptor, epoch); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// And as the final check, ensure that the key embedded in the descriptor
 	// matches the key we teased out of the payload, that we used to validate
 	// the signature.
 	if !candidatePk.Equal(d.IdentityKey) {
-		return nil, fmt.Errorf("nonvoting: Descriptor signing key mismatch")
+		return nil, 0, fmt.Errorf("nonvoting: Descriptor signing key mismatch")
 	}
-	return &d.MixDescriptor, nil
+	return &d.MixDescriptor, d.Revision, nil
 }
 
 func extractSignedDescriptorPublicKey(b []byte) (*eddsa.PublicKey, error) {
@@ -95,3 +95,50 @@ func TestDescriptor(t *testing.T) {
 		require.Equal(v.Bytes(), vv.Bytes(), "MixKeys[%v]", k)
 	}
 }
+
+func TestDescriptorRevision(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	d, rawDesc := genDescriptor(require, 1, 0)
+	_, rev, err := VerifyAndParseDescriptorRevision(rawDesc, debugTestEpoch)
+	require.NoError(err, "VerifyAndParseDescriptorRevision(unrevised)")
+	assert.Equal(uint64(0), rev, "Revision(unrevised)")
+
+	identityPriv, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+	d.IdentityKey = identityPriv.PublicKey()
+
+	signed, err := SignDescriptorRevision(identityPriv, d, 23)
+	require.NoError(err, "SignDescriptorRevision()")
+	dd, rev, err := VerifyAndParseDescriptorRevision([]byte(signed), debugTestEpoch)
+	require.NoError(err, "VerifyAndParseDescriptorRevision()")
+	assert.Equal(uint64(23), rev, "Revision")
+	assert.Equal(d.Name, dd.Name, "Name")
+
+	// Revision unaware callers still accept the descriptor.
+	_, err = VerifyAndParseDescriptor([]byte(signed), debugTestEpoch)
+	require.NoError(err, "VerifyAndParseDescriptor()")
+}
+
+func TestDescriptorVersion(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	d, _ := genDescriptor(require, 1, 0)
+	identityPriv, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+	d.IdentityKey = identityPriv.PublicKey()
+
+	nd := &nodeDescriptor{
+		Version:       "nonvoting-v23",
+		MixDescriptor: *d,
+	}
+	signed, err := signNodeDescriptor(identityPriv, nd)
+	require.NoError(err, "signNodeDescriptor()")
+	_, err = VerifyAndParseDescriptor([]byte(signed), debugTestEpoch)
+	require.Error(err, "VerifyAndParseDescriptor()")
+	vErr, ok := err.(*DescriptorVersionError)
+	require.True(ok, "VerifyAndParseDescriptor(): error type")
+	assert.Equal("nonvoting-v23", vErr.Version, "Version")
+}
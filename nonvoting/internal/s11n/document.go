@@ -85,6 +85,39 @@ func SignDocument(signingKey *eddsa.PrivateKey, d *Document) (string, error) {
 	return signed.CompactSerialize()
 }
 
+// MultiSignDocument signs and serializes the document with each of the
+// provided signing keys, using the JWS JSON serialization.
+func MultiSignDocument(signingKeys []*eddsa.PrivateKey, d *Document) (string, error) {
+	d.Version = documentVersion
+
+	// Serialize the document.
+	var payload []byte
+	enc := codec.NewEncoderBytes(&payload, jsonHandle)
+	if err := enc.Encode(d); err != nil {
+		return "", err
+	}
+
+	// Sign the document.
+	var ks []jose.SigningKey
+	for _, v := range signingKeys {
+		ks = append(ks, jose.SigningKey{
+			Algorithm: jose.EdDSA,
+			Key:       *v.InternalPtr(),
+		})
+	}
+	signer, err := jose.NewMultiSigner(ks, nil)
+	if err != nil {
+		return "", err
+	}
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+
+	// Serialize the descriptor and signatures.
+	return signed.FullSerialize(), nil
+}
+
 // VerifyAndParseDocument verifies the signautre and deserializes the document.
 func VerifyAndParseDocument(b []byte, publicKey *eddsa.PublicKey) (*pki.Document, error) {
 	signed, err := jose.ParseSigned(string(b))
@@ -109,10 +142,62 @@ func VerifyAndParseDocument(b []byte, publicKey *eddsa.PublicKey) (*pki.Document
 		return nil, err
 	}
 
+	return parseDocumentPayload(payload)
+}
+
+// VerifyAndParseDocumentThreshold verifies that the document is signed by at
+// least threshold of the provided public keys, and deserializes the
+// document.  The document may carry any number of signatures (eg: the JWS
+// JSON serialization), and the public keys that produced valid signatures
+// are returned along with the document.
+func VerifyAndParseDocumentThreshold(b []byte, publicKeys []*eddsa.PublicKey, threshold int) (*pki.Document, []*eddsa.PublicKey, error) {
+	if threshold < 1 || threshold > len(publicKeys) {
+		return nil, nil, fmt.Errorf("nonvoting: Invalid signature threshold: %v of %v", threshold, len(publicKeys))
+	}
+
+	signed, err := jose.ParseSigned(string(b))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(signed.Signatures) == 0 {
+		return nil, nil, fmt.Errorf("nonvoting: Expected at least 1 signature, got: 0")
+	}
+
+	// Validate the signatures, crediting each signature to at most one
+	// public key, and each public key at most once.
+	var signers []*eddsa.PublicKey
+	var payload []byte
+	usedSigs := make(map[int]bool)
+	usedKeys := make(map[[eddsa.PublicKeySize]byte]bool)
+	for _, k := range publicKeys {
+		if usedKeys[k.ByteArray()] {
+			continue
+		}
+		idx, sig, p, err := signed.VerifyMulti(*k.InternalPtr())
+		if err != nil || usedSigs[idx] || sig.Header.Algorithm != "EdDSA" {
+			continue
+		}
+		usedSigs[idx] = true
+		usedKeys[k.ByteArray()] = true
+		signers = append(signers, k)
+		payload = p
+	}
+	if len(signers) < threshold {
+		return nil, signers, fmt.Errorf("nonvoting: Insufficient valid document signatures: %v, need %v", len(signers), threshold)
+	}
+
+	doc, err := parseDocumentPayload(payload)
+	if err != nil {
+		return nil, signers, err
+	}
+	return doc, signers, nil
+}
+
+func parseDocumentPayload(payload []byte) (*pki.Document, error) {
 	// Parse the payload.
 	d := new(Document)
 	dec := codec.NewDecoderBytes(payload, jsonHandle)
-	if err = dec.Decode(d); err != nil {
+	if err := dec.Decode(d); err != nil {
 		return nil, err
 	}
 
@@ -151,7 +236,7 @@ func VerifyAndParseDocument(b []byte, publicKey *eddsa.PublicKey) (*pki.Document
 		doc.Providers = append(doc.Providers, desc)
 	}
 
-	if err = IsDocumentWellFormed(doc); err != nil {
+	if err := IsDocumentWellFormed(doc); err != nil {
 		return nil, err
 	}
 
@@ -187,9 +272,7 @@ func IsDocumentWellFormed(d *pki.Document) error {
 			pks[pk] = true
 		}
 	}
-	if len(d.Providers) == 0 {
-		return fmt.Errorf("nonvoting: Document contains no Providers")
-	}
+	// Note: Authorities may be configured to not require any Providers.
 	for _, desc := range d.Providers {
 		if err := IsDescriptorWellFormed(desc, d.Epoch); err != nil {
 			return err
@@ -120,3 +120,88 @@ func TestDocument(t *testing.T) {
 	// TODO: Ensure the descriptors are sane.
 	_ = assert
 }
+
+func TestDocumentThreshold(t *testing.T) {
+	require := require.New(t)
+
+	// Generate random signing keys.
+	var keys []*eddsa.PrivateKey
+	var pubKeys []*eddsa.PublicKey
+	for i := 0; i < 3; i++ {
+		k, err := eddsa.NewKeypair(rand.Reader)
+		require.NoError(err, "eddsa.NewKeypair()")
+		keys = append(keys, k)
+		pubKeys = append(pubKeys, k.PublicKey())
+	}
+
+	// Generate a Document.
+	doc := &Document{
+		Epoch:           debugTestEpoch,
+		Topology:        make([][][]byte, 3),
+		MixLambda:       0.42,
+		MixMaxDelay:     23,
+		SendLambda:      0.69,
+		SendShift:       15000,
+		SendMaxInterval: 17,
+	}
+	idx := 1
+	for l := 0; l < 3; l++ {
+		_, rawDesc := genDescriptor(require, idx, 0)
+		doc.Topology[l] = append(doc.Topology[l], rawDesc)
+		idx++
+	}
+	_, rawDesc := genDescriptor(require, idx, pki.LayerProvider)
+	doc.Providers = append(doc.Providers, rawDesc)
+
+	// Sign with 2 of the 3 keys.
+	signed, err := MultiSignDocument(keys[:2], doc)
+	require.NoError(err, "MultiSignDocument()")
+
+	// Validate and deserialize.
+	ddoc, signers, err := VerifyAndParseDocumentThreshold([]byte(signed), pubKeys, 2)
+	require.NoError(err, "VerifyAndParseDocumentThreshold()")
+	require.Equal(doc.Epoch, ddoc.Epoch, "VerifyAndParseDocumentThreshold(): Epoch")
+	require.Equal(pubKeys[:2], signers, "VerifyAndParseDocumentThreshold(): Signers")
+
+	_, signers, err = VerifyAndParseDocumentThreshold([]byte(signed), pubKeys, 3)
+	require.Error(err, "VerifyAndParseDocumentThreshold(): Insufficient signatures")
+	require.Len(signers, 2, "VerifyAndParseDocumentThreshold(): Insufficient signatures")
+
+	// Duplicate keys must not count more than once.
+	_, _, err = VerifyAndParseDocumentThreshold([]byte(signed), []*eddsa.PublicKey{pubKeys[0], pubKeys[0]}, 2)
+	require.Error(err, "VerifyAndParseDocumentThreshold(): Duplicate keys")
+
+	// Single signature documents are also accepted.
+	signed, err = SignDocument(keys[2], doc)
+	require.NoError(err, "SignDocument()")
+	_, signers, err = VerifyAndParseDocumentThreshold([]byte(signed), pubKeys, 1)
+	require.NoError(err, "VerifyAndParseDocumentThreshold(): Single signature")
+	require.Equal(pubKeys[2:], signers, "VerifyAndParseDocumentThreshold(): Single signature")
+
+	// The strict single signature verification rejects multiple signatures.
+	signed, err = MultiSignDocument(keys, doc)
+	require.NoError(err, "MultiSignDocument()")
+	_, err = VerifyAndParseDocument([]byte(signed), pubKeys[0])
+	require.Error(err, "VerifyAndParseDocument(): Multiple signatures")
+}
+
+func TestDocumentNoProviders(t *testing.T) {
+	require := require.New(t)
+
+	k, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+
+	// Authorities may be configured to not require any Providers.
+	doc := &Document{
+		Epoch:    debugTestEpoch,
+		Topology: make([][][]byte, 1),
+	}
+	_, rawDesc := genDescriptor(require, 1, 0)
+	doc.Topology[0] = append(doc.Topology[0], rawDesc)
+
+	signed, err := SignDocument(k, doc)
+	require.NoError(err, "SignDocument()")
+	ddoc, err := VerifyAndParseDocument([]byte(signed), k.PublicKey())
+	require.NoError(err, "VerifyAndParseDocument()")
+	require.Len(ddoc.Providers, 0, "VerifyAndParseDocument(): Providers")
+}
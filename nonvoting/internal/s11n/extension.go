@@ -0,0 +1,184 @@
+// extension.go - Katzenpost Non-voting authority wire extension s11n.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package s11n
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ugorji/go/codec"
+)
+
+const extensionVersion = "nonvoting-extension-v0"
+
+// ExtensionEpoch is the `commands.PostDescriptor` epoch that denotes a
+// wire protocol extension request, rather than a descriptor upload.
+//
+// The extension commands are not part of the core wire protocol, so
+// requests are carried as the payload of a `post_descriptor` command for
+// this epoch, which no authority will ever accept a descriptor for, and
+// responses as the payload of a `consensus` command with the error code
+// `ConsensusOk`.  Authorities that predate the extensions either reject
+// the request as a descriptor for an invalid epoch, or close the session
+// if the peer is not allowed to post.
+const ExtensionEpoch = math.MaxUint64
+
+const (
+	// ExtGetCapabilities is the extension command that exchanges
+	// Capabilities.  It is only valid as the first command of a session.
+	ExtGetCapabilities = "get_capabilities"
+
+	// ExtGetDescriptorStatus is the extension command that returns the
+	// DescriptorStatus of each of the peer's descriptors.
+	ExtGetDescriptorStatus = "get_descriptor_status"
+
+	// ExtGetConsensusRange is the extension command that returns the
+	// ConsensusRangeEntry for each epoch from Epoch to EndEpoch inclusive.
+	ExtGetConsensusRange = "get_consensus_range"
+
+	// ExtGetConsensusWait is the extension command that returns the
+	// Document for Epoch, like `get_consensus`, except that the authority
+	// may hold the request for up to Timeout seconds if the Document has
+	// yet to be generated.  The response ErrorCode is the
+	// `commands.Consensus` error code.
+	ExtGetConsensusWait = "get_consensus_wait"
+
+	// ExtGetAuthorityStatus is the extension command that returns the
+	// authority's AuthorityStatus.  It is only allowed on admin listeners.
+	ExtGetAuthorityStatus = "get_authority_status"
+)
+
+const (
+	// DescriptorLate is the `commands.PostDescriptorStatus` error code for
+	// descriptors that were posted after the Document for the epoch was
+	// generated.  It is only sent to peers that support
+	// FeatureDescriptorErrorCodes.
+	DescriptorLate = 4
+
+	// DescriptorInternalError is the `commands.PostDescriptorStatus` error
+	// code for descriptors that the authority failed to accept due to an
+	// internal error.  It is only sent to peers that support
+	// FeatureDescriptorErrorCodes.
+	DescriptorInternalError = 5
+)
+
+// ExtensionRequest is a wire protocol extension request.
+type ExtensionRequest struct {
+	// Command is the extension command (eg: ExtGetCapabilities).
+	Command string
+
+	// Epoch is the (first) epoch that the command is for, if any.
+	Epoch uint64
+
+	// EndEpoch is the last epoch that the command is for, if any.
+	EndEpoch uint64
+
+	// Timeout is the time in seconds that the authority may hold the
+	// request for, if any.
+	Timeout uint32
+
+	// Payload is the command specific payload, if any.
+	Payload []byte
+}
+
+// ExtensionResponse is a wire protocol extension response.
+type ExtensionResponse struct {
+	// Command is the extension command that is being responded to.
+	Command string
+
+	// ErrorCode is the command specific error code, if any.
+	ErrorCode uint8
+
+	// Payload is the command specific payload, if any.
+	Payload []byte
+}
+
+type extensionRequest struct {
+	// Version uniquely identifies the extension format so that it can be
+	// rejected if the version changes.
+	Version string
+
+	ExtensionRequest
+}
+
+type extensionResponse struct {
+	// Version uniquely identifies the extension format so that it can be
+	// rejected if the version changes.
+	Version string
+
+	ExtensionResponse
+}
+
+// SerializeExtensionRequest serializes the extension request.
+//
+// Note: The request is not signed, and relies on the authenticated wire
+// protocol session for integrity.
+func SerializeExtensionRequest(r *ExtensionRequest) ([]byte, error) {
+	return serializeExtension(&extensionRequest{
+		Version:          extensionVersion,
+		ExtensionRequest: *r,
+	})
+}
+
+// ParseExtensionRequest deserializes the extension request.
+func ParseExtensionRequest(b []byte) (*ExtensionRequest, error) {
+	r := new(extensionRequest)
+	if err := parseExtension(b, r, &r.Version); err != nil {
+		return nil, err
+	}
+	return &r.ExtensionRequest, nil
+}
+
+// SerializeExtensionResponse serializes the extension response.
+//
+// Note: The response is not signed, and relies on the authenticated wire
+// protocol session for integrity.
+func SerializeExtensionResponse(r *ExtensionResponse) ([]byte, error) {
+	return serializeExtension(&extensionResponse{
+		Version:           extensionVersion,
+		ExtensionResponse: *r,
+	})
+}
+
+// ParseExtensionResponse deserializes the extension response.
+func ParseExtensionResponse(b []byte) (*ExtensionResponse, error) {
+	r := new(extensionResponse)
+	if err := parseExtension(b, r, &r.Version); err != nil {
+		return nil, err
+	}
+	return &r.ExtensionResponse, nil
+}
+
+func serializeExtension(v interface{}) ([]byte, error) {
+	var b []byte
+	enc := codec.NewEncoderBytes(&b, jsonHandle)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func parseExtension(b []byte, v interface{}, version *string) error {
+	dec := codec.NewDecoderBytes(b, jsonHandle)
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if *version != extensionVersion {
+		return fmt.Errorf("nonvoting: Invalid Extension Version: '%v'", *version)
+	}
+	return nil
+}
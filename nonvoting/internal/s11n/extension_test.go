@@ -0,0 +1,66 @@
+// extension_test.go - Non-voting authority wire extension s11n tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package s11n
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtension(t *testing.T) {
+	require := require.New(t)
+
+	req := &ExtensionRequest{
+		Command:  ExtGetCapabilities,
+		Epoch:    debugTestEpoch,
+		EndEpoch: debugTestEpoch + 1,
+		Timeout:  23,
+		Payload:  []byte("not actually capabilities"),
+	}
+	b, err := SerializeExtensionRequest(req)
+	require.NoError(err, "SerializeExtensionRequest()")
+
+	t.Logf("Serialized request: '%v'", string(b))
+
+	dReq, err := ParseExtensionRequest(b)
+	require.NoError(err, "ParseExtensionRequest()")
+	require.Equal(req, dReq, "ParseExtensionRequest()")
+
+	resp := &ExtensionResponse{
+		Command:   ExtGetCapabilities,
+		ErrorCode: 1,
+		Payload:   []byte("not actually capabilities"),
+	}
+	b, err = SerializeExtensionResponse(resp)
+	require.NoError(err, "SerializeExtensionResponse()")
+
+	dResp, err := ParseExtensionResponse(b)
+	require.NoError(err, "ParseExtensionResponse()")
+	require.Equal(resp, dResp, "ParseExtensionResponse()")
+
+	// Requests and responses are versioned, and are never mistaken for
+	// other serialized objects.
+	_, err = ParseExtensionRequest([]byte("{\"Version\":\"bogus\"}"))
+	require.Error(err, "ParseExtensionRequest(bad)")
+	_, err = ParseExtensionResponse([]byte("{\"Version\":\"bogus\"}"))
+	require.Error(err, "ParseExtensionResponse(bad)")
+	caps, err := SerializeCapabilities(LocalCapabilities())
+	require.NoError(err, "SerializeCapabilities()")
+	_, err = ParseExtensionRequest(caps)
+	require.Error(err, "ParseExtensionRequest(capabilities)")
+}
@@ -0,0 +1,163 @@
+// status.go - Katzenpost Non-voting authority descriptor status s11n.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package s11n
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	descriptorStatusVersion = "nonvoting-descriptor-status-v0"
+	authorityStatusVersion  = "nonvoting-authority-status-v0"
+)
+
+// DescriptorStatus is the authority's view of a node's descriptor for a
+// given epoch.
+type DescriptorStatus struct {
+	// Epoch is the epoch that the descriptor is for.
+	Epoch uint64
+
+	// Hash is the DescriptorHash of the signed descriptor held by the
+	// authority.
+	Hash []byte
+
+	// Revision is the revision of the descriptor held by the authority.
+	Revision uint64
+
+	// HasDocument is true iff the Document for the epoch has been generated.
+	HasDocument bool
+
+	// Included is true iff the descriptor is included in the Document.
+	Included bool
+
+	// Layer is the layer that the node was assigned to iff Included is set.
+	Layer uint8
+
+	// Standby is true iff the descriptor was withheld from the Document as
+	// the topology was at capacity.
+	Standby bool
+}
+
+type descriptorStatusList struct {
+	// Version uniquely identifies the status format so that it can be
+	// rejected if the version changes.
+	Version string
+
+	Statuses []*DescriptorStatus
+}
+
+// DescriptorHash returns the digest of a signed and serialized descriptor,
+// as used to identify descriptors in a DescriptorStatus.
+func DescriptorHash(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+// SerializeDescriptorStatus serializes a list of descriptor statuses.
+//
+// Note: The statuses are not signed, and rely on the authenticated wire
+// protocol session for integrity.
+func SerializeDescriptorStatus(statuses []*DescriptorStatus) ([]byte, error) {
+	l := &descriptorStatusList{
+		Version:  descriptorStatusVersion,
+		Statuses: statuses,
+	}
+
+	var b []byte
+	enc := codec.NewEncoderBytes(&b, jsonHandle)
+	if err := enc.Encode(l); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ParseDescriptorStatus deserializes a list of descriptor statuses.
+func ParseDescriptorStatus(b []byte) ([]*DescriptorStatus, error) {
+	l := new(descriptorStatusList)
+	dec := codec.NewDecoderBytes(b, jsonHandle)
+	if err := dec.Decode(l); err != nil {
+		return nil, err
+	}
+	if l.Version != descriptorStatusVersion {
+		return nil, fmt.Errorf("nonvoting: Invalid Descriptor Status Version: '%v'", l.Version)
+	}
+	for _, v := range l.Statuses {
+		if v == nil {
+			return nil, fmt.Errorf("nonvoting: Descriptor Status contains a nil entry")
+		}
+		if len(v.Hash) != sha256.Size {
+			return nil, fmt.Errorf("nonvoting: Descriptor Status for epoch %v has invalid Hash", v.Epoch)
+		}
+	}
+	return l.Statuses, nil
+}
+
+// AuthorityStatus is the authority's readiness to generate the Document for
+// the next epoch.
+type AuthorityStatus struct {
+	// Epoch is the epoch that the status is for.
+	Epoch uint64
+
+	// Ready is true iff enough descriptors have been uploaded to generate
+	// the Document.
+	Ready bool
+
+	// Report is the human readable readiness report.
+	Report string
+}
+
+type authorityStatus struct {
+	// Version uniquely identifies the status format so that it can be
+	// rejected if the version changes.
+	Version string
+
+	AuthorityStatus
+}
+
+// SerializeAuthorityStatus serializes an authority status.
+//
+// Note: The status is not signed, and relies on the authenticated wire
+// protocol session for integrity.
+func SerializeAuthorityStatus(status *AuthorityStatus) ([]byte, error) {
+	st := &authorityStatus{
+		Version:         authorityStatusVersion,
+		AuthorityStatus: *status,
+	}
+
+	var b []byte
+	enc := codec.NewEncoderBytes(&b, jsonHandle)
+	if err := enc.Encode(st); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ParseAuthorityStatus deserializes an authority status.
+func ParseAuthorityStatus(b []byte) (*AuthorityStatus, error) {
+	st := new(authorityStatus)
+	dec := codec.NewDecoderBytes(b, jsonHandle)
+	if err := dec.Decode(st); err != nil {
+		return nil, err
+	}
+	if st.Version != authorityStatusVersion {
+		return nil, fmt.Errorf("nonvoting: Invalid Authority Status Version: '%v'", st.Version)
+	}
+	return &st.AuthorityStatus, nil
+}
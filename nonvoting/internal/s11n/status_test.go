@@ -0,0 +1,93 @@
+// status_test.go - Descriptor status s11n tests.
+// Copyright (C) 2018  Yawning Angel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package s11n
+
+import (
+	"testing"
+
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescriptorStatus(t *testing.T) {
+	require := require.New(t)
+
+	_, rawDesc := genDescriptor(require, 1, 0)
+	_, rawProvider := genDescriptor(require, 2, pki.LayerProvider)
+
+	statuses := []*DescriptorStatus{
+		&DescriptorStatus{
+			Epoch:       debugTestEpoch,
+			Hash:        DescriptorHash(rawDesc),
+			Revision:    3,
+			HasDocument: true,
+			Included:    true,
+			Layer:       2,
+		},
+		&DescriptorStatus{
+			Epoch: debugTestEpoch + 1,
+			Hash:  DescriptorHash(rawProvider),
+		},
+		&DescriptorStatus{
+			Epoch:       debugTestEpoch + 2,
+			Hash:        DescriptorHash(rawDesc),
+			HasDocument: true,
+			Standby:     true,
+		},
+	}
+
+	b, err := SerializeDescriptorStatus(statuses)
+	require.NoError(err, "SerializeDescriptorStatus()")
+
+	t.Logf("Serialized status: '%v'", string(b))
+
+	dStatuses, err := ParseDescriptorStatus(b)
+	require.NoError(err, "ParseDescriptorStatus()")
+	require.Equal(statuses, dStatuses, "ParseDescriptorStatus(): Statuses")
+
+	// Truncated digests are rejected.
+	statuses[0].Hash = statuses[0].Hash[:16]
+	b, err = SerializeDescriptorStatus(statuses)
+	require.NoError(err, "SerializeDescriptorStatus(bad)")
+	_, err = ParseDescriptorStatus(b)
+	require.Error(err, "ParseDescriptorStatus(bad)")
+}
+
+func TestAuthorityStatus(t *testing.T) {
+	require := require.New(t)
+
+	status := &AuthorityStatus{
+		Epoch:  debugTestEpoch,
+		Ready:  true,
+		Report: "providers 1/1",
+	}
+
+	b, err := SerializeAuthorityStatus(status)
+	require.NoError(err, "SerializeAuthorityStatus()")
+
+	t.Logf("Serialized status: '%v'", string(b))
+
+	dStatus, err := ParseAuthorityStatus(b)
+	require.NoError(err, "ParseAuthorityStatus()")
+	require.Equal(status, dStatus, "ParseAuthorityStatus(): Status")
+
+	// Other formats are rejected.
+	b, err = SerializeDescriptorStatus(nil)
+	require.NoError(err, "SerializeDescriptorStatus()")
+	_, err = ParseAuthorityStatus(b)
+	require.Error(err, "ParseAuthorityStatus(): descriptor status")
+}
@@ -0,0 +1,83 @@
+// activation.go - Katzenpost non-voting authority socket activation.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed via socket activation.
+const listenFdsStart = 3
+
+// ListenersFromEnv returns the listeners passed to the process via the
+// systemd socket activation protocol (`LISTEN_PID`, `LISTEN_FDS` and
+// `LISTEN_FDNAMES`), for use with WithListener.  If the process was not
+// socket activated, no listeners are returned.
+//
+// Once all of the listeners are created, the passed file descriptors are
+// closed, and the environment variables are unset so that they are not
+// inherited by child processes.  On failure, both are left untouched.
+func ListenersFromEnv() ([]net.Listener, error) {
+	pidStr := os.Getenv("LISTEN_PID")
+	if pidStr == "" {
+		return nil, nil
+	}
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil {
+		return nil, fmt.Errorf("server: invalid LISTEN_PID '%v': %v", pidStr, err)
+	}
+	if pid != os.Getpid() {
+		// The file descriptors are intended for a different process.
+		return nil, nil
+	}
+	nStr := os.Getenv("LISTEN_FDS")
+	n, err := strconv.Atoi(nStr)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("server: invalid LISTEN_FDS '%v'", nStr)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		l, err := fileListener(fd, name)
+		if err != nil {
+			for _, v := range listeners {
+				v.Close()
+			}
+			return nil, fmt.Errorf("server: socket activated fd %v (%v) is not usable: %v", fd, name, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	// The listeners hold duplicates of the passed file descriptors.
+	for i := 0; i < n; i++ {
+		closeFd(listenFdsStart + i)
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return listeners, nil
+}
@@ -0,0 +1,46 @@
+// activation_unix.go - Katzenpost non-voting authority socket activation.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+func fileListener(fd int, name string) (net.Listener, error) {
+	// The file descriptor is duplicated, so that it is left untouched if
+	// any of the passed file descriptors are unusable.
+	dupFd, err := syscall.Dup(fd)
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(dupFd)
+
+	// net.FileListener dups the file descriptor, so the duplicate can be
+	// closed.
+	f := os.NewFile(uintptr(dupFd), name)
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+func closeFd(fd int) {
+	syscall.Close(fd)
+}
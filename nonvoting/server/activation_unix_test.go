@@ -0,0 +1,154 @@
+// activation_unix_test.go - Non-voting authority socket activation tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const activationHelperEnv = "NONVOTING_TEST_ACTIVATION"
+
+// TestActivationHelper is run in a child process by TestListenersFromEnv,
+// which passes the file descriptors to it the way systemd would.  The
+// LISTEN_PID can only be set once the child process exists, so the child
+// sets it itself.
+func TestActivationHelper(t *testing.T) {
+	mode := os.Getenv(activationHelperEnv)
+	if mode == "" {
+		t.Skip("Only run as a child process of TestListenersFromEnv")
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	if err := activationHelper(mode); err != nil {
+		fmt.Fprintf(os.Stderr, "activation helper: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func activationHelper(mode string) error {
+	listeners, err := ListenersFromEnv()
+	switch mode {
+	case "ok":
+		if err != nil {
+			return err
+		}
+		if len(listeners) != 1 {
+			return fmt.Errorf("got %v listeners", len(listeners))
+		}
+		defer listeners[0].Close()
+		if v := os.Getenv("LISTEN_FDS"); v != "" {
+			return fmt.Errorf("LISTEN_FDS not unset: '%v'", v)
+		}
+
+		// The listener accepts connections on the passed socket.
+		conn, err := listeners[0].Accept()
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write([]byte("ok"))
+		conn.Close()
+		return err
+	case "bad":
+		if err == nil {
+			return fmt.Errorf("unusable fd accepted")
+		}
+
+		// Nothing is consumed on failure, so the passed socket is
+		// still usable.
+		if v := os.Getenv("LISTEN_FDS"); v != "2" {
+			return fmt.Errorf("LISTEN_FDS not retained: '%v'", v)
+		}
+		if os.Getenv("LISTEN_PID") == "" {
+			return fmt.Errorf("LISTEN_PID not retained")
+		}
+		l, err := net.FileListener(os.NewFile(listenFdsStart, "socket"))
+		if err != nil {
+			return fmt.Errorf("passed fd closed on failure: %v", err)
+		}
+		return l.Close()
+	default:
+		return fmt.Errorf("invalid mode: '%v'", mode)
+	}
+}
+
+func runActivationHelper(t *testing.T, mode string, files ...*os.File) ([]byte, error) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestActivationHelper$")
+	cmd.Env = append(os.Environ(),
+		activationHelperEnv+"="+mode,
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES=authority",
+	)
+	cmd.ExtraFiles = files
+	return cmd.CombinedOutput()
+}
+
+func TestListenersFromEnv(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "net.Listen()")
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(err, "File()")
+	defer f.Close()
+
+	// The passed socket is accepted on by the child.
+	errCh := make(chan error, 1)
+	go func() {
+		out, err := runActivationHelper(t, "ok", f)
+		if err != nil {
+			err = fmt.Errorf("%v: %s", err, out)
+		}
+		errCh <- err
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(err, "net.Dial()")
+	b, err := ioutil.ReadAll(conn)
+	conn.Close()
+	require.NoError(err, "ReadAll()")
+	assert.Equal("ok", string(b), "Accepted by child")
+	assert.NoError(<-errCh, "Child: ok")
+
+	// A file descriptor that is not a socket fails, without consuming the
+	// environment or the usable file descriptors.
+	notSocket, err := ioutil.TempFile("", "authority-test-")
+	require.NoError(err, "TempFile()")
+	defer os.Remove(notSocket.Name())
+	defer notSocket.Close()
+	out, err := runActivationHelper(t, "bad", f, notSocket)
+	assert.NoError(err, "Child: bad: %s", out)
+
+	// Without LISTEN_PID, the process is not socket activated.
+	os.Unsetenv("LISTEN_PID")
+	listeners, err := ListenersFromEnv()
+	assert.NoError(err, "ListenersFromEnv(): not activated")
+	assert.Nil(listeners, "ListenersFromEnv(): not activated")
+}
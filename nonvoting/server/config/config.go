@@ -37,6 +37,9 @@ const (
 	defaultLogLevel         = "NOTICE"
 	defaultLayers           = 3
 	defaultMinNodesPerLayer = 2
+	defaultMinProviders     = 1
+	defaultMaxLayerChurn    = 1.0
+	defaultMaxConnections   = 1024
 	absoluteMaxDelay        = 6 * 60 * 60 * 1000 // 6 hours.
 
 	// Note: These values are picked primarily for debugging and need to
@@ -55,24 +58,73 @@ var defaultLogging = Logging{
 	Level:   defaultLogLevel,
 }
 
+const (
+	// RoleFetch is the listener role that allows fetching documents.
+	RoleFetch = "fetch"
+
+	// RoleUpload is the listener role that allows nodes to upload, and
+	// query the status of their descriptors.
+	RoleUpload = "upload"
+
+	// RoleAdmin is the listener role that allows querying the authority's
+	// status.  Admin listeners accept connections from peers without an
+	// identity key, and should only be bound to a trusted network.
+	RoleAdmin = "admin"
+)
+
 // Authority is the authority configuration.
 type Authority struct {
 	// Addresses are the IP address/port combinations that the authority will
-	// bind to for incoming connections.
+	// bind to for incoming connections, with the fetch and upload roles.
 	Addresses []string
 
-	// DataDir is the absolute path to the authority's state files.
+	// Listeners are additional listeners, each restricted to a set of
+	// roles.
+	Listeners []*Listener
+
+	// DataDir is the absolute path to the authority's state files.  It may
+	// be omitted iff the persistence store, identity key, and log backend
+	// are all provided to the server by other means.
 	DataDir string
+
+	// ReadOnly opens the snapshot of the persistence store, that the
+	// instance that owns the DataDir refreshes each time it generates a
+	// document, and serves the persisted documents without accepting
+	// descriptors or generating new documents.  This is intended for
+	// inspecting the state of an authority without taking ownership of the
+	// DataDir, so the Addresses are not bound, and only the Listeners are.
+	ReadOnly bool
+
+	// MaxConnections is the maximum number of concurrent connections,
+	// beyond which new connections are closed immediately.  Long-poll
+	// requests hold their connection, so this bounds the resources they may
+	// consume.  If unset, a reasonable default is used.
+	MaxConnections int
 }
 
 func (sCfg *Authority) validate() error {
+	addrMap := make(map[string]bool)
 	if sCfg.Addresses != nil {
 		for _, v := range sCfg.Addresses {
 			if err := utils.EnsureAddrIPPort(v); err != nil {
 				return fmt.Errorf("config: Authority: Address '%v' is invalid: %v", v, err)
 			}
+			if addrMap[v] {
+				return fmt.Errorf("config: Authority: Address '%v' is present more than once", v)
+			}
+			addrMap[v] = true
 		}
-	} else {
+	}
+	for _, v := range sCfg.Listeners {
+		if err := v.validate(); err != nil {
+			return err
+		}
+		if addrMap[v.Address] {
+			return fmt.Errorf("config: Authority: Address '%v' is present more than once", v.Address)
+		}
+		addrMap[v.Address] = true
+	}
+	if sCfg.Addresses == nil && sCfg.Listeners == nil {
 		// Try to guess a "suitable" external IPv4 address.  If people want
 		// to do loopback testing, they can manually specify one.  If people
 		// want to use IPng, they can manually specify that as well.
@@ -82,12 +134,45 @@ func (sCfg *Authority) validate() error {
 		}
 		sCfg.Addresses = []string{addr.String() + defaultAddress}
 	}
-	if !filepath.IsAbs(sCfg.DataDir) {
+	switch {
+	case sCfg.MaxConnections < 0:
+		return fmt.Errorf("config: Authority: MaxConnections %v is invalid", sCfg.MaxConnections)
+	case sCfg.MaxConnections == 0:
+		sCfg.MaxConnections = defaultMaxConnections
+	}
+	if sCfg.DataDir != "" && !filepath.IsAbs(sCfg.DataDir) {
 		return fmt.Errorf("config: Authority: DataDir '%v' is not an absolute path", sCfg.DataDir)
 	}
 	return nil
 }
 
+// Listener is a listener with a restricted set of roles.
+type Listener struct {
+	// Address is the IP address/port combination to bind to.
+	Address string
+
+	// Roles is the list of roles that the listener is allowed, and must
+	// consist of RoleFetch, RoleUpload, and RoleAdmin.
+	Roles []string
+}
+
+func (lCfg *Listener) validate() error {
+	if err := utils.EnsureAddrIPPort(lCfg.Address); err != nil {
+		return fmt.Errorf("config: Authority: Listener Address '%v' is invalid: %v", lCfg.Address, err)
+	}
+	if len(lCfg.Roles) == 0 {
+		return fmt.Errorf("config: Authority: Listener '%v' has no Roles", lCfg.Address)
+	}
+	for _, v := range lCfg.Roles {
+		switch v {
+		case RoleFetch, RoleUpload, RoleAdmin:
+		default:
+			return fmt.Errorf("config: Authority: Listener '%v' Role '%v' is invalid", lCfg.Address, v)
+		}
+	}
+	return nil
+}
+
 // Logging is the authority logging configuration.
 type Logging struct {
 	// Disable disables logging entirely.
@@ -170,16 +255,103 @@ func (pCfg *Parameters) applyDefaults() {
 	}
 }
 
+// Topology is the network topology configuration.
+type Topology struct {
+	// Layers is the number of non-provider layers in the network topology.
+	//
+	// Changing this across restarts is supported, nodes from removed layers
+	// will be redistributed, and new layers will be seeded from the
+	// remaining nodes.
+	Layers int
+
+	// MinNodesPerLayer is the minimum number of nodes per layer required to
+	// form a valid Document.
+	MinNodesPerLayer int
+
+	// MaxNodesPerLayer is the maximum number of nodes per layer, with any
+	// surplus nodes kept on standby outside of the published topology, to
+	// be promoted when active nodes fail to upload a descriptor.  If left
+	// unset, there is no limit.
+	MaxNodesPerLayer int
+
+	// MinProviders is the minimum number of providers required to form a
+	// valid Document, which may be 0.  If unset, a single provider is
+	// required.
+	MinProviders *int
+
+	// MaxLayerChurn is the maximum fraction [0, 1] of the nodes present in
+	// the previous Document that may change layers in the next Document.
+	// If unset, there is no limit.
+	//
+	// Moves that are required to keep every layer within
+	// LayerBalanceTolerance of the balanced layer size are always made, so
+	// this requires LayerBalanceTolerance to also be set.
+	MaxLayerChurn *float64
+
+	// LayerBalanceTolerance is the number of nodes by which a layer may
+	// deviate from the balanced layer size, when limiting layer churn.
+	LayerBalanceTolerance int
+}
+
+func (tCfg *Topology) validate() error {
+	if tCfg.Layers > defaultLayers {
+		// This is a limitation of the Sphinx implementation.
+		return fmt.Errorf("config: Topology: Layers %v exceeds maximum", tCfg.Layers)
+	}
+	minNodesPerLayer := tCfg.MinNodesPerLayer
+	if minNodesPerLayer <= 0 {
+		minNodesPerLayer = defaultMinNodesPerLayer
+	}
+	if tCfg.MaxNodesPerLayer < 0 || (tCfg.MaxNodesPerLayer > 0 && tCfg.MaxNodesPerLayer < minNodesPerLayer) {
+		return fmt.Errorf("config: Topology: MaxNodesPerLayer %v is invalid", tCfg.MaxNodesPerLayer)
+	}
+	if v := tCfg.MinProviders; v != nil && *v < 0 {
+		return fmt.Errorf("config: Topology: MinProviders %v is invalid", *v)
+	}
+	if v := tCfg.MaxLayerChurn; v != nil && !(*v >= 0 && *v <= 1) {
+		return fmt.Errorf("config: Topology: MaxLayerChurn %v is out of range", *v)
+	}
+	if tCfg.LayerBalanceTolerance < 0 {
+		return fmt.Errorf("config: Topology: LayerBalanceTolerance %v is invalid", tCfg.LayerBalanceTolerance)
+	}
+	if tCfg.MaxLayerChurn != nil && tCfg.LayerBalanceTolerance == 0 {
+		// Every layer must be balanced, so there is no churn to limit.
+		return fmt.Errorf("config: Topology: MaxLayerChurn requires LayerBalanceTolerance")
+	}
+	return nil
+}
+
+func (tCfg *Topology) applyDefaults() {
+	if tCfg.Layers <= 0 {
+		tCfg.Layers = defaultLayers
+	}
+	if tCfg.MinNodesPerLayer <= 0 {
+		tCfg.MinNodesPerLayer = defaultMinNodesPerLayer
+	}
+	if tCfg.MinProviders == nil {
+		v := defaultMinProviders
+		tCfg.MinProviders = &v
+	}
+	if tCfg.MaxLayerChurn == nil {
+		v := defaultMaxLayerChurn
+		tCfg.MaxLayerChurn = &v
+	}
+}
+
 // Debug is the authority debug configuration.
 type Debug struct {
 	// IdentityKey specifies the identity private key.
 	IdentityKey *eddsa.PrivateKey `toml:"-"`
 
 	// Layers is the number of non-provider layers in the network topology.
+	//
+	// Deprecated: Use Topology.Layers instead.
 	Layers int
 
 	// MinNodesPerLayer is the minimum number of nodes per layer required to
 	// form a valid Document.
+	//
+	// Deprecated: Use Topology.MinNodesPerLayer instead.
 	MinNodesPerLayer int
 
 	// GenerateOnly halts and cleans up the server right after long term
@@ -187,21 +359,22 @@ type Debug struct {
 	GenerateOnly bool
 }
 
-func (dCfg *Debug) validate() error {
-	if dCfg.Layers > defaultLayers {
-		// This is a limitation of the Sphinx implementation.
-		return fmt.Errorf("config: Debug: Layers %v exceeds maximum", dCfg.Layers)
-	}
-	return nil
-}
-
-func (dCfg *Debug) applyDefaults() {
-	if dCfg.Layers <= 0 {
-		dCfg.Layers = defaultLayers
+func (dCfg *Debug) migrateTopology(tCfg *Topology) error {
+	// Carry the deprecated values over to the Topology section, so that
+	// existing config files keep working.
+	if dCfg.Layers != 0 {
+		if tCfg.Layers != 0 && tCfg.Layers != dCfg.Layers {
+			return fmt.Errorf("config: Debug: Layers conflicts with Topology: Layers")
+		}
+		tCfg.Layers = dCfg.Layers
 	}
-	if dCfg.MinNodesPerLayer <= 0 {
-		dCfg.MinNodesPerLayer = defaultMinNodesPerLayer
+	if dCfg.MinNodesPerLayer != 0 {
+		if tCfg.MinNodesPerLayer != 0 && tCfg.MinNodesPerLayer != dCfg.MinNodesPerLayer {
+			return fmt.Errorf("config: Debug: MinNodesPerLayer conflicts with Topology: MinNodesPerLayer")
+		}
+		tCfg.MinNodesPerLayer = dCfg.MinNodesPerLayer
 	}
+	return nil
 }
 
 // Node is an authority mix node or provider entry.
@@ -240,6 +413,7 @@ type Config struct {
 	Authority  *Authority
 	Logging    *Logging
 	Parameters *Parameters
+	Topology   *Topology
 	Debug      *Debug
 
 	Mixes     []*Node
@@ -260,9 +434,15 @@ func (cfg *Config) FixupAndValidate() error {
 	if cfg.Parameters == nil {
 		cfg.Parameters = &Parameters{}
 	}
+	if cfg.Topology == nil {
+		cfg.Topology = &Topology{}
+	}
 	if cfg.Debug == nil {
 		cfg.Debug = &Debug{}
 	}
+	if err := cfg.Debug.migrateTopology(cfg.Topology); err != nil {
+		return err
+	}
 
 	// Validate and fixup the various sections.
 	if err := cfg.Authority.validate(); err != nil {
@@ -274,11 +454,11 @@ func (cfg *Config) FixupAndValidate() error {
 	if err := cfg.Parameters.validate(); err != nil {
 		return err
 	}
-	if err := cfg.Debug.validate(); err != nil {
+	if err := cfg.Topology.validate(); err != nil {
 		return err
 	}
 	cfg.Parameters.applyDefaults()
-	cfg.Debug.applyDefaults()
+	cfg.Topology.applyDefaults()
 
 	allNodes := make([]*Node, 0, len(cfg.Mixes)+len(cfg.Providers))
 	for _, v := range cfg.Mixes {
@@ -0,0 +1,79 @@
+// config_test.go - Katzenpost non-voting authority server config tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateTopology(t *testing.T) {
+	assert := assert.New(t)
+
+	// The deprecated values are carried over to the Topology section.
+	tCfg := &Topology{}
+	dCfg := &Debug{Layers: 2, MinNodesPerLayer: 3}
+	assert.NoError(dCfg.migrateTopology(tCfg), "migrateTopology()")
+	assert.Equal(2, tCfg.Layers, "Layers")
+	assert.Equal(3, tCfg.MinNodesPerLayer, "MinNodesPerLayer")
+
+	// Matching values in both sections are fine.
+	tCfg = &Topology{Layers: 2}
+	assert.NoError(dCfg.migrateTopology(tCfg), "migrateTopology(): matching")
+	assert.Equal(3, tCfg.MinNodesPerLayer, "MinNodesPerLayer: matching")
+
+	// The Topology section is left alone if the deprecated values are
+	// unset.
+	tCfg = &Topology{Layers: 4, MinNodesPerLayer: 1}
+	assert.NoError((&Debug{}).migrateTopology(tCfg), "migrateTopology(): unset")
+	assert.Equal(&Topology{Layers: 4, MinNodesPerLayer: 1}, tCfg, "Topology: unset")
+
+	// Conflicting values are rejected.
+	assert.Error((&Debug{Layers: 3}).migrateTopology(&Topology{Layers: 2}), "migrateTopology(): Layers conflict")
+	assert.Error((&Debug{MinNodesPerLayer: 3}).migrateTopology(&Topology{MinNodesPerLayer: 2}), "migrateTopology(): MinNodesPerLayer conflict")
+}
+
+func TestTopologyValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	churn, minProviders := 0.5, 0
+	for _, v := range []struct {
+		name  string
+		tCfg  Topology
+		valid bool
+	}{
+		{"Defaults", Topology{}, true},
+		{"MaxLayerChurn", Topology{MaxLayerChurn: &churn, LayerBalanceTolerance: 1}, true},
+		{"MaxLayerChurn without LayerBalanceTolerance", Topology{MaxLayerChurn: &churn}, false},
+		{"Zero MinProviders", Topology{MinProviders: &minProviders}, true},
+		{"MaxNodesPerLayer below MinNodesPerLayer", Topology{MinNodesPerLayer: 3, MaxNodesPerLayer: 2}, false},
+	} {
+		err := v.tCfg.validate()
+		if v.valid {
+			assert.NoError(err, v.name)
+		} else {
+			assert.Error(err, v.name)
+		}
+	}
+
+	// The defaults do not override explicitly set values.
+	tCfg := &Topology{MinProviders: &minProviders}
+	tCfg.applyDefaults()
+	assert.Equal(0, *tCfg.MinProviders, "MinProviders: explicit zero")
+	assert.Equal(defaultMaxLayerChurn, *tCfg.MaxLayerChurn, "MaxLayerChurn: default")
+}
@@ -0,0 +1,273 @@
+// events.go - Katzenpost non-voting authority events.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/pki"
+)
+
+// defaultEventBufferSize is the number of events buffered per subscription
+// if no buffer size is specified.
+const defaultEventBufferSize = 64
+
+// Event is an authority state change event, one of DescriptorAcceptedEvent,
+// DescriptorRejectedEvent, DocumentGeneratedEvent, NodeMissingEvent, or
+// FatalErrorEvent.
+type Event interface {
+	isEvent()
+}
+
+// DescriptorAcceptedEvent is the event emitted when a node's descriptor is
+// accepted.
+type DescriptorAcceptedEvent struct {
+	// Epoch is the epoch that the descriptor is for.
+	Epoch uint64
+
+	// IdentityKey is the node's identity key.
+	IdentityKey *eddsa.PublicKey
+
+	// Revision is the revision of the descriptor.
+	Revision uint64
+
+	// Replaced is true iff the descriptor replaced a lower revision.
+	Replaced bool
+
+	// Raw is the signed descriptor.
+	Raw []byte
+}
+
+// RejectReason is the reason a descriptor upload was rejected.
+type RejectReason int
+
+const (
+	// RejectInvalid is the reason for malformed descriptors, and descriptors
+	// for invalid epochs.
+	RejectInvalid RejectReason = iota
+
+	// RejectForbidden is the reason for descriptors from unauthorized
+	// nodes, or ones not signed by the uploading node.
+	RejectForbidden
+
+	// RejectConflict is the reason for descriptors that conflict with the
+	// one that is held.
+	RejectConflict
+
+	// RejectLate is the reason for descriptors uploaded after the Document
+	// for the epoch was generated.
+	RejectLate
+
+	// RejectReadOnly is the reason for descriptors uploaded to a read-only
+	// authority.
+	RejectReadOnly
+
+	// RejectInternal is the reason for descriptors rejected due to an
+	// internal error.
+	RejectInternal
+
+	// RejectUnsupportedVersion is the reason for descriptors in a format
+	// that the authority does not support, as posted by nodes that need to
+	// be upgraded.  Legacy nodes are only told that the descriptor is
+	// invalid.
+	RejectUnsupportedVersion
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectInvalid:
+		return "invalid"
+	case RejectForbidden:
+		return "forbidden"
+	case RejectConflict:
+		return "conflict"
+	case RejectLate:
+		return "late"
+	case RejectReadOnly:
+		return "read-only"
+	case RejectInternal:
+		return "internal error"
+	case RejectUnsupportedVersion:
+		return "unsupported version"
+	default:
+		return "unknown"
+	}
+}
+
+// DescriptorRejectedEvent is the event emitted when a node's descriptor is
+// rejected.
+type DescriptorRejectedEvent struct {
+	// Epoch is the epoch that the descriptor was posted for.
+	Epoch uint64
+
+	// IdentityKey is the identity key of the node that posted the
+	// descriptor.
+	IdentityKey *eddsa.PublicKey
+
+	// Reason is the reason the descriptor was rejected.
+	Reason RejectReason
+
+	// Err is the detailed cause of the rejection.
+	Err error
+}
+
+// DocumentGeneratedEvent is the event emitted when a Document is generated.
+type DocumentGeneratedEvent struct {
+	// Epoch is the epoch that the Document is for.
+	Epoch uint64
+
+	// Document is the Document.
+	Document *pki.Document
+
+	// Raw is the signed Document.
+	Raw []byte
+
+	// LayerChanges is the number of the ReturningNodes that were assigned
+	// to a different layer than in the previous Document, and is bounded
+	// by Topology.MaxLayerChurn.
+	LayerChanges int
+
+	// ReturningNodes is the number of nodes in the Document's topology that
+	// were also in the previous Document's topology.
+	ReturningNodes int
+}
+
+// NodeMissingEvent is the event emitted for each authorized node that is
+// absent from a generated Document.
+type NodeMissingEvent struct {
+	// Epoch is the epoch of the Document.
+	Epoch uint64
+
+	// IdentityKey is the node's identity key.
+	IdentityKey *eddsa.PublicKey
+
+	// Provider is the node's identifier iff the node is a provider.
+	Provider string
+
+	// Standby is true iff the node posted a descriptor, but was kept on
+	// standby.
+	Standby bool
+}
+
+// FatalErrorEvent is the event emitted when the authority encounters a
+// fatal error, and will shut down.
+type FatalErrorEvent struct {
+	// Err is the fatal error.
+	Err error
+}
+
+func (e *DescriptorAcceptedEvent) isEvent() {}
+func (e *DescriptorRejectedEvent) isEvent() {}
+func (e *DocumentGeneratedEvent) isEvent()  {}
+func (e *NodeMissingEvent) isEvent()        {}
+func (e *FatalErrorEvent) isEvent()         {}
+
+// Subscription is a subscription to the authority's events.
+type Subscription struct {
+	b  *eventBus
+	ch chan Event
+
+	dropped uint64
+}
+
+// C returns the channel that the events are delivered on.  The channel is
+// closed when the subscription is closed, or the Server is shut down.
+func (sub *Subscription) C() <-chan Event {
+	return sub.ch
+}
+
+// Dropped returns the number of events that were discarded as the
+// subscriber was not keeping up.
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// Close terminates the subscription.
+func (sub *Subscription) Close() {
+	sub.b.unsubscribe(sub)
+}
+
+type eventBus struct {
+	sync.Mutex
+
+	subs   map[*Subscription]bool
+	closed bool
+}
+
+func (b *eventBus) subscribe(bufferSize int) *Subscription {
+	if bufferSize <= 0 {
+		bufferSize = defaultEventBufferSize
+	}
+	sub := &Subscription{
+		b:  b,
+		ch: make(chan Event, bufferSize),
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		close(sub.ch)
+	} else {
+		b.subs[sub] = true
+	}
+	return sub
+}
+
+func (b *eventBus) unsubscribe(sub *Subscription) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.subs[sub] {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+func (b *eventBus) publish(ev Event) {
+	b.Lock()
+	defer b.Unlock()
+
+	// Never block the publisher (usually the state worker), slow
+	// subscribers will miss events instead.
+	for sub := range b.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+func (b *eventBus) close() {
+	b.Lock()
+	defer b.Unlock()
+
+	for sub := range b.subs {
+		close(sub.ch)
+	}
+	b.subs = nil
+	b.closed = true
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs: make(map[*Subscription]bool),
+	}
+}
@@ -0,0 +1,244 @@
+// extension.go - Katzenpost non-voting authority wire protocol extensions.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/katzenpost/authority/nonvoting/internal/s11n"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/wire"
+	"github.com/katzenpost/core/wire/commands"
+)
+
+// isExtension returns true iff the command is a wire protocol extension
+// request, as opposed to a descriptor upload.
+func isExtension(cmd commands.Command) bool {
+	c, ok := cmd.(*commands.PostDescriptor)
+	return ok && c.Epoch == s11n.ExtensionEpoch
+}
+
+func (s *Server) onFirstCommand(rAddr net.Addr, wireConn *wire.Session, cmd commands.Command, roles listenerRoles) (*s11n.Capabilities, commands.Command, bool) {
+	// Peers that do not advertise their capabilities are assumed to be
+	// legacy peers.
+	if !isExtension(cmd) {
+		return s11n.LegacyCapabilities(), cmd, true
+	}
+	req, ok := s.parseExtension(rAddr, cmd.(*commands.PostDescriptor))
+	if !ok {
+		return nil, nil, false
+	}
+	if req.Command != s11n.ExtGetCapabilities {
+		return s11n.LegacyCapabilities(), cmd, true
+	}
+
+	peerCaps, resp := s.onGetCapabilities(rAddr, req, roles)
+	if peerCaps == nil {
+		if resp != nil {
+			wireConn.SendCommand(resp)
+		}
+		return nil, nil, false
+	}
+	if err := wireConn.SendCommand(resp); err != nil {
+		s.log.Debugf("Peer %v: Failed to send capabilities: %v", rAddr, err)
+		return nil, nil, false
+	}
+	cmd, err := wireConn.RecvCommand()
+	if err != nil {
+		s.log.Debugf("Peer %v: Failed to receive command: %v", rAddr, err)
+		return nil, nil, false
+	}
+	return peerCaps, cmd, true
+}
+
+func (s *Server) onGetCapabilities(rAddr net.Addr, req *s11n.ExtensionRequest, roles listenerRoles) (*s11n.Capabilities, commands.Command) {
+	peerCaps, err := s11n.ParseCapabilities(req.Payload)
+	if err != nil {
+		s.log.Errorf("Peer %v: Invalid capabilities: %v", rAddr, err)
+		return nil, nil
+	}
+
+	// Tell the peer what is supported, and why the session is being
+	// rejected iff there is nothing in common.
+	caps := s11n.LocalCapabilities()
+	roles.filterFeatures(caps)
+	if err = caps.Negotiate(peerCaps); err != nil {
+		s.log.Errorf("Peer %v: Incompatible capabilities: %v", rAddr, err)
+		caps.Reason = err.Error()
+		peerCaps = nil
+	}
+	b, err := s11n.SerializeCapabilities(caps)
+	if err != nil {
+		// This should basically always succeed.
+		s.log.Errorf("Peer %v: Failed to serialize capabilities: %v", rAddr, err)
+		return nil, nil
+	}
+	resp, ok := s.extensionResponse(rAddr, &s11n.ExtensionResponse{Command: req.Command, Payload: b})
+	if !ok {
+		return nil, nil
+	}
+
+	if peerCaps != nil {
+		s.log.Debugf("Peer %v: Capabilities: %+v", rAddr, peerCaps)
+	}
+	return peerCaps, resp
+}
+
+// onExtension handles a wire protocol extension request, and returns the
+// response, and false iff the session should be terminated without a
+// response.
+func (s *Server) onExtension(rAddr net.Addr, cmd *commands.PostDescriptor, roles listenerRoles, auth *wireAuthenticator) (commands.Command, bool) {
+	req, ok := s.parseExtension(rAddr, cmd)
+	if !ok {
+		return nil, false
+	}
+
+	// Reject commands that are not allowed on this listener, prior to doing
+	// anything else with them.
+	if !roles.allowsExtension(req.Command) {
+		s.log.Errorf("Peer %v: Extension '%v' not allowed on listener (%v).", rAddr, req.Command, roles)
+		return nil, false
+	}
+
+	switch req.Command {
+	case s11n.ExtGetCapabilities:
+		// Capabilities can only be exchanged before any other command.
+		s.log.Errorf("Peer %v: Capabilities exchanged mid-session.", rAddr)
+		return nil, false
+	case s11n.ExtGetConsensusRange:
+		return s.onGetConsensusRange(rAddr, req)
+	case s11n.ExtGetConsensusWait:
+		return s.onGetConsensusWait(rAddr, req)
+	case s11n.ExtGetDescriptorStatus:
+		if auth.peerIdentityKey == nil {
+			// Clients have no descriptors, so this is also actively evil.
+			s.log.Errorf("Peer %v: Not allowed to query descriptor status.", rAddr)
+			return nil, false
+		}
+		return s.onGetDescriptorStatus(rAddr, req, auth.peerIdentityKey)
+	case s11n.ExtGetAuthorityStatus:
+		return s.onGetAuthorityStatus(rAddr, req)
+	default:
+		s.log.Debugf("Peer %v: Invalid extension request: '%v'", rAddr, req.Command)
+		return nil, false
+	}
+}
+
+func (s *Server) onGetDescriptorStatus(rAddr net.Addr, req *s11n.ExtensionRequest, pubKey *eddsa.PublicKey) (commands.Command, bool) {
+	statuses := s.state.descriptorStatus(pubKey)
+	b, err := s11n.SerializeDescriptorStatus(statuses)
+	if err != nil {
+		// This should basically always succeed.
+		s.log.Errorf("Peer %v: Failed to serialize descriptor status: %v", rAddr, err)
+		return nil, false
+	}
+
+	s.log.Debugf("Peer %v: Serving descriptor status for %v epoch(s).", rAddr, len(statuses))
+	return s.extensionResponse(rAddr, &s11n.ExtensionResponse{Command: req.Command, Payload: b})
+}
+
+func (s *Server) onGetAuthorityStatus(rAddr net.Addr, req *s11n.ExtensionRequest) (commands.Command, bool) {
+	r := s.ReadinessReport()
+	if r == nil {
+		// The Server is shutting down.
+		return nil, false
+	}
+	b, err := s11n.SerializeAuthorityStatus(&s11n.AuthorityStatus{
+		Epoch:  r.Epoch,
+		Ready:  r.IsReady(),
+		Report: r.String(),
+	})
+	if err != nil {
+		// This should basically always succeed.
+		s.log.Errorf("Peer %v: Failed to serialize authority status: %v", rAddr, err)
+		return nil, false
+	}
+
+	s.log.Debugf("Peer %v: Serving authority status for epoch %v.", rAddr, r.Epoch)
+	return s.extensionResponse(rAddr, &s11n.ExtensionResponse{Command: req.Command, Payload: b})
+}
+
+func (s *Server) onGetConsensusRange(rAddr net.Addr, req *s11n.ExtensionRequest) (commands.Command, bool) {
+	epochs := consensusRangeEpochs(req.Epoch, req.EndEpoch)
+	if epochs == nil {
+		s.log.Errorf("Peer %v: Invalid consensus range: %v-%v", rAddr, req.Epoch, req.EndEpoch)
+		return nil, false
+	}
+
+	entries := make([]*s11n.ConsensusRangeEntry, 0, len(epochs))
+	for _, epoch := range epochs {
+		e := &s11n.ConsensusRangeEntry{Epoch: epoch}
+		e.ErrorCode, e.Payload = s.consensusForEpoch(rAddr, epoch)
+		entries = append(entries, e)
+	}
+	b, err := s11n.SerializeConsensusRange(entries)
+	if err != nil {
+		// This should basically always succeed.
+		s.log.Errorf("Peer %v: Failed to serialize consensus range: %v", rAddr, err)
+		return nil, false
+	}
+	return s.extensionResponse(rAddr, &s11n.ExtensionResponse{Command: req.Command, Payload: b})
+}
+
+func (s *Server) onGetConsensusWait(rAddr net.Addr, req *s11n.ExtensionRequest) (commands.Command, bool) {
+	// Bound the amount of time a request is held, peers that want to wait
+	// longer are expected to re-issue the request.
+	const maxWait = 5 * time.Minute
+
+	// Only wait if the document may eventually be generated.
+	if _, err := s.state.documentForEpoch(req.Epoch); err == errNotYet {
+		wait := time.Duration(req.Timeout) * time.Second
+		if wait > maxWait {
+			wait = maxWait
+		}
+		s.log.Debugf("Peer %v: Waiting up to %v for document for epoch %v.", rAddr, wait, req.Epoch)
+
+		t := time.NewTimer(wait)
+		select {
+		case <-s.state.documentPublishedCh(req.Epoch):
+		case <-t.C:
+		case <-s.haltingCh:
+		}
+		t.Stop()
+	}
+
+	resp := &s11n.ExtensionResponse{Command: req.Command}
+	resp.ErrorCode, resp.Payload = s.consensusForEpoch(rAddr, req.Epoch)
+	return s.extensionResponse(rAddr, resp)
+}
+
+func (s *Server) parseExtension(rAddr net.Addr, cmd *commands.PostDescriptor) (*s11n.ExtensionRequest, bool) {
+	req, err := s11n.ParseExtensionRequest(cmd.Payload)
+	if err != nil {
+		s.log.Errorf("Peer %v: Invalid extension request: %v", rAddr, err)
+		return nil, false
+	}
+	return req, true
+}
+
+// extensionResponse returns the command that carries the wire protocol
+// extension response.
+func (s *Server) extensionResponse(rAddr net.Addr, resp *s11n.ExtensionResponse) (commands.Command, bool) {
+	b, err := s11n.SerializeExtensionResponse(resp)
+	if err != nil {
+		// This should basically always succeed.
+		s.log.Errorf("Peer %v: Failed to serialize extension response: %v", rAddr, err)
+		return nil, false
+	}
+	return &commands.Consensus{ErrorCode: commands.ConsensusOk, Payload: b}, true
+}
@@ -0,0 +1,325 @@
+// extension_test.go - Non-voting authority wire protocol extension tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/authority/nonvoting/internal/s11n"
+	"github.com/katzenpost/authority/nonvoting/server/config"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/wire/commands"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testPeerAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2323}
+
+func newExtensionTestServer(t *testing.T) *Server {
+	logBackend, err := log.New("", "DEBUG", true)
+	require.NoError(t, err, "log.New()")
+	return &Server{log: logBackend.GetLogger("authority")}
+}
+
+func newExtensionRequest(t *testing.T, req *s11n.ExtensionRequest) *commands.PostDescriptor {
+	b, err := s11n.SerializeExtensionRequest(req)
+	require.NoError(t, err, "SerializeExtensionRequest()")
+	return &commands.PostDescriptor{Epoch: s11n.ExtensionEpoch, Payload: b}
+}
+
+// parseExtensionResponse returns the extension response carried by the
+// command.
+func parseExtensionResponse(t *testing.T, cmd commands.Command) *s11n.ExtensionResponse {
+	c, ok := cmd.(*commands.Consensus)
+	require.True(t, ok, "Extension response: %T", cmd)
+	require.Equal(t, uint8(commands.ConsensusOk), c.ErrorCode, "Extension response: ErrorCode")
+	resp, err := s11n.ParseExtensionResponse(c.Payload)
+	require.NoError(t, err, "ParseExtensionResponse()")
+	return resp
+}
+
+func TestIsExtension(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(isExtension(&commands.PostDescriptor{Epoch: s11n.ExtensionEpoch}), "Extension")
+	assert.False(isExtension(&commands.PostDescriptor{Epoch: 23}), "Descriptor")
+	assert.False(isExtension(&commands.GetConsensus{Epoch: s11n.ExtensionEpoch}), "GetConsensus")
+}
+
+func TestOnGetCapabilities(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	s := newExtensionTestServer(t)
+
+	b, err := s11n.SerializeCapabilities(s11n.LocalCapabilities())
+	require.NoError(err, "SerializeCapabilities()")
+	req := &s11n.ExtensionRequest{Command: s11n.ExtGetCapabilities, Payload: b}
+
+	// The advertised features depend on the listener's roles.
+	peerCaps, resp := s.onGetCapabilities(testPeerAddr, req, roleFetch)
+	require.NotNil(peerCaps, "onGetCapabilities(): peerCaps")
+	assert.Equal(s11n.LocalCapabilities(), peerCaps, "onGetCapabilities(): peerCaps")
+	ext := parseExtensionResponse(t, resp)
+	assert.Equal(s11n.ExtGetCapabilities, ext.Command, "Command")
+	caps, err := s11n.ParseCapabilities(ext.Payload)
+	require.NoError(err, "ParseCapabilities()")
+	assert.Empty(caps.Reason, "Reason")
+	assert.True(caps.HasFeature(s11n.FeatureConsensusRange), "Fetch: FeatureConsensusRange")
+	assert.False(caps.HasFeature(s11n.FeatureDescriptorStatus), "Fetch: FeatureDescriptorStatus")
+
+	// Peers with nothing in common are told why.
+	b, err = s11n.SerializeCapabilities(&s11n.Capabilities{DocumentVersions: []string{"bogus"}})
+	require.NoError(err, "SerializeCapabilities()")
+	req.Payload = b
+	peerCaps, resp = s.onGetCapabilities(testPeerAddr, req, defaultRoles)
+	assert.Nil(peerCaps, "Incompatible: peerCaps")
+	caps, err = s11n.ParseCapabilities(parseExtensionResponse(t, resp).Payload)
+	require.NoError(err, "ParseCapabilities()")
+	assert.NotEmpty(caps.Reason, "Incompatible: Reason")
+
+	// Malformed capabilities terminate the session.
+	req.Payload = []byte("bogus")
+	peerCaps, resp = s.onGetCapabilities(testPeerAddr, req, defaultRoles)
+	assert.Nil(peerCaps, "Malformed: peerCaps")
+	assert.Nil(resp, "Malformed: resp")
+}
+
+func TestOnExtensionInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newExtensionTestServer(t)
+	auth := &wireAuthenticator{s: s, roles: defaultRoles}
+
+	for _, v := range []struct {
+		name string
+		cmd  *commands.PostDescriptor
+	}{
+		{"Malformed", &commands.PostDescriptor{Epoch: s11n.ExtensionEpoch, Payload: []byte("bogus")}},
+		{"Unknown", newExtensionRequest(t, &s11n.ExtensionRequest{Command: "bogus"})},
+		{"Mid-session capabilities", newExtensionRequest(t, &s11n.ExtensionRequest{Command: s11n.ExtGetCapabilities})},
+	} {
+		resp, ok := s.onExtension(testPeerAddr, v.cmd, defaultRoles, auth)
+		assert.False(ok, "%v: ok", v.name)
+		assert.Nil(resp, "%v: resp", v.name)
+	}
+}
+
+func TestOnGetDescriptorStatus(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	st := newTestState(t, &config.Topology{})
+	s := newExtensionTestServer(t)
+	s.state = st
+	nodes := addTestDescriptors(t, st, testEpoch, 0, 2)
+	cmd := newExtensionRequest(t, &s11n.ExtensionRequest{Command: s11n.ExtGetDescriptorStatus})
+
+	// Nodes are told about their own descriptors.
+	auth := &wireAuthenticator{s: s, roles: defaultRoles, peerIdentityKey: nodes[0].desc.IdentityKey}
+	resp, ok := s.onExtension(testPeerAddr, cmd, defaultRoles, auth)
+	require.True(ok, "onExtension()")
+	ext := parseExtensionResponse(t, resp)
+	assert.Equal(s11n.ExtGetDescriptorStatus, ext.Command, "Command")
+	statuses, err := s11n.ParseDescriptorStatus(ext.Payload)
+	require.NoError(err, "ParseDescriptorStatus()")
+	require.Len(statuses, 1, "Statuses")
+	assert.Equal(uint64(testEpoch), statuses[0].Epoch, "Epoch")
+	assert.Equal(s11n.DescriptorHash(nodes[0].raw), statuses[0].Hash, "Hash")
+	assert.False(statuses[0].HasDocument, "HasDocument")
+
+	// Clients have no descriptors, and fetch-only listeners do not serve
+	// descriptor status.
+	resp, ok = s.onExtension(testPeerAddr, cmd, defaultRoles, &wireAuthenticator{s: s, roles: defaultRoles})
+	assert.False(ok, "Anonymous: ok")
+	assert.Nil(resp, "Anonymous: resp")
+	resp, ok = s.onExtension(testPeerAddr, cmd, roleFetch, auth)
+	assert.False(ok, "Fetch: ok")
+	assert.Nil(resp, "Fetch: resp")
+}
+
+func TestOnGetConsensusRange(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	st := newTestState(t, &config.Topology{})
+	s := newExtensionTestServer(t)
+	s.state = st
+	s.clock = &testClock{epoch: testEpoch, till: 2 * time.Hour}
+	st.s = s
+	setTestDocument(st, testEpoch, nil)
+	st.documents[testEpoch].raw = []byte("not actually a document")
+	auth := &wireAuthenticator{s: s, roles: defaultRoles}
+
+	cmd := newExtensionRequest(t, &s11n.ExtensionRequest{
+		Command:  s11n.ExtGetConsensusRange,
+		Epoch:    testEpoch - 1,
+		EndEpoch: testEpoch + 1,
+	})
+	resp, ok := s.onExtension(testPeerAddr, cmd, roleFetch, auth)
+	require.True(ok, "onExtension()")
+	ext := parseExtensionResponse(t, resp)
+	assert.Equal(s11n.ExtGetConsensusRange, ext.Command, "Command")
+	entries, err := s11n.ParseConsensusRange(ext.Payload)
+	require.NoError(err, "ParseConsensusRange()")
+	require.Len(entries, 3, "Entries")
+	for i, v := range []struct {
+		errorCode uint8
+		payload   []byte
+	}{
+		{commands.ConsensusGone, nil},
+		{commands.ConsensusOk, st.documents[testEpoch].raw},
+		{commands.ConsensusNotFound, nil},
+	} {
+		assert.Equal(uint64(testEpoch-1+i), entries[i].Epoch, "[%d]: Epoch", i)
+		assert.Equal(v.errorCode, entries[i].ErrorCode, "[%d]: ErrorCode", i)
+		assert.Equal(v.payload, entries[i].Payload, "[%d]: Payload", i)
+	}
+
+	// Upload-only listeners do not serve Documents.
+	resp, ok = s.onExtension(testPeerAddr, cmd, roleUpload, auth)
+	assert.False(ok, "Upload: ok")
+	assert.Nil(resp, "Upload: resp")
+
+	// Invalid requests terminate the session, rather than leaving peers
+	// that reuse sessions waiting on a response that never comes.
+	cmd = newExtensionRequest(t, &s11n.ExtensionRequest{
+		Command:  s11n.ExtGetConsensusRange,
+		Epoch:    2,
+		EndEpoch: 1,
+	})
+	resp, ok = s.onExtension(testPeerAddr, cmd, roleFetch, auth)
+	assert.False(ok, "Inverted range: ok")
+	assert.Nil(resp, "Inverted range: resp")
+}
+
+func TestOnGetConsensusWait(t *testing.T) {
+	assert := assert.New(t)
+
+	st := newTestState(t, &config.Topology{})
+	s := newExtensionTestServer(t)
+	s.state = st
+	s.clock = &testClock{epoch: testEpoch, till: 2 * time.Hour}
+	st.s = s
+	st.docWaiters = make(map[uint64]chan interface{})
+	auth := &wireAuthenticator{s: s, roles: defaultRoles}
+
+	onWait := func(epoch uint64, timeout uint32) *s11n.ExtensionResponse {
+		cmd := newExtensionRequest(t, &s11n.ExtensionRequest{
+			Command: s11n.ExtGetConsensusWait,
+			Epoch:   epoch,
+			Timeout: timeout,
+		})
+		resp, ok := s.onExtension(testPeerAddr, cmd, roleFetch, auth)
+		require.True(t, ok, "onExtension()")
+		return parseExtensionResponse(t, resp)
+	}
+
+	// Documents that will never be generated are not waited for.
+	start := time.Now()
+	resp := onWait(testEpoch, 60)
+	assert.Equal(uint8(commands.ConsensusGone), resp.ErrorCode, "Gone: ErrorCode")
+	assert.True(time.Since(start) < 30*time.Second, "Gone: not held")
+
+	// Documents that may be generated are waited for, till the timeout.
+	resp = onWait(testEpoch+1, 0)
+	assert.Equal(uint8(commands.ConsensusNotFound), resp.ErrorCode, "Timeout: ErrorCode")
+
+	// ... or till the Document is generated.
+	raw := []byte("not actually a document")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		st.Lock()
+		defer st.Unlock()
+		setTestDocument(st, testEpoch+1, nil)
+		st.documents[testEpoch+1].raw = raw
+		st.releaseWaiters()
+	}()
+	resp = onWait(testEpoch+1, 60)
+	assert.Equal(s11n.ExtGetConsensusWait, resp.Command, "Generated: Command")
+	assert.Equal(uint8(commands.ConsensusOk), resp.ErrorCode, "Generated: ErrorCode")
+	assert.Equal(raw, resp.Payload, "Generated: Payload")
+}
+
+func TestOnGetAuthorityStatus(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	minProviders := 1
+	st := newTestState(t, &config.Topology{
+		Layers:           1,
+		MinNodesPerLayer: 2,
+		MinProviders:     &minProviders,
+	})
+	s := newExtensionTestServer(t)
+	s.cfg = st.s.cfg
+	s.state = st
+	s.clock = &testClock{epoch: testEpoch, till: 2 * time.Hour}
+	auth := &wireAuthenticator{s: s, roles: roleAdmin}
+	cmd := newExtensionRequest(t, &s11n.ExtensionRequest{Command: s11n.ExtGetAuthorityStatus})
+
+	onStatus := func() *s11n.AuthorityStatus {
+		resp, ok := s.onExtension(testPeerAddr, cmd, roleAdmin, auth)
+		require.True(ok, "onExtension()")
+		ext := parseExtensionResponse(t, resp)
+		assert.Equal(s11n.ExtGetAuthorityStatus, ext.Command, "Command")
+		status, err := s11n.ParseAuthorityStatus(ext.Payload)
+		require.NoError(err, "ParseAuthorityStatus()")
+		return status
+	}
+
+	// The status is for the epoch that the next Document is for.
+	status := onStatus()
+	assert.Equal(uint64(testEpoch+1), status.Epoch, "Epoch")
+	assert.False(status.Ready, "Ready: empty")
+	assert.Equal(st.readinessReport(testEpoch+1).String(), status.Report, "Report")
+
+	addTestDescriptors(t, st, testEpoch+1, 1, 2)
+	assert.True(onStatus().Ready, "Ready")
+
+	// Only admin listeners serve the status.
+	for _, roles := range []listenerRoles{roleFetch, roleUpload, defaultRoles} {
+		resp, ok := s.onExtension(testPeerAddr, cmd, roles, auth)
+		assert.False(ok, "%v: ok", roles)
+		assert.Nil(resp, "%v: resp", roles)
+	}
+}
+
+func TestListenerRoles(t *testing.T) {
+	assert := assert.New(t)
+
+	admin := rolesFromConfig([]string{config.RoleAdmin})
+	assert.Equal(roleAdmin, admin, "rolesFromConfig(): admin")
+	assert.Equal(config.RoleAdmin, admin.String(), "String(): admin")
+	assert.True(admin.allowsAnonymous(), "allowsAnonymous(): admin")
+	assert.False(admin.allows(&commands.GetConsensus{}), "allows(): admin, GetConsensus")
+	assert.False(admin.allows(&commands.PostDescriptor{}), "allows(): admin, PostDescriptor")
+	assert.True(admin.allowsExtension(s11n.ExtGetCapabilities), "allowsExtension(): admin, capabilities")
+	assert.False(admin.allowsExtension(s11n.ExtGetConsensusRange), "allowsExtension(): admin, range")
+
+	assert.False(roleUpload.allowsAnonymous(), "allowsAnonymous(): upload")
+	assert.Equal("fetch,upload,admin", (defaultRoles | roleAdmin).String(), "String(): all")
+
+	caps := s11n.LocalCapabilities()
+	admin.filterFeatures(caps)
+	assert.Equal([]string{s11n.FeatureSessionReuse, s11n.FeatureAuthorityStatus}, caps.Features, "filterFeatures(): admin")
+	caps = s11n.LocalCapabilities()
+	defaultRoles.filterFeatures(caps)
+	assert.False(caps.HasFeature(s11n.FeatureAuthorityStatus), "filterFeatures(): default")
+}
@@ -0,0 +1,127 @@
+// listener.go - Katzenpost non-voting authority listener roles.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/katzenpost/authority/nonvoting/internal/s11n"
+	"github.com/katzenpost/authority/nonvoting/server/config"
+	"github.com/katzenpost/core/wire/commands"
+)
+
+type listenerRoles uint8
+
+const (
+	roleFetch listenerRoles = 1 << iota
+	roleUpload
+	roleAdmin
+
+	// defaultRoles are the roles of the listeners bound to the
+	// Authority.Addresses.
+	defaultRoles = roleFetch | roleUpload
+)
+
+func rolesFromConfig(roles []string) listenerRoles {
+	var r listenerRoles
+	for _, v := range roles {
+		switch v {
+		case config.RoleFetch:
+			r |= roleFetch
+		case config.RoleUpload:
+			r |= roleUpload
+		case config.RoleAdmin:
+			r |= roleAdmin
+		}
+	}
+	return r
+}
+
+// allows returns true iff the command may be issued on a listener with the
+// roles.  This is checked before any of the command specific processing
+// (eg: descriptor validation) is done.
+func (r listenerRoles) allows(cmd commands.Command) bool {
+	switch cmd.(type) {
+	case *commands.GetConsensus:
+		return r&roleFetch != 0
+	case *commands.PostDescriptor:
+		return r&roleUpload != 0
+	default:
+		return false
+	}
+}
+
+// allowsExtension returns true iff the wire protocol extension command may
+// be issued on a listener with the roles.
+func (r listenerRoles) allowsExtension(command string) bool {
+	switch command {
+	case s11n.ExtGetCapabilities:
+		return true
+	case s11n.ExtGetConsensusRange, s11n.ExtGetConsensusWait:
+		return r&roleFetch != 0
+	case s11n.ExtGetDescriptorStatus:
+		return r&roleUpload != 0
+	case s11n.ExtGetAuthorityStatus:
+		return r&roleAdmin != 0
+	default:
+		return false
+	}
+}
+
+// allowsAnonymous returns true iff peers without an identity key (clients,
+// and administrative tools) may connect to a listener with the roles.
+func (r listenerRoles) allowsAnonymous() bool {
+	return r&(roleFetch|roleAdmin) != 0
+}
+
+// filterFeatures removes the features that are unusable on a listener with
+// the roles from caps.
+func (r listenerRoles) filterFeatures(caps *s11n.Capabilities) {
+	features := make([]string, 0, len(caps.Features))
+	for _, v := range caps.Features {
+		switch v {
+		case s11n.FeatureConsensusRange, s11n.FeatureConsensusWait:
+			if r&roleFetch == 0 {
+				continue
+			}
+		case s11n.FeatureDescriptorStatus, s11n.FeatureDescriptorRevision, s11n.FeatureDescriptorErrorCodes:
+			if r&roleUpload == 0 {
+				continue
+			}
+		case s11n.FeatureAuthorityStatus:
+			if r&roleAdmin == 0 {
+				continue
+			}
+		}
+		features = append(features, v)
+	}
+	caps.Features = features
+}
+
+func (r listenerRoles) String() string {
+	var l []string
+	if r&roleFetch != 0 {
+		l = append(l, config.RoleFetch)
+	}
+	if r&roleUpload != 0 {
+		l = append(l, config.RoleUpload)
+	}
+	if r&roleAdmin != 0 {
+		l = append(l, config.RoleAdmin)
+	}
+	return strings.Join(l, ",")
+}
@@ -0,0 +1,152 @@
+// options.go - Katzenpost non-voting authority server options.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/katzenpost/authority/nonvoting/server/config"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/log"
+)
+
+// Option is an optional parameter to New.
+type Option func(*Server) error
+
+// Clock is the source of the current epoch.
+type Clock interface {
+	// Now returns the current epoch, the time elapsed since the start of
+	// the epoch, and the time till the next epoch, like epochtime.Now.
+	Now() (uint64, time.Duration, time.Duration)
+}
+
+type epochtimeClock struct{}
+
+func (c *epochtimeClock) Now() (uint64, time.Duration, time.Duration) {
+	return epochtime.Now()
+}
+
+// WithLogBackend provides the log backend for the Server to use, instead of
+// the one specified by the Logging configuration section.
+func WithLogBackend(b *log.Backend) Option {
+	return func(s *Server) error {
+		if b == nil {
+			return errors.New("server: log backend is nil")
+		}
+		s.logBackend = b
+		return nil
+	}
+}
+
+// WithStorage provides the persistence backend for the Server to use,
+// instead of the persistence store in the DataDir.  The Server takes
+// ownership of the Storage, and will close it when shut down.
+//
+// Note: The DataDir is not locked when a Storage is provided, as excluding
+// other instances from the Storage is the caller's responsibility.
+func WithStorage(st Storage) Option {
+	return func(s *Server) error {
+		if st == nil {
+			return errors.New("server: storage is nil")
+		}
+		s.storage = st
+		return nil
+	}
+}
+
+// WithClock provides the source of the current epoch for the Server to use,
+// instead of the system clock.
+func WithClock(c Clock) Option {
+	return func(s *Server) error {
+		if c == nil {
+			return errors.New("server: clock is nil")
+		}
+		s.clock = c
+		return nil
+	}
+}
+
+// WithIdentityKey provides the authority's identity key, instead of the
+// one loaded from (or generated in) the DataDir.
+func WithIdentityKey(k *eddsa.PrivateKey) Option {
+	return func(s *Server) error {
+		if k == nil {
+			return errors.New("server: identity key is nil")
+		}
+
+		// Copy the key, as the Server will clear it on shutdown.
+		s.identityKey = new(eddsa.PrivateKey)
+		return s.identityKey.FromBytes(k.Bytes())
+	}
+}
+
+type externalListener struct {
+	l     net.Listener
+	roles listenerRoles
+}
+
+// WithListener provides an already bound listener for the Server to accept
+// connections on, with the specified roles (config.RoleFetch,
+// config.RoleUpload, config.RoleAdmin).
+//
+// If no roles are specified, and the listener is bound to an address that is
+// present in the configuration, the listener takes the place of, and the
+// roles of the configured listener, otherwise the listener will have the
+// same roles as the Authority.Addresses listeners.
+//
+// The Server takes ownership of the listener, even if New fails.  Note that
+// the configuration will default to binding to a guessed external address
+// if no addresses are configured, which can be avoided by setting
+// Authority.Addresses to an empty list.
+func WithListener(l net.Listener, roles ...string) Option {
+	return func(s *Server) error {
+		for _, v := range roles {
+			switch v {
+			case config.RoleFetch, config.RoleUpload, config.RoleAdmin:
+			default:
+				l.Close()
+				return fmt.Errorf("server: invalid listener role '%v'", v)
+			}
+		}
+		s.externalListeners = append(s.externalListeners, &externalListener{
+			l:     l,
+			roles: rolesFromConfig(roles),
+		})
+		return nil
+	}
+}
+
+// normalizeAddr returns the canonical form of a TCP address, so that the
+// address a listener is bound to can be compared against the configured
+// addresses.  The unspecified addresses are all considered equivalent, as
+// a listener bound to any of them reports itself as bound to "[::]".
+func normalizeAddr(addr string) string {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return addr
+	}
+	ip := a.IP
+	if ip == nil || ip.IsUnspecified() {
+		ip = net.IPv6unspecified
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(a.Port))
+}
@@ -0,0 +1,171 @@
+// options_test.go - Non-voting authority server option tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/katzenpost/authority/nonvoting/server/config"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestConfig returns a configuration without a DataDir or Addresses,
+// for a single layer topology with nrProviders whitelisted providers.
+func newTestConfig(t *testing.T, nrProviders int) *config.Config {
+	cfg := &config.Config{
+		Authority: &config.Authority{
+			Addresses: []string{},
+		},
+		Topology: &config.Topology{
+			Layers:           1,
+			MinNodesPerLayer: 1,
+			MinProviders:     &nrProviders,
+		},
+	}
+	k, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(t, err, "eddsa.NewKeypair()")
+	cfg.Mixes = append(cfg.Mixes, &config.Node{IdentityKey: k.PublicKey()})
+	for i := 0; i < nrProviders; i++ {
+		k, err = eddsa.NewKeypair(rand.Reader)
+		require.NoError(t, err, "eddsa.NewKeypair()")
+		cfg.Providers = append(cfg.Providers, &config.Node{
+			Identifier:  "provider-" + strconv.Itoa(i),
+			IdentityKey: k.PublicKey(),
+		})
+	}
+	return cfg
+}
+
+// newTestOptions returns the options that provide everything that would
+// otherwise live in the DataDir, and the provided Storage.
+func newTestOptions(t *testing.T) ([]Option, *memoryStorage) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", true)
+	require.NoError(err, "log.New()")
+	identityKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "Listen()")
+	st := NewMemoryStorage().(*memoryStorage)
+
+	return []Option{
+		WithLogBackend(logBackend),
+		WithIdentityKey(identityKey),
+		WithStorage(st),
+		WithListener(l),
+	}, st
+}
+
+func TestNormalizeAddr(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, v := range []struct {
+		a, b string
+	}{
+		{"127.0.0.1:2323", "127.0.0.1:2323"},
+		{"[::ffff:127.0.0.1]:2323", "127.0.0.1:2323"},
+		{"[::1]:2323", "[0:0:0:0:0:0:0:1]:2323"},
+		{"0.0.0.0:2323", "[::]:2323"},
+		{":2323", "[::]:2323"},
+	} {
+		assert.Equal(normalizeAddr(v.a), normalizeAddr(v.b), "%v == %v", v.a, v.b)
+	}
+	assert.NotEqual(normalizeAddr("127.0.0.1:2323"), normalizeAddr("127.0.0.1:2324"), "Port")
+	assert.NotEqual(normalizeAddr("127.0.0.1:2323"), normalizeAddr("127.0.0.2:2323"), "Address")
+
+	// A listener bound to the unspecified address matches the configuration.
+	l, err := net.Listen("tcp", "0.0.0.0:0")
+	require.NoError(t, err, "Listen()")
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	assert.Equal(normalizeAddr(net.JoinHostPort("0.0.0.0", strconv.Itoa(port))), normalizeAddr(l.Addr().String()), "Listener")
+}
+
+func TestNewClosesListeners(t *testing.T) {
+	require := require.New(t)
+
+	// Listeners supplied after a failing option must still be closed.
+	var ls []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(err, "Listen()")
+		defer l.Close()
+		ls = append(ls, l)
+	}
+	_, err := New(nil, WithListener(ls[0]), WithClock(nil), WithListener(ls[1]))
+	require.Error(err, "New(): bad option")
+	for i, l := range ls {
+		_, err = l.Accept()
+		require.Error(err, "Accept(): listener %d", i)
+	}
+}
+
+func TestNewWithoutDataDir(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cwd, err := os.Getwd()
+	require.NoError(err, "Getwd()")
+	entries, err := ioutil.ReadDir(cwd)
+	require.NoError(err, "ReadDir()")
+
+	// Everything that lives in the DataDir is provided.
+	opts, st := newTestOptions(t)
+	s, err := New(newTestConfig(t, 1), opts...)
+	require.NoError(err, "New()")
+	assert.False(st.closed, "Storage: running")
+	s.Shutdown()
+	assert.True(st.closed, "Storage: shut down")
+
+	after, err := ioutil.ReadDir(cwd)
+	require.NoError(err, "ReadDir()")
+	assert.Len(after, len(entries), "Nothing created")
+
+	// The DataDir is mandatory as soon as anything is not provided.
+	opts, st = newTestOptions(t)
+	_, err = New(newTestConfig(t, 1), append(opts[:1:1], opts[2:]...)...)
+	assert.Error(err, "New(): no identity key")
+	assert.True(st.closed, "Storage: New() failed")
+}
+
+func TestNewClosesStorage(t *testing.T) {
+	assert := assert.New(t)
+
+	// Initialization fails after the options are applied, but before the
+	// state worker takes ownership of the Storage.
+	opts, st := newTestOptions(t)
+	_, err := New(newTestConfig(t, 0), append(opts, WithClock(nil))...)
+	assert.Error(err, "New(): bad option")
+	assert.True(st.closed, "Storage: bad option")
+
+	opts, st = newTestOptions(t)
+	cfg := newTestConfig(t, 1)
+	minProviders := 2
+	cfg.Topology.MinProviders = &minProviders
+	_, err = New(cfg, opts...)
+	assert.Error(err, "New(): insufficient providers")
+	assert.True(st.closed, "Storage: insufficient providers")
+}
@@ -0,0 +1,142 @@
+// readiness.go - Katzenpost non-voting authority readiness report.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/pki"
+)
+
+// ReadinessReport is a summary of the descriptors uploaded for an epoch,
+// relative to what is required to generate a Document.
+type ReadinessReport struct {
+	// Epoch is the epoch that the report is for.
+	Epoch uint64
+
+	// Providers is the number of provider descriptors uploaded.
+	Providers int
+
+	// MinProviders is the number of provider descriptors required.
+	MinProviders int
+
+	// Nodes is the number of mix descriptors uploaded.
+	Nodes int
+
+	// LayerNodes is the number of nodes that would be assigned to each
+	// layer, if the Document was generated from the uploaded descriptors.
+	LayerNodes []int
+
+	// MinNodesPerLayer is the number of nodes required in each layer.
+	MinNodesPerLayer int
+
+	// Standby is the number of nodes that would be placed on standby, as
+	// the layers are at capacity.
+	Standby int
+
+	// LayerChanges is the number of the ReturningNodes that would be
+	// assigned to a different layer than in the previous Document.
+	LayerChanges int
+
+	// ReturningNodes is the number of nodes that would be in the
+	// Document's topology, that were also in the previous Document's
+	// topology.
+	ReturningNodes int
+
+	// MissingMixes is the list of the identity keys of authorized mixes that
+	// have not uploaded a descriptor.
+	MissingMixes []*eddsa.PublicKey
+
+	// MissingProviders is the list of the identifiers of authorized
+	// providers that have not uploaded a descriptor.
+	MissingProviders []string
+}
+
+// IsReady returns true iff enough descriptors have been uploaded to generate
+// a Document.
+func (r *ReadinessReport) IsReady() bool {
+	if r.Providers < r.MinProviders || len(r.LayerNodes) == 0 {
+		return false
+	}
+	for _, v := range r.LayerNodes {
+		if v < r.MinNodesPerLayer {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *ReadinessReport) String() string {
+	return fmt.Sprintf("epoch %v: providers %v/%v, nodes %v (per layer %v/%v, standby %v, layer changes %v/%v), missing mixes: %v, missing providers: %v", r.Epoch, r.Providers, r.MinProviders, r.Nodes, r.LayerNodes, r.MinNodesPerLayer, r.Standby, r.LayerChanges, r.ReturningNodes, r.MissingMixes, r.MissingProviders)
+}
+
+func (s *state) readinessReport(epoch uint64) *ReadinessReport {
+	// Lock is held.
+
+	r := &ReadinessReport{
+		Epoch:            epoch,
+		MinProviders:     *s.s.cfg.Topology.MinProviders,
+		MinNodesPerLayer: s.s.cfg.Topology.MinNodesPerLayer,
+	}
+
+	m := s.descriptors[epoch]
+	var nodes []*descriptor
+	for _, v := range m {
+		if v.desc.Layer == pki.LayerProvider {
+			r.Providers++
+		} else {
+			nodes = append(nodes, v)
+		}
+	}
+	r.Nodes = len(nodes)
+
+	// The layers are populated exactly as if the Document was being
+	// generated, so that the report accounts for standby nodes, and for
+	// layers left unbalanced by the churn limit.  The plan is seeded by
+	// the epoch (and the nodes are in a fixed order), so that the reports
+	// for the same descriptors are identical.
+	sort.Slice(nodes, func(i, j int) bool {
+		return bytes.Compare(nodes[i].desc.IdentityKey.Bytes(), nodes[j].desc.IdentityKey.Bytes()) < 0
+	})
+	plan := s.planTopology(epoch, nodes, rand.New(rand.NewSource(int64(epoch))))
+	for _, v := range plan.layers {
+		r.LayerNodes = append(r.LayerNodes, len(v))
+	}
+	r.Standby = len(plan.standby)
+	r.LayerChanges, r.ReturningNodes = plan.nrChanged, plan.nrReturning
+
+	for _, v := range s.s.cfg.Mixes {
+		if _, ok := m[v.IdentityKey.ByteArray()]; !ok {
+			r.MissingMixes = append(r.MissingMixes, v.IdentityKey)
+		}
+	}
+	sort.Slice(r.MissingMixes, func(i, j int) bool {
+		return r.MissingMixes[i].String() < r.MissingMixes[j].String()
+	})
+	for _, v := range s.s.cfg.Providers {
+		if _, ok := m[v.IdentityKey.ByteArray()]; !ok {
+			r.MissingProviders = append(r.MissingProviders, v.Identifier)
+		}
+	}
+	sort.Strings(r.MissingProviders)
+
+	return r
+}
@@ -24,9 +24,12 @@ package server
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/katzenpost/authority/nonvoting/server/config"
@@ -52,11 +55,19 @@ type Server struct {
 
 	logBackend *log.Backend
 	log        *logging.Logger
+	clock      Clock
 
-	state     *state
-	listeners []net.Listener
+	state             *state
+	storage           Storage
+	listeners         []net.Listener
+	externalListeners []*externalListener
+
+	dataDirLock *os.File
+	events      *eventBus
+	connSem     chan struct{}
 
 	fatalErrCh chan error
+	haltingCh  chan interface{}
 	haltedCh   chan interface{}
 	haltOnce   sync.Once
 }
@@ -87,7 +98,87 @@ func (s *Server) initDataDir() error {
 	return nil
 }
 
+func (s *Server) usesDataDir() bool {
+	switch {
+	case s.storage == nil:
+		return true
+	case s.identityKey == nil && s.cfg.Debug.IdentityKey == nil:
+		return true
+	case s.logBackend == nil && !s.cfg.Logging.Disable && s.cfg.Logging.File != "" && !filepath.IsAbs(s.cfg.Logging.File):
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) lockDataDir() error {
+	const lockFile = "authority.lock"
+
+	// Read-only instances never write to the persistence store (they open
+	// a snapshot of it), so they do not take the lock.
+	if s.cfg.Authority.ReadOnly {
+		return nil
+	}
+
+	p := filepath.Join(s.cfg.Authority.DataDir, lockFile)
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("authority: failed to open DataDir lock: %v", err)
+	}
+	if err = tryLockFile(f); err != nil {
+		defer f.Close()
+		if pid := readLockPID(f); pid > 0 {
+			return fmt.Errorf("authority: DataDir '%v' is in use by another instance (pid %v)", s.cfg.Authority.DataDir, pid)
+		}
+		return fmt.Errorf("authority: DataDir '%v' is in use by another instance: %v", s.cfg.Authority.DataDir, err)
+	}
+
+	// Record the holder's PID for the benefit of operators, and any other
+	// instance that fails to acquire the lock.
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		unlockFile(f)
+		f.Close()
+		return fmt.Errorf("authority: failed to write DataDir lock: %v", err)
+	}
+
+	s.dataDirLock = f
+	return nil
+}
+
+func (s *Server) unlockDataDir() {
+	if s.dataDirLock == nil {
+		return
+	}
+
+	// The lock file is intentionally left in place, as removing it would
+	// race against another instance that is attempting to acquire it.
+	unlockFile(s.dataDirLock)
+	s.dataDirLock.Close()
+	s.dataDirLock = nil
+}
+
+func readLockPID(f *os.File) int {
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
 func (s *Server) initLogging() error {
+	if s.logBackend != nil {
+		// The log backend was provided via WithLogBackend.
+		s.log = s.logBackend.GetLogger("authority")
+		return nil
+	}
+
 	p := s.cfg.Logging.File
 	if !s.cfg.Logging.Disable && s.cfg.Logging.File != "" {
 		if !filepath.IsAbs(p) {
@@ -108,6 +199,43 @@ func (s *Server) IdentityKey() *eddsa.PublicKey {
 	return s.identityKey.PublicKey()
 }
 
+// Subscribe returns a new subscription to the Server's events, buffering up
+// to bufferSize events (or a reasonable default if 0).  Events are
+// delivered without ever blocking the Server, so subscribers that fall more
+// than bufferSize events behind will miss events.
+func (s *Server) Subscribe(bufferSize int) *Subscription {
+	return s.events.subscribe(bufferSize)
+}
+
+func (s *Server) onFatalError(err error) {
+	s.events.publish(&FatalErrorEvent{Err: err})
+
+	// Only the first fatal error needs to reach the watcher, and the
+	// caller may be holding locks that the shutdown requires, so never
+	// block here.
+	select {
+	case s.fatalErrCh <- err:
+	default:
+	}
+}
+
+// ReadinessReport returns a report on the descriptors uploaded for the next
+// epoch, and if they are sufficient to generate a Document, or nil if the
+// Server has been shut down.
+func (s *Server) ReadinessReport() *ReadinessReport {
+	select {
+	case <-s.haltingCh:
+		return nil
+	default:
+	}
+	epoch, _, _ := s.clock.Now()
+
+	s.state.RLock()
+	defer s.state.RUnlock()
+
+	return s.state.readinessReport(epoch + 1)
+}
+
 // Wait waits till the server is terminated for any reason.
 func (s *Server) Wait() {
 	<-s.haltedCh
@@ -118,9 +246,9 @@ func (s *Server) Shutdown() {
 	s.haltOnce.Do(func() { s.halt() })
 }
 
-func (s *Server) listenWorker(l net.Listener) {
+func (s *Server) listenWorker(l net.Listener, roles listenerRoles) {
 	addr := l.Addr()
-	s.log.Noticef("Listening on: %v", addr)
+	s.log.Noticef("Listening on: %v (%v)", addr, roles)
 	defer func() {
 		s.log.Noticef("Stopping listening on: %v", addr)
 		l.Close()
@@ -136,8 +264,19 @@ func (s *Server) listenWorker(l net.Listener) {
 			continue
 		}
 
+		// Connections are handled concurrently, as some requests (eg:
+		// GetConsensusWait) may be held for a long time, up to a limit.
+		// Peers will retry, possibly on another of the authority's
+		// addresses, so there is no point in queueing connections.
+		select {
+		case s.connSem <- struct{}{}:
+		default:
+			s.log.Debugf("Rejecting connection from %v, too many connections.", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
 		s.Add(1)
-		s.onConn(conn)
+		go s.onConn(conn, roles)
 	}
 
 	// NOTREACHED
@@ -146,6 +285,9 @@ func (s *Server) listenWorker(l net.Listener) {
 func (s *Server) halt() {
 	s.log.Notice("Starting graceful shutdown.")
 
+	// Release any connections that are waiting on the state.
+	close(s.haltingCh)
+
 	// Halt the listeners.
 	for idx, l := range s.listeners {
 		if l != nil {
@@ -157,32 +299,97 @@ func (s *Server) halt() {
 	// Wait for all the connections to terminate.
 	s.WaitGroup.Wait()
 
-	// Halt the state worker.
+	// Halt the state worker.  The state is retained, as ReadinessReport
+	// may be called concurrently with the shutdown.
 	if s.state != nil {
 		s.state.Halt()
-		s.state = nil
 	}
+	s.events.close()
 
 	s.identityKey.Reset()
 	s.linkKey.Reset()
-	close(s.fatalErrCh)
+	s.unlockDataDir()
 
 	s.log.Notice("Shutdown complete.")
 	close(s.haltedCh)
 }
 
 // New returns a new Server instance parameterized with the specific
-// configuration.
-func New(cfg *config.Config) (*Server, error) {
+// configuration and options.
+func New(cfg *config.Config, opts ...Option) (*Server, error) {
 	s := new(Server)
 	s.cfg = cfg
-	s.fatalErrCh = make(chan error)
+	s.fatalErrCh = make(chan error, 1)
+	s.haltingCh = make(chan interface{})
 	s.haltedCh = make(chan interface{})
+	s.events = newEventBus()
+
+	// Externally provided listeners are owned by the Server, and are
+	// closed if initialization fails.
+	isOk := false
+	defer func() {
+		if !isOk {
+			for _, v := range s.externalListeners {
+				v.l.Close()
+			}
+
+			// Likewise the provided Storage, unless the state worker
+			// took ownership of it.
+			if s.storage != nil && s.state == nil {
+				s.storage.Close()
+			}
+		}
+	}()
+	var optErr error
+	for _, opt := range opts {
+		// Keep applying options past a failure, so that every listener
+		// provided is owned (and closed) by the Server.
+		if err := opt(s); err != nil && optErr == nil {
+			optErr = err
+		}
+	}
+	if optErr != nil {
+		return nil, optErr
+	}
+	if s.clock == nil {
+		s.clock = &epochtimeClock{}
+	}
 
-	// Do the early initialization and bring up logging.
-	if err := s.initDataDir(); err != nil {
+	// Ensure that the configuration upholds the same invariants, regardless
+	// of if it was loaded from a file or built programmatically.
+	if cfg == nil {
+		return nil, errors.New("server: cfg is mandatory")
+	}
+	if err := cfg.FixupAndValidate(); err != nil {
 		return nil, err
 	}
+	s.connSem = make(chan struct{}, cfg.Authority.MaxConnections)
+
+	// Do the early initialization and bring up logging.  The DataDir is
+	// only required if something that lives in it was not provided.
+	if s.usesDataDir() {
+		if cfg.Authority.DataDir == "" {
+			return nil, errors.New("server: Authority: DataDir is mandatory")
+		}
+		if err := s.initDataDir(); err != nil {
+			return nil, err
+		}
+	}
+	if s.storage == nil {
+		// The lock protects the persistence store in the DataDir.
+		if err := s.lockDataDir(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Until the server is fully initialized, failures need to release the
+	// DataDir lock.
+	defer func() {
+		if !isOk {
+			s.unlockDataDir()
+		}
+	}()
+
 	if err := s.initLogging(); err != nil {
 		return nil, err
 	}
@@ -191,10 +398,15 @@ func New(cfg *config.Config) (*Server, error) {
 	if s.cfg.Logging.Level == "DEBUG" {
 		s.log.Warning("Unsafe Debug logging is enabled.")
 	}
+	if s.cfg.Authority.ReadOnly {
+		s.log.Warning("ReadOnly is set, descriptors will not be accepted and documents will not be generated.")
+	}
 
 	// Initialize the authority identity key.
 	var err error
-	if s.cfg.Debug.IdentityKey != nil {
+	if s.identityKey != nil {
+		// The identity key was provided via WithIdentityKey.
+	} else if s.cfg.Debug.IdentityKey != nil {
 		s.log.Warning("IdentityKey should NOT be used for production deployments.")
 		s.identityKey = new(eddsa.PrivateKey)
 		s.identityKey.FromBytes(s.cfg.Debug.IdentityKey.Bytes())
@@ -215,15 +427,14 @@ func New(cfg *config.Config) (*Server, error) {
 
 	// Ensure that there are enough mixes and providers whitelisted to form
 	// a topology, assuming all of them post a descriptor.
-	if len(cfg.Providers) < 1 {
-		return nil, fmt.Errorf("server: No Providers specified in the config")
+	if len(cfg.Providers) < *cfg.Topology.MinProviders {
+		return nil, fmt.Errorf("server: Insufficient providers whitelisted, got %v, need %v", len(cfg.Providers), *cfg.Topology.MinProviders)
 	}
-	if len(cfg.Mixes) < cfg.Debug.Layers*cfg.Debug.MinNodesPerLayer {
-		return nil, fmt.Errorf("server: Insufficient nodes whitelisted, got %v , need %v", len(cfg.Mixes), cfg.Debug.Layers*cfg.Debug.MinNodesPerLayer)
+	if len(cfg.Mixes) < cfg.Topology.Layers*cfg.Topology.MinNodesPerLayer {
+		return nil, fmt.Errorf("server: Insufficient nodes whitelisted, got %v , need %v", len(cfg.Mixes), cfg.Topology.Layers*cfg.Topology.MinNodesPerLayer)
 	}
 
 	// Past this point, failures need to call s.Shutdown() to do cleanup.
-	isOk := false
 	defer func() {
 		if !isOk {
 			s.Shutdown()
@@ -232,12 +443,12 @@ func New(cfg *config.Config) (*Server, error) {
 
 	// Start the fatal error watcher.
 	go func() {
-		err, ok := <-s.fatalErrCh
-		if !ok {
-			return
+		select {
+		case err := <-s.fatalErrCh:
+			s.log.Warningf("Shutting down due to error: %v", err)
+			s.Shutdown()
+		case <-s.haltingCh:
 		}
-		s.log.Warningf("Shutting down due to error: %v", err)
-		s.Shutdown()
 	}()
 
 	// Start up the state worker.
@@ -245,21 +456,60 @@ func New(cfg *config.Config) (*Server, error) {
 		return nil, err
 	}
 
-	// Start up the listeners.
-	for _, v := range s.cfg.Authority.Addresses {
-		l, err := net.Listen("tcp", v)
-		if err != nil {
-			s.log.Errorf("Failed to start listener '%v': %v", v, err)
-			continue
-		}
+	// Start up the listeners.  Externally provided listeners that are bound
+	// to a configured address take the place of the configured listener,
+	// and unless explicitly specified, its roles.
+	var allRoles listenerRoles
+	external := make(map[string]*externalListener)
+	for _, v := range s.externalListeners {
+		external[normalizeAddr(v.l.Addr().String())] = v
+	}
+	startListener := func(l net.Listener, roles listenerRoles) {
 		s.listeners = append(s.listeners, l)
+		allRoles |= roles
 		s.Add(1)
-		go s.listenWorker(l)
+		go s.listenWorker(l, roles)
+	}
+	bindListener := func(addr string, roles listenerRoles) {
+		if v, ok := external[normalizeAddr(addr)]; ok {
+			if v.roles == 0 {
+				v.roles = roles
+			}
+			return
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.log.Errorf("Failed to start listener '%v': %v", addr, err)
+			return
+		}
+		startListener(l, roles)
+	}
+	if !s.cfg.Authority.ReadOnly {
+		// The Addresses belong to the instance that owns the DataDir, so
+		// read-only instances only bind the explicitly configured listeners.
+		for _, v := range s.cfg.Authority.Addresses {
+			bindListener(v, defaultRoles)
+		}
+	}
+	for _, v := range s.cfg.Authority.Listeners {
+		bindListener(v.Address, rolesFromConfig(v.Roles))
+	}
+	for _, v := range s.externalListeners {
+		if v.roles == 0 {
+			v.roles = defaultRoles
+		}
+		startListener(v.l, v.roles)
 	}
 	if len(s.listeners) == 0 {
 		s.log.Errorf("Failed to start all listeners.")
 		return nil, fmt.Errorf("authority: failed to start all listeners")
 	}
+	if allRoles&roleFetch == 0 {
+		s.log.Warningf("No listener allows fetching documents.")
+	}
+	if allRoles&roleUpload == 0 {
+		s.log.Warningf("No listener allows uploading descriptors.")
+	}
 
 	isOk = true
 	return s, nil
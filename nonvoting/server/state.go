@@ -18,37 +18,36 @@ package server
 
 import (
 	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"path/filepath"
+	mrand "math/rand"
+	"sort"
 	"sync"
 	"time"
 
-	bolt "github.com/coreos/bbolt"
 	"github.com/katzenpost/authority/nonvoting/internal/s11n"
+	"github.com/katzenpost/authority/nonvoting/server/config"
 	"github.com/katzenpost/core/crypto/eddsa"
 	"github.com/katzenpost/core/crypto/rand"
-	"github.com/katzenpost/core/epochtime"
 	"github.com/katzenpost/core/pki"
 	"github.com/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/core/worker"
 	"gopkg.in/op/go-logging.v1"
 )
 
-const (
-	descriptorsBucket = "descriptors"
-	documentsBucket   = "documents"
-)
-
 var (
-	errGone   = errors.New("authority: Requested epoch will never get a Document")
-	errNotYet = errors.New("authority: Document is not ready yet")
+	errGone     = errors.New("authority: Requested epoch will never get a Document")
+	errNotYet   = errors.New("authority: Document is not ready yet")
+	errReadOnly = errors.New("authority: Persistence store is read-only")
+	errConflict = errors.New("authority: Conflicting descriptor for epoch")
+	errLate     = errors.New("authority: Late descriptor upload for epoch")
+	errInternal = errors.New("authority: Internal error")
 )
 
 type descriptor struct {
-	desc *pki.MixDescriptor
-	raw  []byte
+	desc     *pki.MixDescriptor
+	raw      []byte
+	revision uint64
 }
 
 type document struct {
@@ -63,24 +62,26 @@ type state struct {
 	s   *Server
 	log *logging.Logger
 
-	db *bolt.DB
+	storage Storage
 
 	authorizedMixes     map[[eddsa.PublicKeySize]byte]bool
 	authorizedProviders map[[eddsa.PublicKeySize]byte]string
 
 	documents   map[uint64]*document
 	descriptors map[uint64]map[[eddsa.PublicKeySize]byte]*descriptor
+	standby     map[uint64]map[[eddsa.PublicKeySize]byte]bool
+	docWaiters  map[uint64]chan interface{}
 
 	updateCh       chan interface{}
 	bootstrapEpoch uint64
+	lastReadiness  string
 }
 
 func (s *state) Halt() {
 	s.Worker.Halt()
 
 	// Gracefully close the persistence store.
-	s.db.Sync()
-	s.db.Close()
+	s.storage.Close()
 }
 
 func (s *state) onUpdate() {
@@ -119,11 +120,17 @@ func (s *state) worker() {
 
 func (s *state) onWakeup() {
 	const publishDeadline = 3600 * time.Second
-	epoch, _, till := epochtime.Now()
+	epoch, _, till := s.s.clock.Now()
 
 	s.Lock()
 	defer s.Unlock()
 
+	// Read-only instances just serve what was persisted.
+	if s.s.cfg.Authority.ReadOnly {
+		s.pruneDocuments()
+		return
+	}
+
 	// If we are doing a bootstrap, and we don't have a document, attempt
 	// to generate one for the current epoch regardless of the time.
 	if epoch == s.bootstrapEpoch && s.documents[epoch] == nil {
@@ -139,8 +146,13 @@ func (s *state) onWakeup() {
 	// If it is past the descriptor upload period and we have yet to generate a
 	// document for the *next* epoch, generate one.
 	if till < publishDeadline && s.documents[epoch+1] == nil {
-		if m, ok := s.descriptors[epoch+1]; ok && s.hasEnoughDescriptors(m) {
+		if r := s.readinessReport(epoch + 1); r.IsReady() {
 			s.generateDocument(epoch + 1)
+		} else if rs := r.String(); rs != s.lastReadiness {
+			// Only warn when the situation changes, as this is checked on
+			// every wakeup till the Document is generated.
+			s.log.Warningf("Insufficient descriptors to generate Document: %v", rs)
+			s.lastReadiness = rs
 		}
 	}
 
@@ -148,25 +160,6 @@ func (s *state) onWakeup() {
 	s.pruneDocuments()
 }
 
-func (s *state) hasEnoughDescriptors(m map[[eddsa.PublicKeySize]byte]*descriptor) bool {
-	// A Document will be generated iff there are at least:
-	//
-	//  * Debug.Layers * Debug.MinNodesPerLayer nodes.
-	//  * One provider.
-	//
-	// Otherwise, it's pointless to generate a unusable document.
-	nrProviders := 0
-	for _, v := range m {
-		if v.desc.Layer == pki.LayerProvider {
-			nrProviders++
-		}
-	}
-	nrNodes := len(m) - nrProviders
-
-	minNodes := s.s.cfg.Debug.Layers * s.s.cfg.Debug.MinNodesPerLayer
-	return nrProviders > 0 && nrNodes >= minNodes
-}
-
 func (s *state) generateDocument(epoch uint64) {
 	// Lock is held (called from the onWakeup hook).
 
@@ -183,12 +176,31 @@ func (s *state) generateDocument(epoch uint64) {
 		}
 	}
 
-	// Assign nodes to layers.
-	var topology [][][]byte
-	if d, ok := s.documents[epoch-1]; ok {
-		topology = s.generateTopology(nodes, d.doc)
-	} else {
-		topology = s.generateRandomTopology(nodes)
+	// Assign nodes to layers, keeping any nodes in excess of the topology's
+	// capacity on standby.
+	plan := s.planTopology(epoch, nodes, rand.NewMath())
+	if len(plan.standby) > 0 {
+		s.log.Noticef("Topology capacity is %v nodes, placing %v nodes on standby.", len(nodes)-len(plan.standby), len(plan.standby))
+		for _, v := range plan.standby {
+			s.log.Debugf("Node %v: Standby for epoch %v.", v.desc.IdentityKey, epoch)
+		}
+	}
+	if plan.nrReturning > 0 {
+		churn := float64(plan.nrChanged) / float64(plan.nrReturning)
+		s.log.Noticef("Topology churn: %v/%v (%.2f) returning nodes changed layer.", plan.nrChanged, plan.nrReturning, churn)
+	}
+
+	// Ensure that every resulting layer is adequately populated, as it is
+	// pointless to publish an unusable (or lopsided) document.
+	topology := make([][][]byte, len(plan.layers))
+	for layer, nodes := range plan.layers {
+		if len(nodes) < s.s.cfg.Topology.MinNodesPerLayer {
+			s.log.Errorf("Not generating Document, layer %v has %v nodes, need %v.", layer, len(nodes), s.s.cfg.Topology.MinNodesPerLayer)
+			return
+		}
+		for _, v := range nodes {
+			topology[layer] = append(topology[layer], v.raw)
+		}
 	}
 
 	// Build the Document.
@@ -208,7 +220,7 @@ func (s *state) generateDocument(epoch uint64) {
 	if err != nil {
 		// This should basically always succeed.
 		s.log.Errorf("Failed to sign document: %v", err)
-		s.s.fatalErrCh <- err
+		s.s.onFatalError(err)
 		return
 	}
 
@@ -217,37 +229,202 @@ func (s *state) generateDocument(epoch uint64) {
 	if err != nil {
 		// This should basically always succeed.
 		s.log.Errorf("Signed document failed validation: %v", err)
-		s.s.fatalErrCh <- err
+		s.s.onFatalError(err)
 		return
 	}
 	if pDoc.Epoch != epoch {
 		// This should never happen either.
 		s.log.Errorf("Signed document has invalid epoch: %v", pDoc.Epoch)
-		s.s.fatalErrCh <- s11n.ErrInvalidEpoch
+		s.s.onFatalError(s11n.ErrInvalidEpoch)
 		return
 	}
 
 	s.log.Debugf("Document (Parsed): %v", pDoc)
 
 	// Persist the document to disk.
-	if err := s.db.Update(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket([]byte(documentsBucket))
-		bkt.Put(epochToBytes(epoch), []byte(signed))
-		return nil
-	}); err != nil {
+	if err := s.storage.PutDocument(epoch, []byte(signed)); err != nil {
 		// Persistence failures are FATAL.
-		s.s.fatalErrCh <- err
+		s.s.onFatalError(err)
 	}
 
 	d := new(document)
 	d.doc = pDoc
 	d.raw = []byte(signed)
 	s.documents[epoch] = d
+	s.setStandby(epoch, plan.standby)
+
+	// Wake up everyone that is waiting on this document.
+	if ch, ok := s.docWaiters[epoch]; ok {
+		close(ch)
+		delete(s.docWaiters, epoch)
+	}
+
+	s.s.events.publish(&DocumentGeneratedEvent{
+		Epoch:          epoch,
+		Document:       pDoc,
+		Raw:            d.raw,
+		LayerChanges:   plan.nrChanged,
+		ReturningNodes: plan.nrReturning,
+	})
+	s.publishMissingNodes(epoch, pDoc)
 }
 
-func (s *state) generateTopology(nodeList []*descriptor, doc *pki.Document) [][][]byte {
-	s.log.Debugf("Generating mix topology.")
+func (s *state) publishMissingNodes(epoch uint64, doc *pki.Document) {
+	// Lock is held (called from the onWakeup hook).
 
+	included := make(map[[eddsa.PublicKeySize]byte]bool)
+	for _, nodes := range doc.Topology {
+		for _, desc := range nodes {
+			included[desc.IdentityKey.ByteArray()] = true
+		}
+	}
+	for _, desc := range doc.Providers {
+		included[desc.IdentityKey.ByteArray()] = true
+	}
+
+	onMissing := func(v *config.Node) {
+		pk := v.IdentityKey.ByteArray()
+		if included[pk] {
+			return
+		}
+		s.s.events.publish(&NodeMissingEvent{
+			Epoch:       epoch,
+			IdentityKey: v.IdentityKey,
+			Provider:    v.Identifier,
+			Standby:     s.standby[epoch][pk],
+		})
+	}
+	for _, v := range s.s.cfg.Mixes {
+		onMissing(v)
+	}
+	for _, v := range s.s.cfg.Providers {
+		onMissing(v)
+	}
+}
+
+// topologyPlan is an assignment of nodes to the layers of a Document.
+type topologyPlan struct {
+	layers  [][]*descriptor
+	standby []*descriptor
+
+	// nrChanged is the number of the nrReturning nodes present in the
+	// previous Document's topology that changed layers.
+	nrChanged   int
+	nrReturning int
+}
+
+func (s *state) planTopology(epoch uint64, nodes []*descriptor, rng *mrand.Rand) *topologyPlan {
+	// Lock is held.
+
+	p := new(topologyPlan)
+	nodes, p.standby = s.selectActiveNodes(epoch, nodes, rng)
+	if d, ok := s.documents[epoch-1]; ok {
+		p.layers, p.nrChanged, p.nrReturning = s.generateTopology(nodes, d.doc, rng)
+	} else {
+		p.layers = s.generateRandomTopology(nodes, rng)
+	}
+	return p
+}
+
+func (s *state) selectActiveNodes(epoch uint64, nodes []*descriptor, rng *mrand.Rand) ([]*descriptor, []*descriptor) {
+	// Lock is held.
+
+	maxNodesPerLayer := s.s.cfg.Topology.MaxNodesPerLayer
+	capacity := s.s.cfg.Topology.Layers * maxNodesPerLayer
+	if maxNodesPerLayer <= 0 || len(nodes) <= capacity {
+		return nodes, nil
+	}
+
+	// Nodes that were active in the previous Document keep their place,
+	// followed by the nodes that were on standby, so that standby nodes get
+	// promoted as active nodes drop out, and finally by new nodes.
+	const (
+		rankActive = iota
+		rankStandby
+		rankNew
+		nrRanks
+	)
+	prevActive := make(map[[eddsa.PublicKeySize]byte]bool)
+	if d, ok := s.documents[epoch-1]; ok {
+		for _, layer := range d.doc.Topology {
+			for _, desc := range layer {
+				prevActive[desc.IdentityKey.ByteArray()] = true
+			}
+		}
+	}
+	prevStandby := make(map[[eddsa.PublicKeySize]byte]bool)
+	for _, v := range s.standbyNodes(epoch - 1) {
+		prevStandby[v.desc.IdentityKey.ByteArray()] = true
+	}
+
+	// The nodes are ranked in random order, so that which of the equally
+	// ranked nodes end up on standby is hard to predict.
+	var ranked [nrRanks][]*descriptor
+	for _, idx := range rng.Perm(len(nodes)) {
+		n := nodes[idx]
+		id := n.desc.IdentityKey.ByteArray()
+		switch {
+		case prevActive[id]:
+			ranked[rankActive] = append(ranked[rankActive], n)
+		case prevStandby[id]:
+			ranked[rankStandby] = append(ranked[rankStandby], n)
+		default:
+			ranked[rankNew] = append(ranked[rankNew], n)
+		}
+	}
+	ordered := make([]*descriptor, 0, len(nodes))
+	for _, v := range ranked {
+		ordered = append(ordered, v...)
+	}
+
+	return ordered[:capacity], ordered[capacity:]
+}
+
+func (s *state) standbyNodes(epoch uint64) []*descriptor {
+	// Lock is held.
+
+	var standby []*descriptor
+	for pk := range s.standby[epoch] {
+		if v, ok := s.descriptors[epoch][pk]; ok {
+			standby = append(standby, v)
+		}
+	}
+	return standby
+}
+
+func (s *state) setStandby(epoch uint64, nodes []*descriptor) {
+	// Lock is held.
+
+	m := make(map[[eddsa.PublicKeySize]byte]bool)
+	for _, v := range nodes {
+		m[v.desc.IdentityKey.ByteArray()] = true
+	}
+	s.standby[epoch] = m
+}
+
+func (s *state) restoreStandby(epoch uint64) {
+	// Lock is held (or the state is being initialized).
+
+	// The standby nodes are not persisted, but are exactly the nodes that
+	// have a descriptor for the epoch, yet are absent from the Document's
+	// topology, as descriptors are not accepted once the Document exists.
+	d, ok := s.documents[epoch]
+	if !ok {
+		return
+	}
+	var standby []*descriptor
+	for _, v := range s.descriptors[epoch] {
+		if v.desc.Layer == pki.LayerProvider {
+			continue
+		}
+		if included, _ := isInDocument(d.doc, v.desc.IdentityKey); !included {
+			standby = append(standby, v)
+		}
+	}
+	s.setStandby(epoch, standby)
+}
+
+func (s *state) generateTopology(nodeList []*descriptor, doc *pki.Document, rng *mrand.Rand) ([][]*descriptor, int, int) {
 	nodeMap := make(map[[constants.NodeIDLength]byte]*descriptor)
 	for _, v := range nodeList {
 		id := v.desc.IdentityKey.ByteArray()
@@ -258,74 +435,151 @@ func (s *state) generateTopology(nodeList []*descriptor, doc *pki.Document) [][]
 	// generating the mix topology such that the number of nodes per layer is
 	// approximately equal, and as many nodes as possible retain their existing
 	// layer assignment to minimise network churn.
+	//
+	// The number of nodes that change layers is further limited by
+	// Topology.MaxLayerChurn, as long as no layer deviates from the balanced
+	// size by more than Topology.LayerBalanceTolerance nodes.
+
+	type entry struct {
+		desc     *descriptor
+		retained bool
+	}
+
+	nrLayers := s.s.cfg.Topology.Layers
+	tolerance := s.s.cfg.Topology.LayerBalanceTolerance
+	lowerBound := len(nodeList)/nrLayers - tolerance
+	if lowerBound < s.s.cfg.Topology.MinNodesPerLayer {
+		lowerBound = s.s.cfg.Topology.MinNodesPerLayer
+	}
+	upperBound := (len(nodeList)+nrLayers-1)/nrLayers + tolerance
+	if maxNodesPerLayer := s.s.cfg.Topology.MaxNodesPerLayer; maxNodesPerLayer > 0 && upperBound > maxNodesPerLayer {
+		upperBound = maxNodesPerLayer
+	}
+	layers := make([][]*entry, nrLayers)
 
-	rng := rand.NewMath()
-	targetNodesPerLayer := len(nodeList) / s.s.cfg.Debug.Layers
-	topology := make([][][]byte, s.s.cfg.Debug.Layers)
+	// The number of layers may have been changed since the existing
+	// topology was generated.  Nodes in layers that no longer exist are
+	// left pending assignment, and new layers are populated from the
+	// pending nodes and by rebalancing below.
+	if len(doc.Topology) != nrLayers {
+		s.log.Noticef("Layer count changed from %v to %v, redistributing nodes.", len(doc.Topology), nrLayers)
+	}
 
-	// Assign nodes that still exist up to the target size.
+	// Retain the existing layer assignment of all nodes that still exist.
+	prevLayers := make(map[[constants.NodeIDLength]byte]int)
 	for layer, nodes := range doc.Topology {
 		// The existing nodes are examined in random order to make it hard
 		// to predict which nodes will be shifted around.
 		nodeIndexes := rng.Perm(len(nodes))
 		for _, idx := range nodeIndexes {
-			if len(topology[layer]) >= targetNodesPerLayer {
-				break
-			}
-
 			id := nodes[idx].IdentityKey.ByteArray()
-			if n, ok := nodeMap[id]; ok {
+			n, ok := nodeMap[id]
+			if !ok {
+				continue
+			}
+			prevLayers[id] = layer
+			if layer < nrLayers {
 				// There is a new descriptor with the same identity key,
 				// as an existing descriptor in the previous document,
 				// so preserve the layering.
-				topology[layer] = append(topology[layer], n.raw)
+				layers[layer] = append(layers[layer], &entry{desc: n, retained: true})
 				delete(nodeMap, id)
 			}
 		}
 	}
 
+	// Each node that changes layers counts against the churn budget,
+	// including those that are forced to by a reduction in the number of
+	// layers.
+	budget := int(*s.s.cfg.Topology.MaxLayerChurn * float64(len(prevLayers)))
+
 	// Flatten the map containing the nodes pending assignment.
 	toAssign := make([]*descriptor, 0, len(nodeMap))
-	for _, n := range nodeMap {
+	for id, n := range nodeMap {
+		if _, ok := prevLayers[id]; ok {
+			budget--
+		}
 		toAssign = append(toAssign, n)
 	}
-	assignIndexes := rng.Perm(len(toAssign))
 
-	// Fill out any layers that are under the target size, by
-	// randomly assigning from the pending list.
-	idx := 0
-	for layer := range doc.Topology {
-		for len(topology[layer]) < targetNodesPerLayer {
-			n := toAssign[assignIndexes[idx]]
-			topology[layer] = append(topology[layer], n.raw)
-			idx++
+	// Assign the pending nodes in random order to the smallest layer, which
+	// does not displace any existing nodes.
+	smallestLargest := func() (int, int) {
+		lMin, lMax := -1, -1
+		for _, l := range rng.Perm(nrLayers) {
+			if lMin < 0 || len(layers[l]) < len(layers[lMin]) {
+				lMin = l
+			}
+			if lMax < 0 || len(layers[l]) > len(layers[lMax]) {
+				lMax = l
+			}
 		}
+		return lMin, lMax
+	}
+	for _, idx := range rng.Perm(len(toAssign)) {
+		l, _ := smallestLargest()
+		layers[l] = append(layers[l], &entry{desc: toAssign[idx]})
 	}
 
-	// Assign the remaining nodes.
-	for layer := 0; idx < len(assignIndexes); idx++ {
-		n := toAssign[assignIndexes[idx]]
-		topology[layer] = append(topology[layer], n.raw)
-		layer++
-		layer = layer % len(topology)
+	// Rebalance the layers by moving nodes from the largest layer to the
+	// smallest.  Moves that are required to keep the layers within the
+	// tolerance (and at or above MinNodesPerLayer) are always done, others
+	// only while there is budget left.
+	for {
+		lMin, lMax := smallestLargest()
+		if len(layers[lMax])-len(layers[lMin]) <= 1 {
+			break
+		}
+		forced := len(layers[lMax]) > upperBound || len(layers[lMin]) < lowerBound
+		if !forced && budget <= 0 {
+			break
+		}
+
+		// Prefer moving nodes that have already been displaced (or are new),
+		// as that does not add to the churn.
+		src := layers[lMax]
+		idx := len(src) - 1
+		for i := len(src) - 1; i >= 0; i-- {
+			if !src[i].retained {
+				idx = i
+				break
+			}
+		}
+		e := src[idx]
+		layers[lMax] = append(src[:idx], src[idx+1:]...)
+		if e.retained {
+			e.retained = false
+			budget--
+		}
+		layers[lMin] = append(layers[lMin], e)
 	}
 
-	return topology
-}
+	// Flatten the layers, and tally up the churn.
+	nrChanged := 0
+	topology := make([][]*descriptor, nrLayers)
+	for layer, entries := range layers {
+		for _, e := range entries {
+			id := e.desc.desc.IdentityKey.ByteArray()
+			if prevLayer, ok := prevLayers[id]; ok && prevLayer != layer {
+				nrChanged++
+			}
+			topology[layer] = append(topology[layer], e.desc)
+		}
+	}
 
-func (s *state) generateRandomTopology(nodes []*descriptor) [][][]byte {
-	s.log.Debugf("Generating random mix topology.")
+	return topology, nrChanged, len(prevLayers)
+}
 
+func (s *state) generateRandomTopology(nodes []*descriptor, rng *mrand.Rand) [][]*descriptor {
 	// If there is no node history in the form of a previous consensus,
 	// then the simplest thing to do is to randomly assign nodes to the
 	// various layers.
 
-	rng := rand.NewMath()
 	nodeIndexes := rng.Perm(len(nodes))
-	topology := make([][][]byte, s.s.cfg.Debug.Layers)
+	topology := make([][]*descriptor, s.s.cfg.Topology.Layers)
 	for idx, layer := 0, 0; idx < len(nodes); idx++ {
 		n := nodes[nodeIndexes[idx]]
-		topology[layer] = append(topology[layer], n.raw)
+		topology[layer] = append(topology[layer], n)
 		layer++
 		layer = layer % len(topology)
 	}
@@ -341,7 +595,7 @@ func (s *state) pruneDocuments() {
 	// be added.
 	const preserveForPastEpochs = 3
 
-	now, _, _ := epochtime.Now()
+	now, _, _ := s.s.clock.Now()
 	cmpEpoch := now - preserveForPastEpochs
 
 	for e := range s.documents {
@@ -354,6 +608,26 @@ func (s *state) pruneDocuments() {
 			delete(s.descriptors, e)
 		}
 	}
+	for e := range s.standby {
+		if e < cmpEpoch {
+			delete(s.standby, e)
+		}
+	}
+	s.releaseWaiters()
+}
+
+func (s *state) releaseWaiters() {
+	// Lock is held.
+
+	// Release everyone that is waiting on a Document that will never be
+	// generated, as soon as that is known, as opposed to leaving them till
+	// their timeout.  They will find out why from documentForEpoch.
+	for e, ch := range s.docWaiters {
+		if _, err := s.documentForEpochLocked(e); err != errNotYet {
+			close(ch)
+			delete(s.docWaiters, e)
+		}
+	}
 }
 
 func (s *state) isDescriptorAuthorized(desc *pki.MixDescriptor) bool {
@@ -373,13 +647,17 @@ func (s *state) isDescriptorAuthorized(desc *pki.MixDescriptor) bool {
 	}
 }
 
-func (s *state) onDescriptorUpload(rawDesc []byte, desc *pki.MixDescriptor, epoch uint64) error {
+func (s *state) onDescriptorUpload(rawDesc []byte, desc *pki.MixDescriptor, revision, epoch uint64) error {
 	// Note: Caller ensures that the epoch is the current epoch +- 1.
 	pk := desc.IdentityKey.ByteArray()
 
 	s.Lock()
 	defer s.Unlock()
 
+	if s.s.cfg.Authority.ReadOnly {
+		return errReadOnly
+	}
+
 	// Get the public key -> descriptor map for the epoch.
 	m, ok := s.descriptors[epoch]
 	if !ok {
@@ -388,62 +666,153 @@ func (s *state) onDescriptorUpload(rawDesc []byte, desc *pki.MixDescriptor, epoc
 	}
 
 	// Check for redundant uploads.
-	if d, ok := m[pk]; ok {
-		// If the descriptor changes, then it will be rejected to prevent
-		// nodes from reneging on uploads.
-		if !bytes.Equal(d.raw, rawDesc) {
-			return fmt.Errorf("state: Node %v: Conflicting descriptor for epoch %v", desc.IdentityKey, epoch)
-		}
-
+	prev, ok := m[pk]
+	if ok {
 		// Redundant uploads that don't change are harmless.
-		return nil
-	}
-
-	// Ok, this is a new descriptor.
-	if s.documents[epoch] != nil {
-		// If there is a document already, the descriptor is late, and will
-		// never appear in a document, so reject it.
-		return fmt.Errorf("state: Node %v: Late descriptor upload for for epoch %v", desc.IdentityKey, epoch)
-	}
+		if bytes.Equal(prev.raw, rawDesc) {
+			return nil
+		}
 
-	// Persist the raw descriptor to disk.
-	if err := s.db.Update(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket([]byte(descriptorsBucket))
-		eBkt, err := bkt.CreateBucketIfNotExists(epochToBytes(epoch))
-		if err != nil {
-			return err
+		// Once the document is generated, the descriptor is set in stone,
+		// and any change is rejected to prevent nodes from reneging on
+		// uploads.  Prior to that, nodes may replace their descriptor by
+		// uploading one with a higher revision.
+		if s.documents[epoch] != nil || revision <= prev.revision {
+			return errConflict
+		}
+	} else if s.documents[epoch] != nil {
+		// Ok, this is a new descriptor.  If there is a document already,
+		// the descriptor is late, and will never appear in a document, so
+		// reject it.
+		return errLate
+	}
+
+	// Persist the raw descriptor to disk, retaining the superseded
+	// revision (if any) for the sake of auditing.
+	var superseded *SupersededDescriptor
+	if prev != nil {
+		superseded = &SupersededDescriptor{
+			Epoch:       epoch,
+			IdentityKey: pk,
+			Revision:    prev.revision,
+			Raw:         prev.raw,
 		}
-		eBkt.Put(pk[:], rawDesc)
-		return nil
-	}); err != nil {
+	}
+	if err := s.storage.PutDescriptor(epoch, pk, rawDesc, superseded); err != nil {
 		// Persistence failures are FATAL.
-		s.s.fatalErrCh <- err
+		s.log.Errorf("Failed to persist descriptor: %v", err)
+		s.s.onFatalError(err)
+		return errInternal
 	}
 
 	// Store the raw descriptor and the parsed struct.
 	d := new(descriptor)
 	d.desc = desc
 	d.raw = rawDesc
+	d.revision = revision
 	m[pk] = d
 
+	s.s.events.publish(&DescriptorAcceptedEvent{
+		Epoch:       epoch,
+		IdentityKey: desc.IdentityKey,
+		Revision:    revision,
+		Replaced:    prev != nil,
+		Raw:         rawDesc,
+	})
+	if prev != nil {
+		s.log.Noticef("Node %v: Replaced descriptor for epoch %v (revision %v -> %v).", desc.IdentityKey, epoch, prev.revision, revision)
+	}
 	s.log.Debugf("Node %v: Sucessfully submitted descriptor for epoch %v.", desc.IdentityKey, epoch)
 	s.onUpdate()
 	return nil
 }
 
-func (s *state) documentForEpoch(epoch uint64) ([]byte, error) {
-	const generationDeadline = 45 * time.Minute
+func (s *state) descriptorStatus(pk *eddsa.PublicKey) []*s11n.DescriptorStatus {
+	s.RLock()
+	defer s.RUnlock()
+
+	id := pk.ByteArray()
+	epochs := make([]uint64, 0, len(s.descriptors))
+	for epoch := range s.descriptors {
+		epochs = append(epochs, epoch)
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+
+	var statuses []*s11n.DescriptorStatus
+	for _, epoch := range epochs {
+		d, ok := s.descriptors[epoch][id]
+		if !ok {
+			continue
+		}
+
+		st := &s11n.DescriptorStatus{
+			Epoch:    epoch,
+			Hash:     s11n.DescriptorHash(d.raw),
+			Revision: d.revision,
+		}
+		if doc, ok := s.documents[epoch]; ok {
+			st.HasDocument = true
+			st.Included, st.Layer = isInDocument(doc.doc, pk)
+			st.Standby = s.standby[epoch][id]
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+func isInDocument(doc *pki.Document, pk *eddsa.PublicKey) (bool, uint8) {
+	for layer, nodes := range doc.Topology {
+		for _, desc := range nodes {
+			if desc.IdentityKey.Equal(pk) {
+				return true, uint8(layer)
+			}
+		}
+	}
+	for _, desc := range doc.Providers {
+		if desc.IdentityKey.Equal(pk) {
+			return true, pki.LayerProvider
+		}
+	}
+	return false, 0
+}
+
+func (s *state) documentPublishedCh(epoch uint64) <-chan interface{} {
+	s.Lock()
+	defer s.Unlock()
 
+	// Return a channel that will be closed when the Document for the epoch
+	// is generated, or when it is certain that it never will be.
+	ch, ok := s.docWaiters[epoch]
+	if !ok {
+		ch = make(chan interface{})
+		if _, err := s.documentForEpochLocked(epoch); err != errNotYet {
+			close(ch)
+			return ch
+		}
+		s.docWaiters[epoch] = ch
+	}
+	return ch
+}
+
+func (s *state) documentForEpoch(epoch uint64) ([]byte, error) {
 	s.RLock()
 	defer s.RUnlock()
 
+	return s.documentForEpochLocked(epoch)
+}
+
+func (s *state) documentForEpochLocked(epoch uint64) ([]byte, error) {
+	// Lock is held.
+
+	const generationDeadline = 45 * time.Minute
+
 	// If we have a serialized document, return it.
 	if d, ok := s.documents[epoch]; ok {
 		return d.raw, nil
 	}
 
 	// Otherwise, return an error based on the time.
-	now, _, till := epochtime.Now()
+	now, _, till := s.s.clock.Now()
 	switch epoch {
 	case now:
 		// Check to see if we are doing a bootstrap, and it's possible that
@@ -476,108 +845,78 @@ func (s *state) documentForEpoch(epoch uint64) ([]byte, error) {
 }
 
 func (s *state) restorePersistence() error {
-	const (
-		metadataBucket = "metadata"
-		versionKey     = "version"
-	)
+	// Figure out which epochs to restore for.
+	now, _, _ := s.s.clock.Now()
+	epochs := []uint64{now - 1, now, now + 1}
 
-	return s.db.Update(func(tx *bolt.Tx) error {
-		// Ensure that all the buckets exist.
-		bkt, err := tx.CreateBucketIfNotExists([]byte(metadataBucket))
-		if err != nil {
-			return err
-		}
-		descsBkt, err := tx.CreateBucketIfNotExists([]byte(descriptorsBucket))
-		if err != nil {
-			return err
+	persisted, err := s.storage.Restore(epochs)
+	if err != nil {
+		return err
+	}
+
+	// Restore the documents and descriptors.
+	for _, epoch := range epochs {
+		e, ok := persisted[epoch]
+		if !ok {
+			s.log.Debugf("No persisted state for epoch: %v.", epoch)
+			continue
 		}
-		docsBkt, err := tx.CreateBucketIfNotExists([]byte(documentsBucket))
-		if err != nil {
-			return err
+
+		if rawDoc := e.Document; rawDoc != nil {
+			if doc, err := s11n.VerifyAndParseDocument(rawDoc, s.s.identityKey.PublicKey()); err != nil {
+				// This continues because there's no reason not to load
+				// the descriptors as long as they validate, even if
+				// the document fails to load.
+				s.log.Errorf("Failed to validate persisted document: %v", err)
+			} else if doc.Epoch != epoch {
+				// The document for the wrong epoch was persisted?
+				s.log.Errorf("Persisted document has unexpected epoch: %v", doc.Epoch)
+			} else {
+				s.log.Debugf("Restored Document for epoch %v: %v.", epoch, doc)
+				d := new(document)
+				d.doc = doc
+				d.raw = rawDoc
+				s.documents[epoch] = d
+			}
 		}
 
-		if b := bkt.Get([]byte(versionKey)); b != nil {
-			// Well it looks like we loaded as opposed to created.
-			if len(b) != 1 || b[0] != 0 {
-				return fmt.Errorf("state: incompatible version: %d", uint(b[0]))
+		for pk, rawDesc := range e.Descriptors {
+			desc, revision, err := s11n.VerifyAndParseDescriptorRevision(rawDesc, epoch)
+			if err != nil {
+				s.log.Errorf("Failed to validate persisted descriptor: %v", err)
+				continue
+			}
+			if pk != desc.IdentityKey.ByteArray() {
+				s.log.Errorf("Discarding persisted descriptor: key mismatch")
+				continue
 			}
 
-			// Figure out which epochs to restore for.
-			now, _, _ := epochtime.Now()
-			epochs := []uint64{now - 1, now, now + 1}
-
-			// Restore the documents and descriptors.
-			for _, epoch := range epochs {
-				k := epochToBytes(epoch)
-				if rawDoc := docsBkt.Get(k); rawDoc != nil {
-					if doc, err := s11n.VerifyAndParseDocument(rawDoc, s.s.identityKey.PublicKey()); err != nil {
-						// This continues because there's no reason not to load
-						// the descriptors as long as they validate, even if
-						// the document fails to load.
-						s.log.Errorf("Failed to validate persisted document: %v", err)
-					} else if doc.Epoch != epoch {
-						// The document for the wrong epoch was persisted?
-						s.log.Errorf("Persisted document has unexpected epoch: %v", doc.Epoch)
-					} else {
-						s.log.Debugf("Restored Document for epoch %v: %v.", epoch, doc)
-						d := new(document)
-						d.doc = doc
-						d.raw = rawDoc
-						s.documents[epoch] = d
-					}
-				}
-
-				eDescsBkt := descsBkt.Bucket(k)
-				if eDescsBkt == nil {
-					s.log.Debugf("No persisted Descriptors for epoch: %v.", epoch)
-					continue
-				}
-
-				c := eDescsBkt.Cursor()
-				for pk, rawDesc := c.First(); pk != nil; pk, rawDesc = c.Next() {
-					desc, err := s11n.VerifyAndParseDescriptor(rawDesc, epoch)
-					if err != nil {
-						s.log.Errorf("Failed to validate persisted descriptor: %v", err)
-						continue
-					}
-					if !bytes.Equal(pk, desc.IdentityKey.Bytes()) {
-						s.log.Errorf("Discarding persisted descriptor: key mismatch")
-						continue
-					}
-
-					if !s.isDescriptorAuthorized(desc) {
-						s.log.Warningf("Discarding persisted descriptor: %v", desc)
-						continue
-					}
-
-					m, ok := s.descriptors[epoch]
-					if !ok {
-						m = make(map[[eddsa.PublicKeySize]byte]*descriptor)
-						s.descriptors[epoch] = m
-					}
-
-					d := new(descriptor)
-					d.desc = desc
-					d.raw = rawDesc
-					m[desc.IdentityKey.ByteArray()] = d
-
-					s.log.Debugf("Restored descriptor for epoch %v: %+v", epoch, desc)
-				}
+			if !s.isDescriptorAuthorized(desc) {
+				s.log.Warningf("Discarding persisted descriptor: %v", desc)
+				continue
 			}
 
-			return nil
-		}
+			m, ok := s.descriptors[epoch]
+			if !ok {
+				m = make(map[[eddsa.PublicKeySize]byte]*descriptor)
+				s.descriptors[epoch] = m
+			}
 
-		// We created a new database, so populate the new `metadata` bucket.
-		bkt.Put([]byte(versionKey), []byte{0})
+			d := new(descriptor)
+			d.desc = desc
+			d.raw = rawDesc
+			d.revision = revision
+			m[pk] = d
 
-		return nil
-	})
+			s.log.Debugf("Restored descriptor for epoch %v: %+v", epoch, desc)
+		}
+		s.restoreStandby(epoch)
+	}
+
+	return nil
 }
 
 func newState(s *Server) (*state, error) {
-	const dbFile = "persistence.db"
-
 	st := new(state)
 	st.s = s
 	st.log = s.logBackend.GetLogger("state")
@@ -597,15 +936,22 @@ func newState(s *Server) (*state, error) {
 
 	st.documents = make(map[uint64]*document)
 	st.descriptors = make(map[uint64]map[[eddsa.PublicKeySize]byte]*descriptor)
-
-	// Initialize the persistence store and restore state.
-	dbPath := filepath.Join(s.cfg.Authority.DataDir, dbFile)
-	var err error
-	if st.db, err = bolt.Open(dbPath, 0600, nil); err != nil {
-		return nil, err
+	st.standby = make(map[uint64]map[[eddsa.PublicKeySize]byte]bool)
+	st.docWaiters = make(map[uint64]chan interface{})
+
+	// Initialize the persistence store (unless one was provided), and
+	// restore state.
+	if st.storage = s.storage; st.storage == nil {
+		var err error
+		if st.storage, err = newBoltStorage(s.cfg.Authority.DataDir, s.cfg.Authority.ReadOnly); err != nil {
+			return nil, err
+		}
 	}
-	if err = st.restorePersistence(); err != nil {
-		st.db.Close()
+	if err := st.restorePersistence(); err != nil {
+		if s.storage == nil {
+			// A provided Storage is closed by New.
+			st.storage.Close()
+		}
 		return nil, err
 	}
 
@@ -616,7 +962,7 @@ func newState(s *Server) (*state, error) {
 	//  * (Checked in worker) *All* nodes publish a descriptor.
 	//
 	// This could be relaxed a bit, but it's primarily intended for debugging.
-	epoch, _, _ := epochtime.Now()
+	epoch, _, _ := s.clock.Now()
 	if _, ok := st.documents[epoch]; !ok {
 		st.bootstrapEpoch = epoch
 	}
@@ -624,9 +970,3 @@ func newState(s *Server) (*state, error) {
 	st.Go(st.worker)
 	return st, nil
 }
-
-func epochToBytes(e uint64) []byte {
-	ret := make([]byte, 8)
-	binary.BigEndian.PutUint64(ret, e)
-	return ret
-}
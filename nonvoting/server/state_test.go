@@ -0,0 +1,434 @@
+// state_test.go - Non-voting authority state tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/authority/nonvoting/internal/s11n"
+	"github.com/katzenpost/authority/nonvoting/server/config"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testEpoch = 0x23
+
+type testClock struct {
+	epoch uint64
+	till  time.Duration
+}
+
+func (c *testClock) Now() (uint64, time.Duration, time.Duration) {
+	return c.epoch, 3*time.Hour - c.till, c.till
+}
+
+func newTestState(t *testing.T, topology *config.Topology) *state {
+	logBackend, err := log.New("", "DEBUG", true)
+	require.NoError(t, err, "log.New()")
+	return &state{
+		log: logBackend.GetLogger("state"),
+		s: &Server{
+			cfg: &config.Config{
+				Authority: &config.Authority{},
+				Topology:  topology,
+			},
+		},
+		documents:   make(map[uint64]*document),
+		descriptors: make(map[uint64]map[[eddsa.PublicKeySize]byte]*descriptor),
+		standby:     make(map[uint64]map[[eddsa.PublicKeySize]byte]bool),
+	}
+}
+
+func newTestDescriptor(t *testing.T, layer uint8) *descriptor {
+	require := require.New(t)
+
+	identityKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "ecdh.NewKeypair()")
+	mixKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "ecdh.NewKeypair()")
+
+	d := &pki.MixDescriptor{
+		Name:        identityKey.PublicKey().String()[:8],
+		IdentityKey: identityKey.PublicKey(),
+		LinkKey:     linkKey.PublicKey(),
+		MixKeys:     map[uint64]*ecdh.PublicKey{testEpoch: mixKey.PublicKey()},
+		Addresses: map[pki.Transport][]string{
+			pki.TransportTCPv4: []string{"192.0.2.1:4242"},
+		},
+		Layer: layer,
+	}
+	signed, err := s11n.SignDescriptor(identityKey, d)
+	require.NoError(err, "SignDescriptor()")
+	return &descriptor{desc: d, raw: []byte(signed)}
+}
+
+// addTestDescriptors adds descriptors for nrProviders providers and nrNodes
+// mixes to the state for the epoch, and authorizes them.
+func addTestDescriptors(t *testing.T, st *state, epoch uint64, nrProviders, nrNodes int) []*descriptor {
+	m := st.descriptors[epoch]
+	if m == nil {
+		m = make(map[[eddsa.PublicKeySize]byte]*descriptor)
+		st.descriptors[epoch] = m
+	}
+	var nodes []*descriptor
+	for i := 0; i < nrProviders+nrNodes; i++ {
+		var layer uint8
+		if i < nrProviders {
+			layer = pki.LayerProvider
+		}
+		d := newTestDescriptor(t, layer)
+		m[d.desc.IdentityKey.ByteArray()] = d
+		if layer == pki.LayerProvider {
+			st.s.cfg.Providers = append(st.s.cfg.Providers, &config.Node{Identifier: d.desc.IdentityKey.String(), IdentityKey: d.desc.IdentityKey})
+		} else {
+			st.s.cfg.Mixes = append(st.s.cfg.Mixes, &config.Node{IdentityKey: d.desc.IdentityKey})
+			nodes = append(nodes, d)
+		}
+	}
+	return nodes
+}
+
+// setTestDocument sets the document for the epoch, with the given topology.
+func setTestDocument(st *state, epoch uint64, layers [][]*descriptor) {
+	doc := &pki.Document{Epoch: epoch}
+	for _, nodes := range layers {
+		var l []*pki.MixDescriptor
+		for _, v := range nodes {
+			l = append(l, v.desc)
+		}
+		doc.Topology = append(doc.Topology, l)
+	}
+	st.documents[epoch] = &document{doc: doc}
+}
+
+func TestReadinessReport(t *testing.T) {
+	assert := assert.New(t)
+
+	minProviders := 1
+	st := newTestState(t, &config.Topology{
+		Layers:           3,
+		MinNodesPerLayer: 2,
+		MinProviders:     &minProviders,
+	})
+
+	r := st.readinessReport(testEpoch)
+	assert.False(r.IsReady(), "IsReady(): empty")
+	assert.Equal([]int{0, 0, 0}, r.LayerNodes, "LayerNodes: empty")
+
+	addTestDescriptors(t, st, testEpoch, 1, 5)
+	r = st.readinessReport(testEpoch)
+	assert.False(r.IsReady(), "IsReady(): 5 nodes")
+	assert.Equal(1, r.Providers, "Providers")
+	assert.Equal(5, r.Nodes, "Nodes")
+	assert.Len(r.MissingMixes, 0, "MissingMixes")
+
+	addTestDescriptors(t, st, testEpoch, 0, 1)
+	r = st.readinessReport(testEpoch)
+	assert.True(r.IsReady(), "IsReady(): 6 nodes")
+	assert.Equal([]int{2, 2, 2}, r.LayerNodes, "LayerNodes: 6 nodes")
+
+	// A node that is authorized, but has not uploaded is reported missing.
+	k, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(t, err, "eddsa.NewKeypair()")
+	st.s.cfg.Mixes = append(st.s.cfg.Mixes, &config.Node{IdentityKey: k.PublicKey()})
+	r = st.readinessReport(testEpoch)
+	assert.Equal([]*eddsa.PublicKey{k.PublicKey()}, r.MissingMixes, "MissingMixes")
+
+	// The per-layer minimum accounts for standby nodes.
+	st.s.cfg.Topology.MaxNodesPerLayer = 1
+	r = st.readinessReport(testEpoch)
+	assert.False(r.IsReady(), "IsReady(): MaxNodesPerLayer < MinNodesPerLayer")
+	assert.Equal([]int{1, 1, 1}, r.LayerNodes, "LayerNodes: standby")
+	st.s.cfg.Topology.MaxNodesPerLayer = 0
+
+	// Providers are not required if the minimum is explicitly 0.
+	minProviders = 0
+	st2 := newTestState(t, st.s.cfg.Topology)
+	addTestDescriptors(t, st2, testEpoch, 0, 6)
+	r = st2.readinessReport(testEpoch)
+	assert.True(r.IsReady(), "IsReady(): no providers required")
+	assert.Equal(0, r.Providers, "Providers: no providers required")
+}
+
+func TestReadinessReportDeterministic(t *testing.T) {
+	assert := assert.New(t)
+
+	// With the churn limit leaving the layers unbalanced, which of the
+	// smaller layers the new node is assigned to is random, and must be the
+	// same for every report on the same descriptors.
+	minProviders, churn := 0, 0.0
+	st := newTestState(t, &config.Topology{
+		Layers:                3,
+		MinNodesPerLayer:      1,
+		MinProviders:          &minProviders,
+		MaxLayerChurn:         &churn,
+		LayerBalanceTolerance: 3,
+	})
+	nodes := addTestDescriptors(t, st, testEpoch, 0, 7)
+	setTestDocument(st, testEpoch-1, [][]*descriptor{nodes[0:4], nodes[4:5], nodes[5:6]})
+
+	r := st.readinessReport(testEpoch)
+	sizes := append([]int{}, r.LayerNodes...)
+	sort.Ints(sizes)
+	assert.Equal([]int{1, 2, 4}, sizes, "LayerNodes")
+	assert.Equal(0, r.LayerChanges, "LayerChanges")
+	assert.Equal(6, r.ReturningNodes, "ReturningNodes")
+	for i := 0; i < 20; i++ {
+		assert.Equal(r, st.readinessReport(testEpoch), "readinessReport(): %v", i)
+	}
+}
+
+func TestGenerateTopology(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, v := range []struct {
+		name      string
+		layers    int
+		minNodes  int
+		tolerance int
+		churn     float64
+		prev      []int // Nodes per layer in the previous Document.
+		removed   []int // Nodes removed from each previous layer.
+		added     int   // New nodes.
+
+		sizes   []int // Sorted resulting nodes per layer.
+		changed int
+	}{
+		{"Unchanged", 3, 2, 0, 0, []int{3, 3, 3}, nil, 0, []int{3, 3, 3}, 0},
+		{"NewNodes", 3, 2, 0, 0, []int{2, 2, 2}, nil, 3, []int{3, 3, 3}, 0},
+		{"WithinTolerance", 3, 1, 1, 0, []int{3, 3, 3}, []int{2, 0, 0}, 0, []int{1, 3, 3}, 0},
+		{"WithinToleranceUnlimited", 3, 1, 1, 1.0, []int{3, 3, 3}, []int{2, 0, 0}, 0, []int{2, 2, 3}, 1},
+		{"NoTolerance", 3, 1, 0, 0, []int{3, 3, 3}, []int{2, 0, 0}, 0, []int{2, 2, 3}, 1},
+		{"MinNodesPerLayer", 3, 2, 2, 0, []int{3, 3, 3}, []int{2, 0, 0}, 0, []int{2, 2, 3}, 1},
+		{"PartialBudget", 3, 1, 3, 0.25, []int{4, 4, 1}, nil, 0, []int{3, 3, 3}, 2},
+		{"ExhaustedBudget", 3, 1, 3, 0.15, []int{4, 4, 1}, nil, 0, []int{2, 3, 4}, 1},
+	} {
+		churn := v.churn
+		st := newTestState(t, &config.Topology{
+			Layers:                v.layers,
+			MinNodesPerLayer:      v.minNodes,
+			MaxLayerChurn:         &churn,
+			LayerBalanceTolerance: v.tolerance,
+		})
+
+		var prev [][]*descriptor
+		var nodes []*descriptor
+		nrReturning := 0
+		for layer, n := range v.prev {
+			var l []*descriptor
+			for i := 0; i < n; i++ {
+				d := newTestDescriptor(t, 0)
+				l = append(l, d)
+				if v.removed == nil || i >= v.removed[layer] {
+					nodes = append(nodes, d)
+					nrReturning++
+				}
+			}
+			prev = append(prev, l)
+		}
+		for i := 0; i < v.added; i++ {
+			nodes = append(nodes, newTestDescriptor(t, 0))
+		}
+		setTestDocument(st, testEpoch, prev)
+
+		topology, changed, returning := st.generateTopology(nodes, st.documents[testEpoch].doc, rand.NewMath())
+		var sizes []int
+		nrNodes := 0
+		for _, l := range topology {
+			sizes = append(sizes, len(l))
+			nrNodes += len(l)
+		}
+		sort.Ints(sizes)
+		assert.Equal(v.sizes, sizes, "%v: Layer sizes", v.name)
+		assert.Equal(len(nodes), nrNodes, "%v: Nodes", v.name)
+		assert.Equal(v.changed, changed, "%v: Changed", v.name)
+		assert.Equal(nrReturning, returning, "%v: Returning", v.name)
+	}
+}
+
+func TestGenerateTopologyLayersChange(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, v := range []struct {
+		name   string
+		layers int
+		prev   []int // Nodes per layer in the previous Document.
+		sizes  []int // Resulting nodes per layer.
+	}{
+		{"FewerLayers", 2, []int{2, 2, 2}, []int{3, 3}},
+		{"MoreLayers", 3, []int{3, 3}, []int{2, 2, 2}},
+	} {
+		churn := 0.0
+		st := newTestState(t, &config.Topology{
+			Layers:           v.layers,
+			MinNodesPerLayer: 1,
+			MaxLayerChurn:    &churn,
+		})
+
+		var prev [][]*descriptor
+		var nodes []*descriptor
+		prevLayers := make(map[[eddsa.PublicKeySize]byte]int)
+		for layer, n := range v.prev {
+			var l []*descriptor
+			for i := 0; i < n; i++ {
+				d := newTestDescriptor(t, 0)
+				l = append(l, d)
+				nodes = append(nodes, d)
+				prevLayers[d.desc.IdentityKey.ByteArray()] = layer
+			}
+			prev = append(prev, l)
+		}
+		setTestDocument(st, testEpoch, prev)
+
+		// Every node is redistributed into a balanced topology, with the
+		// minimum number of nodes changing layers, regardless of the
+		// churn limit.
+		topology, changed, returning := st.generateTopology(nodes, st.documents[testEpoch].doc, rand.NewMath())
+		require.Len(t, topology, v.layers, "%v: Layers", v.name)
+		nrMoved := 0
+		for layer, l := range topology {
+			assert.Len(l, v.sizes[layer], "%v: Layer %v size", v.name, layer)
+			for _, d := range l {
+				if prevLayers[d.desc.IdentityKey.ByteArray()] != layer {
+					nrMoved++
+				}
+			}
+		}
+		assert.Equal(2, nrMoved, "%v: Moved", v.name)
+		assert.Equal(nrMoved, changed, "%v: Changed", v.name)
+		assert.Equal(len(nodes), returning, "%v: Returning", v.name)
+	}
+}
+
+func TestStandbyNodes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	minProviders := 1
+	st := newTestState(t, &config.Topology{
+		Layers:           2,
+		MinNodesPerLayer: 1,
+		MaxNodesPerLayer: 1,
+		MinProviders:     &minProviders,
+	})
+	identityKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+	st.s.identityKey = identityKey
+	st.s.cfg.Parameters = &config.Parameters{}
+	st.s.events = newEventBus()
+	st.storage = NewMemoryStorage()
+	sub := st.s.Subscribe(0)
+	defer sub.Close()
+
+	nodes := addTestDescriptors(t, st, testEpoch, 1, 3)
+	r := st.readinessReport(testEpoch)
+	assert.True(r.IsReady(), "IsReady()")
+	assert.Equal(1, r.Standby, "Standby")
+
+	st.generateDocument(testEpoch)
+	require.NotNil(st.documents[testEpoch], "generateDocument()")
+	standby := st.standbyNodes(testEpoch)
+	require.Len(standby, 1, "standbyNodes()")
+	standbyKey := standby[0].desc.IdentityKey
+
+	// The standby node's descriptor status reflects that it was withheld.
+	for _, v := range nodes {
+		statuses := st.descriptorStatus(v.desc.IdentityKey)
+		require.Len(statuses, 1, "descriptorStatus()")
+		isStandby := v.desc.IdentityKey.Equal(standbyKey)
+		assert.True(statuses[0].HasDocument, "HasDocument")
+		assert.Equal(!isStandby, statuses[0].Included, "Included")
+		assert.Equal(isStandby, statuses[0].Standby, "Standby")
+	}
+
+	// As does the missing node event.
+	nrMissing := 0
+	for done := false; !done; {
+		select {
+		case ev := <-sub.C():
+			if e, ok := ev.(*NodeMissingEvent); ok {
+				nrMissing++
+				assert.True(e.IdentityKey.Equal(standbyKey), "NodeMissingEvent: IdentityKey")
+				assert.True(e.Standby, "NodeMissingEvent: Standby")
+			}
+		default:
+			done = true
+		}
+	}
+	assert.Equal(1, nrMissing, "NodeMissingEvents")
+
+	// The standby nodes are recovered when the state is restored.
+	delete(st.standby, testEpoch)
+	assert.Len(st.standbyNodes(testEpoch), 0, "standbyNodes(): cleared")
+	st.restoreStandby(testEpoch)
+	standby = st.standbyNodes(testEpoch)
+	require.Len(standby, 1, "standbyNodes(): restored")
+	assert.True(standby[0].desc.IdentityKey.Equal(standbyKey), "standbyNodes(): restored node")
+}
+
+func TestDocumentWaiters(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &testClock{epoch: testEpoch, till: 2 * time.Hour}
+	st := newTestState(t, &config.Topology{})
+	st.s.clock = clock
+	st.docWaiters = make(map[uint64]chan interface{})
+
+	isClosed := func(ch <-chan interface{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// Documents for the current epoch will never be generated, unless
+	// bootstrapping.
+	assert.True(isClosed(st.documentPublishedCh(testEpoch)), "Current epoch")
+	st.bootstrapEpoch = testEpoch
+	bootstrapCh := st.documentPublishedCh(testEpoch)
+	assert.False(isClosed(bootstrapCh), "Current epoch: bootstrap")
+
+	// The Document for the next epoch may be generated till the deadline.
+	nextCh := st.documentPublishedCh(testEpoch + 1)
+	assert.False(isClosed(nextCh), "Next epoch")
+	st.releaseWaiters()
+	assert.False(isClosed(nextCh), "Next epoch: before deadline")
+
+	// Past the deadline, the waiters are released immediately.
+	clock.till = 30 * time.Minute
+	st.releaseWaiters()
+	assert.True(isClosed(nextCh), "Next epoch: past deadline")
+	assert.True(isClosed(st.documentPublishedCh(testEpoch+1)), "Next epoch: new waiter past deadline")
+	assert.False(isClosed(bootstrapCh), "Current epoch: bootstrap, past deadline")
+
+	// As are the waiters for Documents that already exist.
+	setTestDocument(st, testEpoch, nil)
+	st.releaseWaiters()
+	assert.True(isClosed(bootstrapCh), "Current epoch: bootstrap, generated")
+	assert.Len(st.docWaiters, 0, "No waiters left")
+}
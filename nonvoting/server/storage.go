@@ -0,0 +1,461 @@
+// storage.go - Katzenpost non-voting authority persistence.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/katzenpost/core/crypto/eddsa"
+)
+
+const (
+	metadataBucket    = "metadata"
+	descriptorsBucket = "descriptors"
+	documentsBucket   = "documents"
+	supersededBucket  = "superseded"
+	versionKey        = "version"
+)
+
+// Storage is a persistence backend for the authority's descriptors and
+// documents.  All of the data passed to a Storage is signed, and is
+// validated by the authority when restored.
+type Storage interface {
+	// Restore returns the persisted state for each of the requested epochs
+	// that has any.
+	Restore(epochs []uint64) (map[uint64]*PersistedEpoch, error)
+
+	// PutDescriptor persists the signed descriptor for the node's identity
+	// key and epoch.  If the descriptor replaces a previous revision, the
+	// previous revision is provided as superseded, and should be retained
+	// for the sake of auditing.
+	PutDescriptor(epoch uint64, id [eddsa.PublicKeySize]byte, raw []byte, superseded *SupersededDescriptor) error
+
+	// PutDocument persists the signed document for the epoch.
+	PutDocument(epoch uint64, raw []byte) error
+
+	// Superseded returns the descriptors retained for auditing for the
+	// epoch, ordered by node identity key and revision.
+	Superseded(epoch uint64) ([]*SupersededDescriptor, error)
+
+	// Close flushes and closes the Storage.
+	Close() error
+}
+
+// PersistedEpoch is the persisted state for a single epoch.
+type PersistedEpoch struct {
+	// Document is the signed Document, if any.
+	Document []byte
+
+	// Descriptors are the signed descriptors, by node identity key.
+	Descriptors map[[eddsa.PublicKeySize]byte][]byte
+}
+
+// SupersededDescriptor is a descriptor that was replaced by a descriptor
+// with a higher revision.
+type SupersededDescriptor struct {
+	// Epoch is the epoch of the replaced descriptor.
+	Epoch uint64
+
+	// IdentityKey is the identity key of the node that uploaded the
+	// replaced descriptor.
+	IdentityKey [eddsa.PublicKeySize]byte
+
+	// Revision is the revision of the replaced descriptor.
+	Revision uint64
+
+	// Raw is the replaced signed descriptor.
+	Raw []byte
+}
+
+type boltStorage struct {
+	db *bolt.DB
+
+	// snapshotPath is the path of the consistent copy of the persistence
+	// store that is exported for read-only instances, iff this instance
+	// owns the store.
+	snapshotPath string
+}
+
+func (st *boltStorage) Restore(epochs []uint64) (map[uint64]*PersistedEpoch, error) {
+	ret := make(map[uint64]*PersistedEpoch)
+	err := st.db.View(func(tx *bolt.Tx) error {
+		descsBkt := tx.Bucket([]byte(descriptorsBucket))
+		docsBkt := tx.Bucket([]byte(documentsBucket))
+
+		for _, epoch := range epochs {
+			e := &PersistedEpoch{
+				Descriptors: make(map[[eddsa.PublicKeySize]byte][]byte),
+			}
+
+			k := epochToBytes(epoch)
+			if rawDoc := docsBkt.Get(k); rawDoc != nil {
+				e.Document = append([]byte{}, rawDoc...)
+			}
+			if eDescsBkt := descsBkt.Bucket(k); eDescsBkt != nil {
+				c := eDescsBkt.Cursor()
+				for pk, rawDesc := c.First(); pk != nil; pk, rawDesc = c.Next() {
+					var id [eddsa.PublicKeySize]byte
+					if len(pk) != len(id) {
+						return fmt.Errorf("state: persisted descriptor has malformed key: %x", pk)
+					}
+					copy(id[:], pk)
+					e.Descriptors[id] = append([]byte{}, rawDesc...)
+				}
+			}
+
+			if e.Document != nil || len(e.Descriptors) > 0 {
+				ret[epoch] = e
+			}
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func (st *boltStorage) PutDescriptor(epoch uint64, id [eddsa.PublicKeySize]byte, raw []byte, superseded *SupersededDescriptor) error {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		eKey := epochToBytes(epoch)
+		if superseded != nil {
+			bkt := tx.Bucket([]byte(supersededBucket))
+			eBkt, err := bkt.CreateBucketIfNotExists(eKey)
+			if err != nil {
+				return err
+			}
+			var rev [8]byte
+			binary.BigEndian.PutUint64(rev[:], superseded.Revision)
+			if err = eBkt.Put(append(id[:], rev[:]...), superseded.Raw); err != nil {
+				return err
+			}
+		}
+
+		bkt := tx.Bucket([]byte(descriptorsBucket))
+		eBkt, err := bkt.CreateBucketIfNotExists(eKey)
+		if err != nil {
+			return err
+		}
+		return eBkt.Put(id[:], raw)
+	})
+}
+
+func (st *boltStorage) PutDocument(epoch uint64, raw []byte) error {
+	err := st.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(documentsBucket))
+		return bkt.Put(epochToBytes(epoch), raw)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Read-only instances only care about documents, so the snapshot is
+	// only refreshed when one is generated.
+	return st.exportSnapshot()
+}
+
+func (st *boltStorage) Superseded(epoch uint64) ([]*SupersededDescriptor, error) {
+	var ret []*SupersededDescriptor
+	err := st.db.View(func(tx *bolt.Tx) error {
+		// Snapshots exported prior to auditing lack the bucket entirely.
+		bkt := tx.Bucket([]byte(supersededBucket))
+		if bkt == nil {
+			return nil
+		}
+		eBkt := bkt.Bucket(epochToBytes(epoch))
+		if eBkt == nil {
+			return nil
+		}
+		c := eBkt.Cursor()
+		for k, raw := c.First(); k != nil; k, raw = c.Next() {
+			if len(k) != eddsa.PublicKeySize+8 {
+				return fmt.Errorf("state: superseded descriptor has malformed key: %x", k)
+			}
+			d := &SupersededDescriptor{
+				Epoch:    epoch,
+				Revision: binary.BigEndian.Uint64(k[eddsa.PublicKeySize:]),
+				Raw:      append([]byte{}, raw...),
+			}
+			copy(d.IdentityKey[:], k)
+			ret = append(ret, d)
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func (st *boltStorage) Close() error {
+	st.db.Sync()
+	return st.db.Close()
+}
+
+// exportSnapshot atomically replaces the snapshot with a consistent copy of
+// the persistence store.
+func (st *boltStorage) exportSnapshot() error {
+	f, err := ioutil.TempFile(filepath.Dir(st.snapshotPath), filepath.Base(st.snapshotPath)+".")
+	if err != nil {
+		return err
+	}
+	err = st.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(f)
+		return err
+	})
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		// Instances that have the previous snapshot open keep reading
+		// it, as it is replaced rather than modified.
+		err = os.Rename(f.Name(), st.snapshotPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("state: failed to export snapshot: %v", err)
+	}
+	return nil
+}
+
+func (st *boltStorage) init(readOnly bool) error {
+	fn := func(tx *bolt.Tx) error {
+		// Ensure that all the buckets exist.
+		var bkt *bolt.Bucket
+		if tx.Writable() {
+			var err error
+			for _, v := range []string{metadataBucket, descriptorsBucket, documentsBucket, supersededBucket} {
+				if _, err = tx.CreateBucketIfNotExists([]byte(v)); err != nil {
+					return err
+				}
+			}
+			bkt = tx.Bucket([]byte(metadataBucket))
+		} else {
+			bkt = tx.Bucket([]byte(metadataBucket))
+			if bkt == nil || tx.Bucket([]byte(descriptorsBucket)) == nil || tx.Bucket([]byte(documentsBucket)) == nil {
+				return fmt.Errorf("state: persistence store is not initialized")
+			}
+		}
+
+		if b := bkt.Get([]byte(versionKey)); b != nil {
+			// Well it looks like we loaded as opposed to created.
+			if len(b) != 1 || b[0] != 0 {
+				return fmt.Errorf("state: incompatible version: %d", uint(b[0]))
+			}
+			return nil
+		}
+
+		// We created a new database, so populate the new `metadata` bucket.
+		return bkt.Put([]byte(versionKey), []byte{0})
+	}
+
+	if readOnly {
+		return st.db.View(fn)
+	}
+	return st.db.Update(fn)
+}
+
+func newBoltStorage(dataDir string, readOnly bool) (*boltStorage, error) {
+	const (
+		dbFile        = "persistence.db"
+		snapshotFile  = "persistence.snapshot.db"
+		dbOpenTimeout = 10 * time.Second
+	)
+
+	snapshotPath := filepath.Join(dataDir, snapshotFile)
+	if readOnly {
+		// Read-only instances run alongside the instance that owns the
+		// DataDir, which holds the store open exclusively, so they open
+		// the snapshot that it exports instead.
+		return newBoltSnapshotStorage(snapshotPath, dbOpenTimeout)
+	}
+	dbPath := filepath.Join(dataDir, dbFile)
+
+	// The DataDir lock should prevent another instance from holding the
+	// store open, but bound the wait regardless so that a stale reader
+	// fails instead of hanging.
+	opts := &bolt.Options{
+		Timeout: dbOpenTimeout,
+	}
+	db, err := bolt.Open(dbPath, 0600, opts)
+	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, fmt.Errorf("state: timed out opening '%v', is another instance running?", dbPath)
+		}
+		return nil, err
+	}
+
+	st := &boltStorage{db: db, snapshotPath: snapshotPath}
+	if err = st.init(false); err == nil {
+		err = st.exportSnapshot()
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+func newBoltSnapshotStorage(snapshotPath string, timeout time.Duration) (*boltStorage, error) {
+	// The snapshot is only ever replaced as a whole, and opening it takes
+	// a shared lock, so it is always consistent.
+	if _, err := os.Stat(snapshotPath); err != nil {
+		return nil, fmt.Errorf("state: no snapshot of the persistence store, has the authority been started? (%v)", err)
+	}
+	opts := &bolt.Options{
+		ReadOnly: true,
+		Timeout:  timeout,
+	}
+	db, err := bolt.Open(snapshotPath, 0600, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &boltStorage{db: db}
+	if err = st.init(true); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+type memoryStorage struct {
+	sync.Mutex
+
+	epochs     map[uint64]*PersistedEpoch
+	superseded map[uint64][]*SupersededDescriptor
+	closed     bool
+}
+
+var errStorageClosed = errors.New("state: storage is closed")
+
+func (st *memoryStorage) Restore(epochs []uint64) (map[uint64]*PersistedEpoch, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	if st.closed {
+		return nil, errStorageClosed
+	}
+	ret := make(map[uint64]*PersistedEpoch)
+	for _, epoch := range epochs {
+		e, ok := st.epochs[epoch]
+		if !ok {
+			continue
+		}
+		ee := &PersistedEpoch{
+			Document:    e.Document,
+			Descriptors: make(map[[eddsa.PublicKeySize]byte][]byte),
+		}
+		for k, v := range e.Descriptors {
+			ee.Descriptors[k] = v
+		}
+		ret[epoch] = ee
+	}
+	return ret, nil
+}
+
+func (st *memoryStorage) PutDescriptor(epoch uint64, id [eddsa.PublicKeySize]byte, raw []byte, superseded *SupersededDescriptor) error {
+	st.Lock()
+	defer st.Unlock()
+
+	if st.closed {
+		return errStorageClosed
+	}
+	if superseded != nil {
+		// The record is keyed by the epoch and node identity key, as
+		// in the bolt backend, regardless of what the caller set.
+		d := *superseded
+		d.Epoch, d.IdentityKey = epoch, id
+		st.superseded[epoch] = append(st.superseded[epoch], &d)
+	}
+	st.getEpoch(epoch).Descriptors[id] = raw
+	return nil
+}
+
+func (st *memoryStorage) PutDocument(epoch uint64, raw []byte) error {
+	st.Lock()
+	defer st.Unlock()
+
+	if st.closed {
+		return errStorageClosed
+	}
+	st.getEpoch(epoch).Document = raw
+	return nil
+}
+
+func (st *memoryStorage) Superseded(epoch uint64) ([]*SupersededDescriptor, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	if st.closed {
+		return nil, errStorageClosed
+	}
+	var ret []*SupersededDescriptor
+	for _, v := range st.superseded[epoch] {
+		d := *v
+		ret = append(ret, &d)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if c := bytes.Compare(ret[i].IdentityKey[:], ret[j].IdentityKey[:]); c != 0 {
+			return c < 0
+		}
+		return ret[i].Revision < ret[j].Revision
+	})
+	return ret, nil
+}
+
+func (st *memoryStorage) Close() error {
+	st.Lock()
+	defer st.Unlock()
+
+	st.closed = true
+	return nil
+}
+
+func (st *memoryStorage) getEpoch(epoch uint64) *PersistedEpoch {
+	e, ok := st.epochs[epoch]
+	if !ok {
+		e = &PersistedEpoch{
+			Descriptors: make(map[[eddsa.PublicKeySize]byte][]byte),
+		}
+		st.epochs[epoch] = e
+	}
+	return e
+}
+
+// NewMemoryStorage returns a Storage that holds everything in memory, and
+// is suitable for testing, or for authorities that do not need to retain
+// state across restarts.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{
+		epochs:     make(map[uint64]*PersistedEpoch),
+		superseded: make(map[uint64][]*SupersededDescriptor),
+	}
+}
+
+func epochToBytes(e uint64) []byte {
+	ret := make([]byte, 8)
+	binary.BigEndian.PutUint64(ret, e)
+	return ret
+}
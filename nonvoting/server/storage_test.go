@@ -0,0 +1,216 @@
+// storage_test.go - Non-voting authority persistence tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/authority/nonvoting/server/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(dataDir string, readOnly bool) *Server {
+	return &Server{
+		cfg: &config.Config{
+			Authority: &config.Authority{
+				DataDir:  dataDir,
+				ReadOnly: readOnly,
+			},
+		},
+	}
+}
+
+func TestLockDataDir(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "authority-test-")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	s := newTestServer(dir, false)
+	require.NoError(s.lockDataDir(), "lockDataDir()")
+	b, err := ioutil.ReadFile(filepath.Join(dir, "authority.lock"))
+	require.NoError(err, "ReadFile(lock)")
+	assert.Equal(fmt.Sprintf("%d\n", os.Getpid()), string(b), "Lock file PID")
+
+	// A second instance must fail immediately, and name the holder.
+	s2 := newTestServer(dir, false)
+	err = s2.lockDataDir()
+	require.Error(err, "lockDataDir(): second instance")
+	assert.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid()), "Lock error")
+
+	// Read-only instances do not take the lock.
+	sRO := newTestServer(dir, true)
+	assert.NoError(sRO.lockDataDir(), "lockDataDir(): read-only")
+	assert.Nil(sRO.dataDirLock, "Read-only lock")
+
+	// Once released, the lock can be taken again.
+	s.unlockDataDir()
+	require.NoError(s2.lockDataDir(), "lockDataDir(): after unlock")
+	s2.unlockDataDir()
+}
+
+func TestBoltStorageReadOnly(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "authority-test-")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	// A read-only instance requires a snapshot from the owning instance.
+	_, err = newBoltStorage(dir, true)
+	assert.Error(err, "newBoltStorage(): read-only, missing snapshot")
+
+	var id [32]byte
+	id[0] = 0x23
+	st, err := newBoltStorage(dir, false)
+	require.NoError(err, "newBoltStorage()")
+	defer st.Close()
+	require.NoError(st.PutDescriptor(42, id, []byte("descriptor"), nil), "PutDescriptor()")
+	require.NoError(st.PutDocument(42, []byte("document")), "PutDocument()")
+
+	// Opening read-only while the writer holds the store open must not
+	// contend with the writer.
+	stRO, err := newBoltStorage(dir, true)
+	require.NoError(err, "newBoltStorage(): read-only")
+
+	m, err := stRO.Restore([]uint64{41, 42})
+	require.NoError(err, "Restore()")
+	require.Len(m, 1, "Restore(): epochs")
+	assert.Equal([]byte("document"), m[42].Document, "Restore(): document")
+	assert.Equal([]byte("descriptor"), m[42].Descriptors[id], "Restore(): descriptor")
+
+	// Refreshing the snapshot does not affect instances that have the
+	// previous one open, and is visible to those that open it afterwards.
+	require.NoError(st.PutDocument(43, []byte("document")), "PutDocument(): after snapshot")
+	m, err = stRO.Restore([]uint64{43})
+	require.NoError(err, "Restore(): after write")
+	assert.Len(m, 0, "Restore(): snapshot is static")
+	assert.Error(stRO.PutDocument(44, []byte("document")), "PutDocument(): read-only")
+	require.NoError(stRO.Close(), "Close(): read-only")
+
+	stRO, err = newBoltStorage(dir, true)
+	require.NoError(err, "newBoltStorage(): read-only, refreshed")
+	defer stRO.Close()
+	m, err = stRO.Restore([]uint64{43})
+	require.NoError(err, "Restore(): refreshed")
+	assert.Equal([]byte("document"), m[43].Document, "Restore(): refreshed document")
+
+	// Nothing but the snapshot is left behind by the exports.
+	matches, err := filepath.Glob(filepath.Join(dir, "persistence.snapshot.db.*"))
+	require.NoError(err, "Glob()")
+	assert.Empty(matches, "Temporary snapshots")
+}
+
+func TestMemoryStorage(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var id [32]byte
+	id[0] = 23
+
+	st := NewMemoryStorage()
+	require.NoError(st.PutDocument(42, []byte("document")), "PutDocument()")
+	require.NoError(st.PutDescriptor(42, id, []byte("descriptor"), nil), "PutDescriptor()")
+	require.NoError(st.PutDescriptor(43, id, []byte("descriptor-1"), nil), "PutDescriptor(): 43")
+
+	m, err := st.Restore([]uint64{41, 42})
+	require.NoError(err, "Restore()")
+	require.Len(m, 1, "Restore(): epochs")
+	assert.Equal([]byte("document"), m[42].Document, "Restore(): document")
+	assert.Equal([]byte("descriptor"), m[42].Descriptors[id], "Restore(): descriptor")
+
+	// Restored epochs are copies, that do not alias the store.
+	m[42].Descriptors[id] = []byte("mutated")
+	m, err = st.Restore([]uint64{42})
+	require.NoError(err, "Restore(): after mutation")
+	assert.Equal([]byte("descriptor"), m[42].Descriptors[id], "Restore(): not aliased")
+
+	// Superseding a descriptor retains the replaced one.
+	require.NoError(st.PutDescriptor(43, id, []byte("descriptor-2"), &SupersededDescriptor{Revision: 0, Raw: []byte("descriptor-1")}), "PutDescriptor(): superseding")
+	m, err = st.Restore([]uint64{43})
+	require.NoError(err, "Restore(): 43")
+	assert.Nil(m[43].Document, "Restore(): no document")
+	assert.Equal([]byte("descriptor-2"), m[43].Descriptors[id], "Restore(): superseding descriptor")
+	testStorageSuperseded(t, st, id)
+
+	// Everything fails once closed.
+	require.NoError(st.Close(), "Close()")
+	_, err = st.Restore([]uint64{42})
+	assert.Equal(errStorageClosed, err, "Restore(): closed")
+	assert.Equal(errStorageClosed, st.PutDocument(44, []byte("document")), "PutDocument(): closed")
+	assert.Equal(errStorageClosed, st.PutDescriptor(44, id, []byte("descriptor"), nil), "PutDescriptor(): closed")
+	_, err = st.Superseded(43)
+	assert.Equal(errStorageClosed, err, "Superseded(): closed")
+}
+
+func TestBoltStorageSuperseded(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "authority-test-")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	var id [32]byte
+	id[0] = 23
+	st, err := newBoltStorage(dir, false)
+	require.NoError(err, "newBoltStorage()")
+	defer st.Close()
+	require.NoError(st.PutDescriptor(43, id, []byte("descriptor-1"), nil), "PutDescriptor(): 43")
+	require.NoError(st.PutDescriptor(43, id, []byte("descriptor-2"), &SupersededDescriptor{Revision: 0, Raw: []byte("descriptor-1")}), "PutDescriptor(): superseding")
+	testStorageSuperseded(t, st, id)
+}
+
+// testStorageSuperseded checks the audit records of a Storage in which id
+// has already superseded revision 0 of its descriptor for epoch 43.
+func testStorageSuperseded(t *testing.T, st Storage, id [32]byte) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// The records are retained per epoch, and are tagged with the epoch
+	// and node identity key even if the caller did not set them.
+	var otherID [32]byte
+	otherID[0] = 42
+	require.NoError(st.PutDescriptor(43, id, []byte("descriptor-3"), &SupersededDescriptor{Revision: 2, Raw: []byte("descriptor-2")}), "PutDescriptor(): superseding again")
+	require.NoError(st.PutDescriptor(43, otherID, []byte("other-2"), &SupersededDescriptor{Revision: 1, Raw: []byte("other-1")}), "PutDescriptor(): other node")
+	require.NoError(st.PutDescriptor(44, id, []byte("descriptor-5"), &SupersededDescriptor{Revision: 4, Raw: []byte("descriptor-4")}), "PutDescriptor(): 44")
+
+	v, err := st.Superseded(43)
+	require.NoError(err, "Superseded()")
+	assert.Equal([]*SupersededDescriptor{
+		{Epoch: 43, IdentityKey: id, Revision: 0, Raw: []byte("descriptor-1")},
+		{Epoch: 43, IdentityKey: id, Revision: 2, Raw: []byte("descriptor-2")},
+		{Epoch: 43, IdentityKey: otherID, Revision: 1, Raw: []byte("other-1")},
+	}, v, "Superseded(): 43")
+
+	v, err = st.Superseded(44)
+	require.NoError(err, "Superseded(): 44")
+	assert.Equal([]*SupersededDescriptor{
+		{Epoch: 44, IdentityKey: id, Revision: 4, Raw: []byte("descriptor-4")},
+	}, v, "Superseded(): 44")
+
+	v, err = st.Superseded(42)
+	require.NoError(err, "Superseded(): none")
+	assert.Empty(v, "Superseded(): none")
+}
@@ -17,21 +17,22 @@
 package server
 
 import (
+	"fmt"
 	"net"
 	"time"
 
 	"github.com/katzenpost/authority/nonvoting/internal/s11n"
 	"github.com/katzenpost/core/crypto/eddsa"
 	"github.com/katzenpost/core/crypto/rand"
-	"github.com/katzenpost/core/epochtime"
 	"github.com/katzenpost/core/wire"
 	"github.com/katzenpost/core/wire/commands"
 )
 
-func (s *Server) onConn(conn net.Conn) {
+func (s *Server) onConn(conn net.Conn, roles listenerRoles) {
 	const (
 		initialDeadline  = 30 * time.Second
 		responseDeadline = 60 * time.Second
+		idleDeadline     = 60 * time.Second
 	)
 
 	rAddr := conn.RemoteAddr()
@@ -39,11 +40,12 @@ func (s *Server) onConn(conn net.Conn) {
 
 	defer func() {
 		conn.Close()
+		<-s.connSem
 		s.Done()
 	}()
 
 	// Initialize the wire protocol session.
-	auth := &wireAuthenticator{s: s}
+	auth := &wireAuthenticator{s: s, roles: roles}
 	cfg := &wire.SessionConfig{
 		Authenticator:     auth,
 		AdditionalData:    s.identityKey.PublicKey().Bytes(),
@@ -70,62 +72,139 @@ func (s *Server) onConn(conn net.Conn) {
 		s.log.Debugf("Peer %v: Failed to receive command: %v", rAddr, err)
 		return
 	}
+
+	// Peers may optionally advertise their capabilities as the first
+	// command, in which case the actual request follows.
+	peerCaps, cmd, ok := s.onFirstCommand(rAddr, wireConn, cmd, roles)
+	if !ok {
+		return
+	}
 	conn.SetDeadline(time.Time{})
 
+	// Peers that support session reuse may issue further commands after
+	// each response, till the session is idle for too long.
+	reuse := peerCaps.HasFeature(s11n.FeatureSessionReuse)
+	for {
+		resp, ok := s.onCommand(rAddr, cmd, roles, auth, peerCaps)
+		if !ok {
+			return
+		}
+
+		// Send the response.
+		conn.SetDeadline(time.Now().Add(responseDeadline))
+		if err = wireConn.SendCommand(resp); err != nil {
+			s.log.Debugf("Peer %v: Failed to send response: %v", rAddr, err)
+			return
+		}
+		if !reuse {
+			return
+		}
+
+		// Receive the next command.
+		conn.SetDeadline(time.Now().Add(idleDeadline))
+		if cmd, err = wireConn.RecvCommand(); err != nil {
+			s.log.Debugf("Peer %v: Closing session: %v", rAddr, err)
+			return
+		}
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// onCommand handles a single command, and returns the response, and false
+// iff the session should be terminated without a response.
+func (s *Server) onCommand(rAddr net.Addr, cmd commands.Command, roles listenerRoles, auth *wireAuthenticator, peerCaps *s11n.Capabilities) (commands.Command, bool) {
+	// Wire protocol extension requests are carried by descriptor uploads,
+	// and are allowed on every listener, subject to per-command checks.
+	if isExtension(cmd) {
+		return s.onExtension(rAddr, cmd.(*commands.PostDescriptor), roles, auth)
+	}
+
+	// Reject commands that are not allowed on this listener, prior to doing
+	// anything else with them.
+	if !roles.allows(cmd) {
+		s.log.Errorf("Peer %v: Command %T not allowed on listener (%v).", rAddr, cmd, roles)
+		return nil, false
+	}
+
 	// Parse the command, and craft the response.
-	var resp commands.Command
 	switch c := cmd.(type) {
 	case *commands.GetConsensus:
-		resp = s.onGetConsensus(rAddr, c)
+		return s.onGetConsensus(rAddr, c), true
 	case *commands.PostDescriptor:
 		if auth.peerIdentityKey == nil {
 			// A client trying to post is actively evil, don't even dignify
 			// it with a response.
 			s.log.Errorf("Peer %v: Not allowed to post.", rAddr)
-			return
-		} else {
-			resp = s.onPostDescriptor(rAddr, c, auth.peerIdentityKey)
+			return nil, false
 		}
+		return s.onPostDescriptor(rAddr, c, auth.peerIdentityKey, peerCaps), true
 	default:
 		s.log.Debugf("Peer %v: Invalid request: %T", rAddr, c)
-		return
-	}
-
-	// Send the response, if any.
-	if resp != nil {
-		conn.SetDeadline(time.Now().Add(responseDeadline))
-		if err = wireConn.SendCommand(resp); err != nil {
-			s.log.Debugf("Peer %v: Failed to send response: %v", rAddr, err)
-		}
+		return nil, false
 	}
 }
 
 func (s *Server) onGetConsensus(rAddr net.Addr, cmd *commands.GetConsensus) commands.Command {
 	resp := &commands.Consensus{}
-	doc, err := s.state.documentForEpoch(cmd.Epoch)
+	resp.ErrorCode, resp.Payload = s.consensusForEpoch(rAddr, cmd.Epoch)
+	return resp
+}
+
+// consensusRangeEpochs returns the epochs of the consensus range that will
+// be serviced, or nil if the range is invalid.
+func consensusRangeEpochs(startEpoch, endEpoch uint64) []uint64 {
+	// Documents are only held for a handful of epochs, so there is no
+	// reason to ever service a larger range than this.
+	const maxRangeEpochs = 8
+
+	if endEpoch < startEpoch {
+		return nil
+	}
+
+	// The peer will treat any omitted entries as errors.  Note: The range
+	// is iterated by count, as the end of the range may be math.MaxUint64.
+	n := endEpoch - startEpoch
+	if n >= maxRangeEpochs {
+		n = maxRangeEpochs - 1
+	}
+	epochs := make([]uint64, 0, n+1)
+	for i := uint64(0); i <= n; i++ {
+		epochs = append(epochs, startEpoch+i)
+	}
+	return epochs
+}
+
+func (s *Server) consensusForEpoch(rAddr net.Addr, epoch uint64) (uint8, []byte) {
+	doc, err := s.state.documentForEpoch(epoch)
 	if err != nil {
-		s.log.Errorf("Peer %v: Failed to retreive document for epoch '%v': %v", rAddr, cmd.Epoch, err)
+		s.log.Errorf("Peer %v: Failed to retreive document for epoch '%v': %v", rAddr, epoch, err)
 		switch err {
 		case errGone:
-			resp.ErrorCode = commands.ConsensusGone
+			return commands.ConsensusGone, nil
 		default:
-			resp.ErrorCode = commands.ConsensusNotFound
+			return commands.ConsensusNotFound, nil
 		}
-	} else {
-		s.log.Debugf("Peer: %v: Serving document for epoch %v.", rAddr, cmd.Epoch)
-		resp.ErrorCode = commands.ConsensusOk
-		resp.Payload = doc
 	}
-	return resp
+
+	s.log.Debugf("Peer: %v: Serving document for epoch %v.", rAddr, epoch)
+	return commands.ConsensusOk, doc
 }
 
-func (s *Server) onPostDescriptor(rAddr net.Addr, cmd *commands.PostDescriptor, pubKey *eddsa.PublicKey) commands.Command {
+func (s *Server) onPostDescriptor(rAddr net.Addr, cmd *commands.PostDescriptor, pubKey *eddsa.PublicKey, peerCaps *s11n.Capabilities) commands.Command {
 	resp := &commands.PostDescriptorStatus{
 		ErrorCode: commands.DescriptorInvalid,
 	}
+	onReject := func(reason RejectReason, err error) {
+		s.events.publish(&DescriptorRejectedEvent{
+			Epoch:       cmd.Epoch,
+			IdentityKey: pubKey,
+			Reason:      reason,
+			Err:         err,
+		})
+	}
 
 	// Ensure the epoch is somewhat sane.
-	now, _, _ := epochtime.Now()
+	now, _, _ := s.clock.Now()
 	switch cmd.Epoch {
 	case now - 1, now, now + 1:
 		// Nodes will always publish the descriptor for the current epoch on
@@ -134,19 +213,29 @@ func (s *Server) onPostDescriptor(rAddr net.Addr, cmd *commands.PostDescriptor,
 	default:
 		// The peer is publishing for an epoch that's invalid.
 		s.log.Errorf("Peer %v: Invalid descriptor epoch '%v'", rAddr, cmd.Epoch)
+		onReject(RejectInvalid, fmt.Errorf("authority: Invalid descriptor epoch: %v", cmd.Epoch))
 		return resp
 	}
 
 	// Validate and deserialize the descriptor.
-	desc, err := s11n.VerifyAndParseDescriptor(cmd.Payload, cmd.Epoch)
-	if err != nil {
+	desc, revision, err := s11n.VerifyAndParseDescriptorRevision(cmd.Payload, cmd.Epoch)
+	if vErr, ok := err.(*s11n.DescriptorVersionError); ok {
+		// Peers that negotiated capabilities were already told which
+		// formats are supported, but legacy peers can only be told that
+		// the descriptor is invalid, so make the cause obvious here.
+		s.log.Warningf("Peer %v: Unsupported descriptor version '%v', the node needs to be upgraded.", rAddr, vErr.Version)
+		onReject(RejectUnsupportedVersion, err)
+		return resp
+	} else if err != nil {
 		s.log.Errorf("Peer %v: Invalid descriptor: %v", rAddr, err)
+		onReject(RejectInvalid, err)
 		return resp
 	}
 
 	// Ensure that the descriptor is signed by the peer that is posting.
 	if !desc.IdentityKey.Equal(pubKey) {
 		s.log.Errorf("Peer %v: Identity key '%v' is not link key '%v'.", rAddr, desc.IdentityKey, pubKey)
+		onReject(RejectForbidden, fmt.Errorf("authority: Identity key '%v' is not link key", desc.IdentityKey))
 		resp.ErrorCode = commands.DescriptorForbidden
 		return resp
 	}
@@ -154,19 +243,30 @@ func (s *Server) onPostDescriptor(rAddr net.Addr, cmd *commands.PostDescriptor,
 	// Ensure that the descriptor is from an allowed peer.
 	if !s.state.isDescriptorAuthorized(desc) {
 		s.log.Errorf("Peer %v: Identity key '%v' not authorized", rAddr, desc.IdentityKey)
+		onReject(RejectForbidden, fmt.Errorf("authority: Identity key '%v' not authorized", desc.IdentityKey))
 		resp.ErrorCode = commands.DescriptorForbidden
 		return resp
 	}
 
 	// Hand the descriptor off to the state worker.  As long as this returns
 	// a nil, the authority "accepts" the descriptor.
-	err = s.state.onDescriptorUpload(cmd.Payload, desc, cmd.Epoch)
+	err = s.state.onDescriptorUpload(cmd.Payload, desc, revision, cmd.Epoch)
 	if err != nil {
-		// This is either a internal server error or the peer is trying to
-		// retroactively modify their descriptor.  This should disambituate
-		// the condition, but the latter is more likely.
-		s.log.Errorf("Peer %v: Rejected probably a conflict: %v", rAddr, err)
-		resp.ErrorCode = commands.DescriptorConflict
+		s.log.Errorf("Peer %v: Rejected descriptor for epoch %v: %v", rAddr, cmd.Epoch, err)
+		resp.ErrorCode = descriptorErrorCode(err, peerCaps)
+		switch err {
+		case errConflict:
+			// The peer is trying to retroactively modify their descriptor.
+			onReject(RejectConflict, err)
+		case errLate:
+			// The document for the epoch already exists.
+			onReject(RejectLate, err)
+		case errReadOnly:
+			onReject(RejectReadOnly, err)
+		default:
+			// Something is wrong with the authority, not the peer.
+			onReject(RejectInternal, err)
+		}
 		return resp
 	}
 
@@ -176,15 +276,37 @@ func (s *Server) onPostDescriptor(rAddr net.Addr, cmd *commands.PostDescriptor,
 	return resp
 }
 
+func descriptorErrorCode(err error, peerCaps *s11n.Capabilities) uint8 {
+	if !peerCaps.HasFeature(s11n.FeatureDescriptorErrorCodes) {
+		// Legacy peers treat all rejections of well formed descriptors
+		// from authorized peers as conflicts.
+		return commands.DescriptorConflict
+	}
+	switch err {
+	case errConflict:
+		return commands.DescriptorConflict
+	case errLate:
+		return s11n.DescriptorLate
+	default:
+		return s11n.DescriptorInternalError
+	}
+}
+
 type wireAuthenticator struct {
 	s               *Server
+	roles           listenerRoles
 	peerIdentityKey *eddsa.PublicKey
 }
 
 func (a *wireAuthenticator) IsPeerValid(creds *wire.PeerCredentials) bool {
-	// Just allow clients to connect with fetch access.
+	// Just allow clients to connect with fetch access, if the listener
+	// allows fetching.
 	switch len(creds.AdditionalData) {
 	case 0:
+		if !a.roles.allowsAnonymous() {
+			a.s.log.Debugf("Rejecting authentication, listener requires an identity key.")
+			return false
+		}
 		return true
 	case eddsa.PublicKeySize:
 	default:
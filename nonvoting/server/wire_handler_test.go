@@ -0,0 +1,67 @@
+// wire_handler_test.go - Non-voting authority connection handler tests.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/katzenpost/authority/nonvoting/internal/s11n"
+	"github.com/katzenpost/core/wire/commands"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsensusRangeEpochs(t *testing.T) {
+	assert := assert.New(t)
+
+	const max = math.MaxUint64
+	for _, v := range []struct {
+		name       string
+		start, end uint64
+		epochs     []uint64
+	}{
+		{"Single", 23, 23, []uint64{23}},
+		{"Range", 23, 25, []uint64{23, 24, 25}},
+		{"Inverted", 25, 23, nil},
+		{"Clamped", 0, 100, []uint64{0, 1, 2, 3, 4, 5, 6, 7}},
+		{"Zero", 0, 0, []uint64{0}},
+		{"MaxSingle", max, max, []uint64{max}},
+		{"MaxRange", max - 2, max, []uint64{max - 2, max - 1, max}},
+		{"MaxClamped", max - 100, max, []uint64{max - 100, max - 99, max - 98, max - 97, max - 96, max - 95, max - 94, max - 93}},
+		{"Full", 0, max, []uint64{0, 1, 2, 3, 4, 5, 6, 7}},
+	} {
+		assert.Equal(v.epochs, consensusRangeEpochs(v.start, v.end), v.name)
+	}
+}
+
+func TestDescriptorErrorCode(t *testing.T) {
+	assert := assert.New(t)
+
+	// Legacy peers must only ever see the status codes they understand.
+	legacyCaps := s11n.LegacyCapabilities()
+	for _, err := range []error{errConflict, errLate, errReadOnly, errors.New("disk on fire")} {
+		assert.Equal(uint8(commands.DescriptorConflict), descriptorErrorCode(err, legacyCaps), "Legacy: %v", err)
+	}
+
+	// Peers that support the status codes are told why.
+	caps := s11n.LocalCapabilities()
+	assert.Equal(uint8(commands.DescriptorConflict), descriptorErrorCode(errConflict, caps), "Conflict")
+	assert.Equal(uint8(s11n.DescriptorLate), descriptorErrorCode(errLate, caps), "Late")
+	assert.Equal(uint8(s11n.DescriptorInternalError), descriptorErrorCode(errReadOnly, caps), "ReadOnly")
+	assert.Equal(uint8(s11n.DescriptorInternalError), descriptorErrorCode(errors.New("disk on fire"), caps), "Internal")
+}